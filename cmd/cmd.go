@@ -1,12 +1,20 @@
 package cmd
 
 import(
+	"os"
+	"fmt"
+	"errors"
+	"io/ioutil"
 	"k8s.io/klog"
 	"github.com/spf13/cobra"
 	"github.com/jwzl/beehive/pkg/core"
+	beehiveConfig "github.com/jwzl/beehive/pkg/common/config"
+	"github.com/jwzl/edgeOn/common/metrics"
 	"github.com/jwzl/edgeOn/msghub"
 	"github.com/jwzl/edgeOn/dgtwin"
 	"github.com/jwzl/edgeOn/eventbus"
+	"github.com/jwzl/edgeOn/dgtwin/config"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
 )
 
 /*
@@ -27,14 +35,170 @@ func NewAppCommand() *cobra.Command {
 			//TODO: To help debugging, immediately log version
 			klog.Infof("###########  Start the edgeOn client...! ###########")
 			registerModules()
+			startMetrics()
 			// start all modules
 			core.Run()
 		},
 	}
+	cmd.AddCommand(NewExportCommand(), NewImportCommand())
 
 	return cmd
 }
 
+/*
+* new export command, dump all twins in store to a JSON/YAML file.
+*/
+func NewExportCommand() *cobra.Command {
+	var file, format, storePath string
+
+	cmd := &cobra.Command{
+		Use: "export",
+		Short: "Export all digital twins to a JSON/YAML file",
+		Long: `Export all digital twins (metadata, desired and reported properties,
+		versions) in the twin store to a JSON/YAML file, the file can be
+		imported on another gateway by "edgeOn import".`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore(storePath)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			twins, err := store.LoadAll()
+			if err != nil {
+				return err
+			}
+			if format == "" {
+				format = dtstore.ArchiveFormat(file)
+			}
+			content, err := dtstore.EncodeArchive(twins, format)
+			if err != nil {
+				return err
+			}
+
+			if file == "" || file == "-" {
+				_, err = cmd.OutOrStdout().Write(content)
+				return err
+			}
+			if err := ioutil.WriteFile(file, content, 0600); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "%d twins exported to %s\n", len(twins), file)
+
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "-", "file to export, - means stdout")
+	cmd.Flags().StringVar(&format, "format", "", "json or yaml, default by the file extension")
+	cmd.Flags().StringVar(&storePath, "store", "", "twin store directory, default is dgtwin.store.path")
+
+	return cmd
+}
+
+/*
+* new import command, restore the twins from a JSON/YAML file.
+*/
+func NewImportCommand() *cobra.Command {
+	var file, format, storePath, mode string
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use: "import",
+		Short: "Import digital twins from a JSON/YAML file",
+		Long: `Import the digital twins which are exported by "edgeOn export" into
+		the twin store. in merge mode, the imported twins replace the saved twins
+		which have same ID and other saved twins are kept; in replace mode, the 
+		saved twins which are not in file are deleted. edgeOn should be stopped
+		while importing.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if file == "" {
+				return errors.New("file to import is required")
+			}
+
+			var content []byte
+			var err error
+			if file == "-" {
+				content, err = ioutil.ReadAll(os.Stdin)
+			}else {
+				content, err = ioutil.ReadFile(file)
+			}
+			if err != nil {
+				return err
+			}
+			if format == "" {
+				format = dtstore.ArchiveFormat(file)
+			}
+			imported, err := dtstore.DecodeArchive(content, format)
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore(storePath)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			saved, err := store.LoadAll()
+			if err != nil {
+				return err
+			}
+			changes, err := dtstore.PlanImport(saved, imported, mode)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			for _, change := range changes {
+				fmt.Fprintln(out, change)
+			}
+			if dryRun {
+				fmt.Fprintf(out, "%d changes (dry run)\n", len(changes))
+				return nil
+			}
+			if err := dtstore.ApplyImport(store, changes); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%d changes applied\n", len(changes))
+
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "file to import, - means stdin")
+	cmd.Flags().StringVar(&format, "format", "", "json or yaml, default by the file extension")
+	cmd.Flags().StringVar(&storePath, "store", "", "twin store directory, default is dgtwin.store.path")
+	cmd.Flags().StringVar(&mode, "mode", dtstore.ImportModeMerge, "merge or replace")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the changes without applying them")
+
+	return cmd
+}
+
+// open the twin store in path, or the configured store.
+func openStore(path string) (dtstore.TwinStore, error) {
+	if path == "" {
+		path = config.GetDGTwinConfig().StorePath
+	}
+
+	return dtstore.NewFileStore(path)
+}
+
+// serve the metrics of all modules, disabled if metrics.url is empty.
+func startMetrics() {
+	url, err := beehiveConfig.CONFIG.GetValue("metrics.url").ToString()
+	if err != nil || url == "" {
+		klog.Infof("metrics.url is empty, metrics server is disabled")
+		return
+	}
+
+	go func() {
+		if err := metrics.Serve(url); err != nil {
+			klog.Errorf("metrics server is stopped (%v)", err)
+		}
+	}()
+}
+
 // register all module into beehive.
 func registerModules(){
 	dgtwin.Register()
@@ -12,18 +12,24 @@ const (
 
 	//BadRequestCode sucess
 	RequestSuccessCode= 200 
+	//MultiStatusCode the twins in bulk request have different results.
+	MultiStatusCode = 207
 	//device is online.
 	OnlineCode= 600 
 	//Close Watch code.
 	CloseWatchCode= 700 
 	//BadRequestCode bad request
 	BadRequestCode = 400
+	//ForbiddenCode source is not allowed by the access policy.
+	ForbiddenCode = 403
 	//NotFoundCode device not found
 	NotFoundCode = 404
 	//ConflictCode version conflict
 	ConflictCode = 409
 	//InternalErrorCode server internal error
 	InternalErrorCode = 500
+	//DeliveryFailedCode message can't be delivered to target.
+	DeliveryFailedCode = 504
 	//DeviceFound device is found. 
 	DeviceFound		= 600
 	// DeviceNotReady device is not ready.
@@ -40,6 +46,11 @@ const (
 	DGTWINS_OPS_SYNC		= "Sync"
 	DGTWINS_OPS_DETECT		= "Detect"
 	DGTWINS_OPS_KEEPALIVE		= "Keepalive"
+	DGTWINS_OPS_HISTORY		= "History"
+	DGTWINS_OPS_AUDIT		= "Audit"
+	DGTWINS_OPS_INVOKE		= "Invoke"
+	// the message to cloud is queued by hub, and hub will deliver it.
+	DGTWINS_OPS_QUEUED		= "Queued"
 
 	//State
 	DGTWINS_STATE_CREATED	= "created"	
@@ -51,6 +62,22 @@ const (
 	DGTWINS_RESOURCE_TWINS	="twins"
 	DGTWINS_RESOURCE_PROPERTY	="property"
 	DGTWINS_RESOURCE_DEVICE	="device"
+	DGTWINS_RESOURCE_LIFECYCLE	="lifecycle"
+	DGTWINS_RESOURCE_METHOD	="method"
+
+	// lifecycle events of twin.
+	LIFECYCLE_EVENT_CREATED		= "created"
+	// device is online at the first time after the twin is created.
+	LIFECYCLE_EVENT_FIRSTSEEN	= "firstseen"
+	LIFECYCLE_EVENT_ONLINE		= "online"
+	LIFECYCLE_EVENT_OFFLINE		= "offline"
+	LIFECYCLE_EVENT_DELETED		= "deleted"
+
+	// reasons of the device state change.
+	LIFECYCLE_REASON_DETECTED		= "device detected"
+	LIFECYCLE_REASON_DETECT_TIMEOUT	= "detect timeout"
+	LIFECYCLE_REASON_DELIVERY_FAILED	= "delivery failed"
+	LIFECYCLE_REASON_REPORTED		= "reported by device"
 
 	HubModuleName	=  "edge/hub"
 	CloudName		= "cloud"
@@ -58,18 +85,175 @@ const (
 	TwinModuleName	= "edge/dgtwin"
 	BusModuleName	= "edge/eventbus"
 	DeviceName		= "device"
+
+	// metric label of the operations and resources which are not known.
+	METRIC_LABEL_OTHER	= "other"
 )
 
+var metricOperations = map[string]bool{
+	DGTWINS_OPS_CREATE: true, DGTWINS_OPS_UPDATE: true, DGTWINS_OPS_DELETE: true,
+	DGTWINS_OPS_GET: true, DGTWINS_OPS_List: true, DGTWINS_OPS_RESPONSE: true,
+	DGTWINS_OPS_WATCH: true, DGTWINS_OPS_SYNC: true, DGTWINS_OPS_DETECT: true,
+	DGTWINS_OPS_KEEPALIVE: true, DGTWINS_OPS_HISTORY: true, DGTWINS_OPS_AUDIT: true,
+	DGTWINS_OPS_INVOKE: true, DGTWINS_OPS_QUEUED: true,
+}
+
+var metricResources = map[string]bool{
+	DGTWINS_RESOURCE_EDGE: true, DGTWINS_RESOURCE_TWINS: true, DGTWINS_RESOURCE_PROPERTY: true,
+	DGTWINS_RESOURCE_DEVICE: true, DGTWINS_RESOURCE_LIFECYCLE: true, DGTWINS_RESOURCE_METHOD: true,
+}
+
+// MetricLabels return the operation and resource as the labels of message
+// metrics. they may come from devices or apps (e.g. device topic), so the
+// unknown ones are "other" to keep the count of label values bounded.
+func MetricLabels(operation, resource string) (string, string) {
+	if !metricOperations[operation] {
+		operation = METRIC_LABEL_OTHER
+	}
+	if !metricResources[resource] {
+		resource = METRIC_LABEL_OTHER
+	}
+
+	return operation, resource
+}
+
 //Create/update/Delete/Get twins message format
 type TwinMessage struct{	
 	Twins  []DigitalTwin 	`json:"twins"`
 }
 
+//List twins message format, all filters are optional.
+type TwinListMessage struct{
+	// filter by twin's state (created/online/offline).
+	State		string			`json:"state,omitempty"`
+	// filter by the prefix of twin's name.
+	NamePrefix	string			`json:"nameprefix,omitempty"`
+	// filter by metadata, twin should has all these metadata,
+	// metadata with empty value just match the name. 
+	MetaData	[]MetaType		`json:"metadata,omitempty"`
+	// max twins in a page.
+	PageSize	int				`json:"pagesize,omitempty"`
+	// continue token from the last page.
+	Continue	string			`json:"continue,omitempty"`
+}
+
+//History query message format, query the reported values of properties in
+// the time range [Start, End] of a twin.
+type TwinHistoryMessage struct{
+	TwinID		string			`json:"twinid"`
+	// reported property names, empty means all properties.
+	Names		[]string		`json:"names,omitempty"`
+	// time range in millisecond, 0 means no limit.
+	Start		int64			`json:"start,omitempty"`
+	End			int64			`json:"end,omitempty"`
+	// bucket size (millisecond) for downsampling, 0 means all values are returned.
+	Interval	int64			`json:"interval,omitempty"`
+}
+
+//Method message format, invoke the method of twin with the params. it's
+// delivered to the device as is.
+type MethodMessage struct{
+	TwinID		string			`json:"twinid"`
+	Method		string			`json:"method"`
+	Params		json.RawMessage	`json:"params,omitempty"`
+	// timeout (millisecond) to wait for the result, 0 means the default.
+	Timeout		int64			`json:"timeout,omitempty"`
+}
+
+// MethodResult is the result of method which is returned by device.
+type MethodResult struct{
+	TwinID		string			`json:"twinid"`
+	Method		string			`json:"method"`
+	Result		json.RawMessage	`json:"result,omitempty"`
+}
+
+//Audit query message format, query the audit records of a twin in the
+// time range [Start, End].
+type TwinAuditMessage struct{
+	// empty means all twins.
+	TwinID		string			`json:"twinid,omitempty"`
+	// time range in millisecond, 0 means no limit.
+	Start		int64			`json:"start,omitempty"`
+	End			int64			`json:"end,omitempty"`
+	// max records in a page.
+	PageSize	int				`json:"pagesize,omitempty"`
+	// continue token from the last page.
+	Continue	string			`json:"continue,omitempty"`
+}
+
+// AuditRecord is a mutation of twin, the property is empty for the mutation
+// of whole twin (create/delete) whose values are the twin.
+type AuditRecord struct{
+	// millisecond.
+	Timestamp	int64			`json:"timestamp"`
+	// who changed the twin, the source of message.
+	Source		string			`json:"source"`
+	Operation	string			`json:"operation"`
+	MessageID	string			`json:"messageid,omitempty"`
+	TwinID		string			`json:"twinid"`
+	// desired or reported.
+	Kind		string			`json:"kind,omitempty"`
+	Property	string			`json:"property,omitempty"`
+	OldValue	[]byte			`json:"oldvalue,omitempty"`
+	NewValue	[]byte			`json:"newvalue,omitempty"`
+}
+
+// HistoryPoint is a property value at Timestamp (millisecond). for downsampled
+// history, it's a bucket starting at Timestamp, Count is the number of values
+// and Min/Max/Avg are set for numeric values, Value is the last value in bucket.
+type HistoryPoint struct{
+	Timestamp	int64			`json:"timestamp"`
+	Value		[]byte			`json:"value"`
+	Count		int				`json:"count,omitempty"`
+	Min			*float64		`json:"min,omitempty"`
+	Max			*float64		`json:"max,omitempty"`
+	Avg			*float64		`json:"avg,omitempty"`
+}
+
+// PropertyHistory is the history of a reported property.
+type PropertyHistory struct{
+	TwinID		string			`json:"twinid"`
+	Name		string			`json:"name"`
+	Type		string			`json:"type,omitempty"`
+	Points		[]HistoryPoint	`json:"points"`
+}
+
 // Response message format
 type TwinResponse struct{
 	Code   int    			`json:"code"`
 	Reason string 			`json:"reason,omitempty"`
 	Twins  []DigitalTwin		`json:"twins,omitempty"`
+	// result for each requested property.
+	Results	[]PropertyResult	`json:"results,omitempty"`
+	// result for each requested twin.
+	TwinResults	[]TwinResult	`json:"twinresults,omitempty"`
+	// continue token for the next page of List or Audit, empty means the last page.
+	Continue	string			`json:"continue,omitempty"`
+	// device models referenced by the twins.
+	Models	[]DeviceModel		`json:"models,omitempty"`
+	// history of properties.
+	History	[]PropertyHistory	`json:"history,omitempty"`
+	// audit records of twins.
+	Audit	[]AuditRecord		`json:"audit,omitempty"`
+	// result of method.
+	Method	*MethodResult		`json:"method,omitempty"`
+}
+
+// TwinResult is the result of a single twin in the request.
+type TwinResult struct{
+	TwinID	string			`json:"twinid"`
+	Code	int				`json:"code"`
+	Reason	string			`json:"reason,omitempty"`
+}
+
+// PropertyResult is the result of a single property in the request.
+type PropertyResult struct{
+	TwinID	string			`json:"twinid"`
+	// desired or reported
+	Kind	string			`json:"kind"`
+	Name	string			`json:"name"`
+	Code	int				`json:"code"`
+	Reason	string			`json:"reason,omitempty"`
 }
 
 /*
@@ -78,6 +262,26 @@ type TwinResponse struct{
 // message send to device or from device to sync.
 type DeviceMessage struct{	
 	Twin  DeviceTwin	 	`json:"twin"`
+	// reason of the state change, it is just used inside dgtwin.
+	Reason string			`json:"reason,omitempty"`
+}
+
+/*
+* Lifecycle Message.
+*/
+// LifecycleEvent is a lifecycle event of twin.
+type LifecycleEvent struct {
+	TwinID		string		`json:"twinid"`
+	// one of LIFECYCLE_EVENT_*.
+	Event		string		`json:"event"`
+	// unix timestamp (millisecond) of the event.
+	Timestamp	int64		`json:"timestamp"`
+	Reason		string		`json:"reason,omitempty"`
+}
+
+// lifecycle events sync to the subscribers.
+type LifecycleMessage struct {
+	Events	[]LifecycleEvent	`json:"events"`
 }
 
 // response message from device.
@@ -89,6 +293,16 @@ type DeviceResponse struct{
 	Twin  DeviceTwin			`json:"twin,omitempty"`
 }
 
+// response of method from device, the code is same as DeviceResponse.
+type DeviceMethodResponse struct{
+	// the device which returns the result, it's set by the broker
+	// which authenticates the device.
+	TwinID string				`json:"twinid,omitempty"`
+	Code   string    			`json:"code"`
+	Reason string 				`json:"reason,omitempty"`
+	Result json.RawMessage		`json:"result,omitempty"`
+}
+
 // GetDesiredProperties
 func GetDesiredProperties(twin *DeviceTwin) []TwinProperty {
 	return twin.Properties.Desired
@@ -123,6 +337,147 @@ func BuildResponseMessage(code int, reason string, twins []DigitalTwin) ([]byte,
 	return resultJSON, err
 }
 
+// BuildPropertyResponseMessage build response with result of each property.
+func BuildPropertyResponseMessage(code int, reason string, twins []DigitalTwin, results []PropertyResult) ([]byte, error){
+	resp := &TwinResponse{
+		Code: code,
+		Reason: reason,
+		Twins: twins,
+		Results: results,
+	}
+
+	return json.Marshal(resp)
+}
+
+// BuildModelResponseMessage build response with the device models of twins.
+func BuildModelResponseMessage(code int, reason string, twins []DigitalTwin, results []PropertyResult, models []DeviceModel) ([]byte, error){
+	resp := &TwinResponse{
+		Code: code,
+		Reason: reason,
+		Twins: twins,
+		Results: results,
+		Models: models,
+	}
+
+	return json.Marshal(resp)
+}
+
+// BuildListResponseMessage build the response of List with the continue token.
+func BuildListResponseMessage(code int, reason string, twins []DigitalTwin, cont string) ([]byte, error){
+	resp := &TwinResponse{
+		Code: code,
+		Reason: reason,
+		Twins: twins,
+		Continue: cont,
+	}
+
+	return json.Marshal(resp)
+}
+
+// UnMarshalTwinListMessage
+func UnMarshalTwinListMessage(msg *model.Message)(*TwinListMessage, error){
+	var listMsg TwinListMessage
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return nil, errors.New("invaliad message content")
+	}
+
+	if len(content) > 0 {
+		err := json.Unmarshal(content, &listMsg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &listMsg, nil
+}
+
+// BuildHistoryResponseMessage build the response of History query.
+func BuildHistoryResponseMessage(code int, reason string, history []PropertyHistory) ([]byte, error){
+	resp := &TwinResponse{
+		Code: code,
+		Reason: reason,
+		History: history,
+	}
+
+	return json.Marshal(resp)
+}
+
+// UnMarshalTwinHistoryMessage
+func UnMarshalTwinHistoryMessage(msg *model.Message)(*TwinHistoryMessage, error){
+	var historyMsg TwinHistoryMessage
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return nil, errors.New("invaliad message content")
+	}
+
+	err := json.Unmarshal(content, &historyMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &historyMsg, nil
+}
+
+// BuildMethodResponseMessage build the response of method invocation.
+func BuildMethodResponseMessage(code int, reason string, result *MethodResult) ([]byte, error){
+	resp := &TwinResponse{
+		Code: code,
+		Reason: reason,
+		Method: result,
+	}
+
+	return json.Marshal(resp)
+}
+
+// UnMarshalMethodMessage
+func UnMarshalMethodMessage(msg *model.Message)(*MethodMessage, error){
+	var methodMsg MethodMessage
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return nil, errors.New("invaliad message content")
+	}
+
+	err := json.Unmarshal(content, &methodMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &methodMsg, nil
+}
+
+// BuildAuditResponseMessage build the response of Audit query with the continue token.
+func BuildAuditResponseMessage(code int, reason string, records []AuditRecord, cont string) ([]byte, error){
+	resp := &TwinResponse{
+		Code: code,
+		Reason: reason,
+		Audit: records,
+		Continue: cont,
+	}
+
+	return json.Marshal(resp)
+}
+
+// UnMarshalTwinAuditMessage
+func UnMarshalTwinAuditMessage(msg *model.Message)(*TwinAuditMessage, error){
+	var auditMsg TwinAuditMessage
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return nil, errors.New("invaliad message content")
+	}
+
+	err := json.Unmarshal(content, &auditMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditMsg, nil
+}
+
 // UnMarshalResponseMessage
 func UnMarshalResponseMessage(msg *model.Message)(*TwinResponse, error){
 	var rspMsg TwinResponse
@@ -264,6 +619,46 @@ func BuildDeviceMessage(twin *DeviceTwin) ([]byte, error){
 	return json.Marshal(DeviceMsg)
 }
 
+// BuildDeviceStateMessage build the device message which change the
+// device state for the reason.
+func BuildDeviceStateMessage(twinID, state, reason string) ([]byte, error){
+	DeviceMsg := &DeviceMessage{
+		Twin:	DeviceTwin{
+			ID:		twinID,
+			State:	state,
+		},
+		Reason:	reason,
+	}
+
+	return json.Marshal(DeviceMsg)
+}
+
+// BuildLifecycleMessage build the lifecycle events message.
+func BuildLifecycleMessage(events []LifecycleEvent) ([]byte, error){
+	lifecycleMsg := &LifecycleMessage{
+		Events:	events,
+	}
+
+	return json.Marshal(lifecycleMsg)
+}
+
+// UnMarshalLifecycleMessage unmarshal the lifecycle events message.
+func UnMarshalLifecycleMessage(msg *model.Message)(*LifecycleMessage, error){
+	var lifecycleMsg LifecycleMessage
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return nil, errors.New("invaliad message content")
+	}
+
+	err := json.Unmarshal(content, &lifecycleMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lifecycleMsg, nil
+}
+
 // UnMarshal the device message.
 func UnMarshalDeviceMessage(msg *model.Message)(*DeviceMessage, error){
 	var deviceMsg DeviceMessage
@@ -310,6 +705,23 @@ func UnMarshalDeviceResponseMessage(msg *model.Message)(*DeviceResponse, error){
 	return &respMsg, nil
 }
 
+// UnMarshalDeviceMethodResponseMessage
+func UnMarshalDeviceMethodResponseMessage(msg *model.Message)(*DeviceMethodResponse, error){
+	var respMsg DeviceMethodResponse
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return nil, errors.New("invaliad message content")
+	}
+
+	err := json.Unmarshal(content, &respMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &respMsg, nil
+}
+
 type EdgeInfo struct{
 	EdgeID		string	`json:"edgeid"`
 	EdgeName	string	`json:"edgename,omitempty"`
@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"bytes"
+	"strings"
+	"strconv"
+	"net/http"
+	"k8s.io/klog"
+)
+
+/*
+* metrics of the whole process in Prometheus text format.
+*	GET		/metrics
+* each module declares its counters and gauges, the gauges which are
+* computed on each scrape (e.g. twins by state) are registered by a
+* collect function.
+*/
+const (
+	METRICS_PATH		= "/metrics"
+
+	TYPE_COUNTER		= "counter"
+	TYPE_GAUGE			= "gauge"
+)
+
+// Vec is a counter or gauge with labels.
+type Vec struct {
+	name		string
+	help		string
+	metricType	string
+	labels		[]string
+	mutex		sync.Mutex
+	// key is the label values joined by "\xff".
+	values		map[string]float64
+	// collect the values on each scrape, nil for the stored values.
+	collect		func(observe func(value float64, labelValues ...string))
+}
+
+// Registry hold all metrics, key is the metric name.
+type Registry struct {
+	mutex		sync.RWMutex
+	metrics		map[string]*Vec
+}
+
+var defaultRegistry = NewRegistry()
+
+// MessagesTotal count the messages handled by each module.
+var MessagesTotal = NewCounter("edgeon_messages_total",
+			"Messages handled by each module.", "module", "operation", "resource")
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*Vec)}
+}
+
+// register return the registered metric with same name, so each module
+// can declare its metrics more than once (e.g. restarted module).
+func (r *Registry) register(v *Vec) *Vec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if exist, ok := r.metrics[v.name]; ok && v.collect == nil {
+		return exist
+	}
+	// the collect function is replaced by the latest one.
+	r.metrics[v.name] = v
+
+	return v
+}
+
+// NewCounter declare a counter in default registry.
+func NewCounter(name, help string, labels ...string) *Vec {
+	return defaultRegistry.NewCounter(name, help, labels...)
+}
+
+// NewGauge declare a gauge in default registry.
+func NewGauge(name, help string, labels ...string) *Vec {
+	return defaultRegistry.NewGauge(name, help, labels...)
+}
+
+// NewGaugeFunc declare a gauge in default registry, its values
+// are collected by fn on each scrape.
+func NewGaugeFunc(name, help string, labels []string, fn func(observe func(value float64, labelValues ...string))) *Vec {
+	return defaultRegistry.NewGaugeFunc(name, help, labels, fn)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Vec {
+	return r.register(newVec(name, help, TYPE_COUNTER, labels))
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Vec {
+	return r.register(newVec(name, help, TYPE_GAUGE, labels))
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, fn func(observe func(value float64, labelValues ...string))) *Vec {
+	v := newVec(name, help, TYPE_GAUGE, labels)
+	v.collect = fn
+
+	return r.register(v)
+}
+
+func newVec(name, help, metricType string, labels []string) *Vec {
+	return &Vec{
+		name:		name,
+		help:		help,
+		metricType:	metricType,
+		labels:		labels,
+		values:		make(map[string]float64),
+	}
+}
+
+// Inc add 1 to the value of labels.
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Dec subtract 1 from the value of labels, it's only for gauge.
+func (v *Vec) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+// Add add the delta to the value of labels.
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	key, ok := v.key(labelValues)
+	if !ok {
+		return
+	}
+
+	v.mutex.Lock()
+	v.values[key] += delta
+	v.mutex.Unlock()
+}
+
+// Set set the value of labels, it's only for gauge.
+func (v *Vec) Set(value float64, labelValues ...string) {
+	key, ok := v.key(labelValues)
+	if !ok {
+		return
+	}
+
+	v.mutex.Lock()
+	v.values[key] = value
+	v.mutex.Unlock()
+}
+
+// Value return the value of labels.
+func (v *Vec) Value(labelValues ...string) float64 {
+	key, _ := v.key(labelValues)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.values[key]
+}
+
+func (v *Vec) key(labelValues []string) (string, bool) {
+	if len(labelValues) != len(v.labels) {
+		klog.Warningf("metric %s has %d labels, but %d values are given", v.name, len(v.labels), len(labelValues))
+		return "", false
+	}
+
+	return strings.Join(labelValues, "\xff"), true
+}
+
+// write write the metric in text format, the samples are sorted by labels.
+func (v *Vec) write(buf *bytes.Buffer) {
+	values := make(map[string]float64)
+	if v.collect != nil {
+		v.collect(func(value float64, labelValues ...string) {
+			if key, ok := v.key(labelValues); ok {
+				values[key] += value
+			}
+		})
+	}else {
+		v.mutex.Lock()
+		for key, value := range v.values {
+			values[key] = value
+		}
+		v.mutex.Unlock()
+	}
+
+	keys := make([]string, 0, len(values))
+	for key, _ := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", v.name, escape(v.help, false))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", v.name, v.metricType)
+	for _, key := range keys {
+		buf.WriteString(v.name)
+		if len(v.labels) > 0 {
+			labelValues := strings.Split(key, "\xff")
+			pairs := make([]string, len(v.labels))
+			for i, label := range v.labels {
+				pairs[i] = fmt.Sprintf("%s=\"%s\"", label, escape(labelValues[i], true))
+			}
+			buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		buf.WriteString(" " + strconv.FormatFloat(values[key], 'g', -1, 64) + "\n")
+	}
+}
+
+func escape(s string, quoted bool) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	if quoted {
+		s = strings.Replace(s, "\"", "\\\"", -1)
+	}
+
+	return s
+}
+
+// ServeHTTP write all metrics sorted by name.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name, _ := range r.metrics {
+		names = append(names, name)
+	}
+	r.mutex.RUnlock()
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		r.mutex.RLock()
+		v := r.metrics[name]
+		r.mutex.RUnlock()
+		v.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// Handler return the handler of default registry.
+func Handler() http.Handler {
+	return defaultRegistry
+}
+
+// Serve serve the metrics on the url (host:port) until it's failed.
+func Serve(url string) error {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, Handler())
+
+	klog.Infof("Start the metrics server, listen: %s.....", url)
+	return http.ListenAndServe(url, mux)
+}
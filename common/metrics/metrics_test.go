@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"io/ioutil"
+	"net/http/httptest"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	messages := r.NewCounter("test_messages_total", "Messages.", "module", "operation")
+	messages.Inc("edge/dgtwin", "Update")
+	messages.Inc("edge/dgtwin", "Update")
+	messages.Inc("edge/hub", "Get")
+	// wrong count of label values is ignored.
+	messages.Inc("edge/hub")
+
+	if r.NewCounter("test_messages_total", "Messages.", "module", "operation") != messages {
+		t.Errorf("counter is registered twice")
+	}
+	if v := messages.Value("edge/dgtwin", "Update"); v != 2 {
+		t.Errorf("counter value is %v, want 2", v)
+	}
+
+	state := "online"
+	r.NewGaugeFunc("test_twins", "Twins by state.", []string{"state"},
+		func(observe func(value float64, labelValues ...string)) {
+			observe(1, state)
+			observe(1, state)
+			observe(1, "offline")
+		})
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + METRICS_PATH)
+	if err != nil {
+		t.Fatalf("scrape metrics failed (%v)", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	want := `# HELP test_messages_total Messages.
+# TYPE test_messages_total counter
+test_messages_total{module="edge/dgtwin",operation="Update"} 2
+test_messages_total{module="edge/hub",operation="Get"} 1
+# HELP test_twins Twins by state.
+# TYPE test_twins gauge
+test_twins{state="offline"} 1
+test_twins{state="online"} 2
+`
+	if string(body) != want {
+		t.Errorf("metrics is\n%s\nwant\n%s", body, want)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("content type is %s", resp.Header.Get("Content-Type"))
+	}
+}
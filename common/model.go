@@ -0,0 +1,142 @@
+package common
+
+import (
+	"fmt"
+)
+
+// DeviceModel is a schema document which declares the properties of a kind
+// of device, a twin can reference the model by name at Create time, then
+// all properties of this twin are checked against the model.
+type DeviceModel struct {
+	// model name
+	Name		string					`json:"name"`
+	// model description
+	Description	string					`json:"description,omitempty"`
+	// all declared properties.
+	Properties	[]PropertySchema		`json:"properties,omitempty"`
+	// liveness policy of this kind of device.
+	Liveness	*LivenessPolicy			`json:"liveness,omitempty"`
+}
+
+// LivenessPolicy decides how to detect whether the device is alive.
+type LivenessPolicy struct {
+	// interval (second) to ping the device.
+	Interval		int					`json:"interval,omitempty"`
+	// device is offline after it has missed so many pings.
+	MissTolerance	int					`json:"misstolerance,omitempty"`
+	// any traffic from device (Sync/Update/Response) is proof of life,
+	// and the ping is skipped if the device has traffic in interval.
+	TrafficAsAlive	bool				`json:"trafficasalive,omitempty"`
+}
+
+// PropertySchema declares a property of device model.
+type PropertySchema struct {
+	Name		string					`json:"name"`
+	// value type, one of TWIN_PROP_VALUE_TYPE_*.
+	Type		string					`json:"type,omitempty"`
+	// unit of the value, e.g. "°C".
+	Unit		string					`json:"unit,omitempty"`
+	// range of the numeric value.
+	Min			*float64				`json:"min,omitempty"`
+	Max			*float64				`json:"max,omitempty"`
+	// all allowed values, empty means any value.
+	Enum		[]string				`json:"enum,omitempty"`
+	// read-only property can't be updated as desired property,
+	// it can just be reported by device.
+	ReadOnly	bool					`json:"readonly,omitempty"`
+	Description	string					`json:"description,omitempty"`
+}
+
+// GetProperty return the schema of the property, or nil if the
+// property is not declared in this model.
+func (dm *DeviceModel) GetProperty(name string) *PropertySchema {
+	for key, _ := range dm.Properties {
+		if dm.Properties[key].Name == name {
+			return &dm.Properties[key]
+		}
+	}
+
+	return nil
+}
+
+// Check check the model is well-formed.
+func (dm *DeviceModel) Check() error {
+	if dm.Name == "" {
+		return fmt.Errorf("model name is empty")
+	}
+
+	names := make(map[string]bool)
+	for key, _ := range dm.Properties {
+		schema := &dm.Properties[key]
+		if schema.Name == "" {
+			return fmt.Errorf("model (%s) has property without name", dm.Name)
+		}
+		if names[schema.Name] {
+			return fmt.Errorf("model (%s) has duplicated property (%s)", dm.Name, schema.Name)
+		}
+		names[schema.Name] = true
+
+		if !IsValidPropertyType(schema.Type) {
+			return fmt.Errorf("property (%s) has unsupported type %q", schema.Name, schema.Type)
+		}
+		if schema.Min != nil && schema.Max != nil && *schema.Min > *schema.Max {
+			return fmt.Errorf("property (%s) min is greater than max", schema.Name)
+		}
+	}
+
+	if dm.Liveness != nil {
+		return dm.Liveness.Check()
+	}
+
+	return nil
+}
+
+// Check check the liveness policy is valid.
+func (lp *LivenessPolicy) Check() error {
+	if lp.Interval <= 0 {
+		return fmt.Errorf("liveness interval should be greater than 0")
+	}
+	if lp.MissTolerance <= 0 {
+		return fmt.Errorf("liveness miss tolerance should be greater than 0")
+	}
+
+	return nil
+}
+
+// Validate check the value matches the type, range and enum of the schema.
+func (ps *PropertySchema) Validate(value []byte) error {
+	v, err := DecodePropertyValue(ps.Type, value)
+	if err != nil {
+		return err
+	}
+
+	var number float64
+	isNumber := true
+	switch n := v.(type) {
+	case int64:
+		number = float64(n)
+	case float64:
+		number = n
+	default:
+		isNumber = false
+	}
+	if isNumber {
+		if ps.Min != nil && number < *ps.Min {
+			return fmt.Errorf("value %s is less than min %v", value, *ps.Min)
+		}
+		if ps.Max != nil && number > *ps.Max {
+			return fmt.Errorf("value %s is greater than max %v", value, *ps.Max)
+		}
+	}
+
+	if len(ps.Enum) > 0 {
+		for _, allowed := range ps.Enum {
+			if allowed == string(value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("value %q is not in %v", value, ps.Enum)
+	}
+
+	return nil
+}
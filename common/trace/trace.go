@@ -0,0 +1,221 @@
+package trace
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"github.com/jwzl/wssocket/model"
+)
+
+/*
+* end-to-end trace of messages. each message belongs to a trace which is
+* propagated into its responses and the messages sent on behalf of it,
+* each module records a span (hop) when it handles the message.
+* model.Message has no field for the trace ID, so the tracer keeps the
+* trace of each message by its ID, the response joins the trace by its tag.
+* the trace ID is carried in the topics to devices and cloud, and the trace
+* ID from other process is just joined if it is a known trace.
+*/
+const (
+	SPAN_OUTCOME_OK			= "ok"
+	SPAN_OUTCOME_DENIED		= "denied"
+	SPAN_OUTCOME_DROPPED	= "dropped"
+	SPAN_OUTCOME_ERROR		= "error"
+	SPAN_OUTCOME_RETRY		= "retry"
+	SPAN_OUTCOME_TIMEOUT	= "timeout"
+
+	// the oldest trace is dropped when there are more traces.
+	TRACE_MAX_COUNT			= 1024
+	// the later spans of a trace are dropped when it has more spans.
+	TRACE_MAX_SPANS			= 64
+)
+
+// Span is a hop of message in a module.
+type Span struct {
+	TraceID		string	`json:"traceID"`
+	MessageID	string	`json:"messageID"`
+	Module		string	`json:"module"`
+	Operation	string	`json:"operation,omitempty"`
+	Resource	string	`json:"resource,omitempty"`
+	// millisecond.
+	Start		int64	`json:"start"`
+	End			int64	`json:"end"`
+	Outcome		string	`json:"outcome"`
+}
+
+// Tracer keep the spans of the latest traces.
+type Tracer struct {
+	mutex		sync.Mutex
+	// key is trace ID.
+	spans		map[string][]Span
+	// the trace ID of each message, key is message ID.
+	messages	map[string]string
+	// trace IDs in the order of creation.
+	order		[]string
+	maxCount	int
+}
+
+var defaultTracer = NewTracer(TRACE_MAX_COUNT)
+
+func NewTracer(maxCount int) *Tracer {
+	return &Tracer{
+		spans:		make(map[string][]Span),
+		messages:	make(map[string]string),
+		maxCount:	maxCount,
+	}
+}
+
+// TraceID return the trace ID of message, empty if it is not traced.
+func TraceID(msg *model.Message) string {
+	return defaultTracer.TraceID(msg)
+}
+
+// Join add the message into the known trace, it returns false if the
+// trace is unknown (e.g. it's dropped or forged).
+func Join(msg *model.Message, traceID string) bool {
+	return defaultTracer.Join(msg, traceID)
+}
+
+// Start return the trace ID of message, the message without trace ID
+// joins the trace of the message it is tagged with (e.g. response), or
+// starts a new trace whose ID is the message ID.
+func Start(msg *model.Message) string {
+	return defaultTracer.Start(msg)
+}
+
+// Propagate add msg into the trace of parent, msg starts a new trace if
+// parent is nil.
+func Propagate(parent, msg *model.Message) {
+	if parent != nil {
+		Join(msg, Start(parent))
+	}
+	Start(msg)
+}
+
+// Record record the span of message in module, which is started at start
+// and is ended now.
+func Record(module string, msg *model.Message, start time.Time, outcome string) {
+	defaultTracer.Record(module, msg, start, outcome)
+}
+
+// Spans return the spans of the trace which the message (or trace) ID
+// belongs to, sorted by start time.
+func Spans(id string) []Span {
+	return defaultTracer.Spans(id)
+}
+
+func (t *Tracer) TraceID(msg *model.Message) string {
+	if msg == nil {
+		return ""
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.messages[msg.GetID()]
+}
+
+func (t *Tracer) Join(msg *model.Message, traceID string) bool {
+	if msg == nil || traceID == "" {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, exist := t.spans[traceID]; !exist {
+		return false
+	}
+	t.messages[msg.GetID()] = traceID
+
+	return true
+}
+
+func (t *Tracer) Start(msg *model.Message) string {
+	if msg == nil {
+		return ""
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	traceID := t.messages[msg.GetID()]
+	if traceID == "" && msg.GetTag() != "" {
+		traceID = t.messages[msg.GetTag()]
+	}
+	if traceID == "" {
+		traceID = msg.GetID()
+	}
+	t.add(traceID, msg.GetID())
+
+	return traceID
+}
+
+// add add the message into trace, the oldest trace is dropped if the
+// count of traces exceeds max count.
+func (t *Tracer) add(traceID, msgID string) {
+	if _, exist := t.spans[traceID]; !exist {
+		t.spans[traceID] = make([]Span, 0)
+		t.order = append(t.order, traceID)
+		t.messages[traceID] = traceID
+		if len(t.order) > t.maxCount {
+			t.drop(t.order[0])
+			t.order = t.order[1:]
+		}
+	}
+	if msgID != "" {
+		t.messages[msgID] = traceID
+	}
+}
+
+func (t *Tracer) drop(traceID string) {
+	for msgID, id := range t.messages {
+		if id == traceID {
+			delete(t.messages, msgID)
+		}
+	}
+	delete(t.spans, traceID)
+}
+
+func (t *Tracer) Record(module string, msg *model.Message, start time.Time, outcome string) {
+	if msg == nil {
+		return
+	}
+	traceID := t.Start(msg)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	spans, exist := t.spans[traceID]
+	if !exist || len(spans) >= TRACE_MAX_SPANS {
+		return
+	}
+	t.spans[traceID] = append(spans, Span{
+		TraceID:	traceID,
+		MessageID:	msg.GetID(),
+		Module:		module,
+		Operation:	msg.GetOperation(),
+		Resource:	msg.GetResource(),
+		Start:		start.UnixNano() / 1e6,
+		End:		time.Now().UnixNano() / 1e6,
+		Outcome:	outcome,
+	})
+}
+
+func (t *Tracer) Spans(id string) []Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	traceID, exist := t.messages[id]
+	if !exist {
+		return nil
+	}
+
+	spans := make([]Span, len(t.spans[traceID]))
+	copy(spans, t.spans[traceID])
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+
+	return spans
+}
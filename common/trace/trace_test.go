@@ -0,0 +1,51 @@
+package trace
+
+import (
+	"time"
+	"testing"
+	"github.com/jwzl/wssocket/model"
+)
+
+func TestTracer(t *testing.T) {
+	tracer := NewTracer(2)
+
+	request := model.NewMessage("")
+	traceID := tracer.Start(request)
+	if traceID != request.GetID() || tracer.TraceID(request) != traceID {
+		t.Fatalf("trace ID is %s, want message ID %s", traceID, request.GetID())
+	}
+	tracer.Record("edge/hub", request, time.Now(), SPAN_OUTCOME_OK)
+
+	// the response joins the trace of request it is tagged with.
+	response := model.NewMessage("")
+	response.SetTag(request.GetID())
+	if id := tracer.Start(response); id != traceID {
+		t.Errorf("response trace ID is %s, want %s", id, traceID)
+	}
+	tracer.Record("edge/dgtwin", response, time.Now(), SPAN_OUTCOME_DENIED)
+
+	// the message from other process only joins the known trace.
+	remote := model.NewMessage("")
+	if tracer.Join(remote, "remote-trace") {
+		t.Errorf("remote message joins the unknown trace")
+	}
+	if !tracer.Join(remote, traceID) || tracer.Start(remote) != traceID {
+		t.Errorf("remote trace ID is %s, want %s", tracer.TraceID(remote), traceID)
+	}
+	remoteTrace := tracer.Start(model.NewMessage(""))
+
+	spans := tracer.Spans(response.GetID())
+	if len(spans) != 2 || spans[0].Module != "edge/hub" || spans[1].Outcome != SPAN_OUTCOME_DENIED ||
+			spans[1].MessageID != response.GetID() {
+		t.Errorf("unexpected spans %v", spans)
+	}
+
+	// the oldest trace is dropped.
+	tracer.Start(model.NewMessage(""))
+	if spans := tracer.Spans(request.GetID()); spans != nil {
+		t.Errorf("dropped trace has spans %v", spans)
+	}
+	if spans := tracer.Spans(remoteTrace); spans == nil {
+		t.Errorf("trace %s is dropped", remoteTrace)
+	}
+}
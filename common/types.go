@@ -10,6 +10,18 @@ const (
 	TWIN_PROP_VALUE_TYPE_UINT64	= "int64"
 	TWIN_PROP_VALUE_TYPE_STRING	= "string"
 	TWIN_PROP_VALUE_TYPE_BYTES	= "bytes"
+	TWIN_PROP_VALUE_TYPE_FLOAT	= "float"
+	TWIN_PROP_VALUE_TYPE_BOOL	= "bool"
+	TWIN_PROP_VALUE_TYPE_OBJECT	= "object"
+
+	// property kind.
+	TWIN_PROP_KIND_DESIRED	= "desired"
+	TWIN_PROP_KIND_REPORTED	= "reported"
+
+	// desired property status.
+	TWIN_PROP_STATUS_PENDING	= "pending"
+	TWIN_PROP_STATUS_INSYNC		= "in-sync"
+	TWIN_PROP_STATUS_FAILED		= "failed"
 )
 
 // DigitalTwin is a digital description about things in physical world. If you want to do something
@@ -27,10 +39,17 @@ type DigitalTwin struct {
 	State	string 		`json:"state,omitempty"`
 	// device last state
 	LastState	string	`json:"laststate,omitempty"`
+	// device model name, all properties are checked against this model.
+	Model	string		`json:"model,omitempty"`
+	// liveness policy of this twin, it overrides the policy of model.
+	Liveness	*LivenessPolicy	`json:"liveness,omitempty"`
 	// device metadata  
 	MetaData	map[string]*MetaType	`json:"metadata,omitempty"`
 	//all properties
 	Properties	TwinProperties			`json:"properties,omitempty"`	
+	// twin version, increased by each change of this twin.
+	// In Update/Delete request, it's the expected version.
+	Version		uint64					`json:"version,omitempty"`
 }
 
 // all Desired and Reported are in TwinProperties.
@@ -81,6 +100,12 @@ type TwinProperty struct {
 	Type	string 					`json:"type,omitempty"`
 	/* property meta data.*/
 	MetaData	[]MetaType			`json:"metadata,omitempty"`
+	// property version, increased by each change of this property.
+	// In Update/Delete request, it's the expected version.
+	Version		uint64				`json:"version,omitempty"`
+	// desired property status (pending/in-sync/failed), it shows
+	// whether the reported value has reached the desired value. 
+	Status		string				`json:"status,omitempty"`
 }
 
 type MetaType struct{
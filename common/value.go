@@ -0,0 +1,213 @@
+package common
+
+import (
+	"fmt"
+	"bytes"
+	"strconv"
+	"unicode/utf8"
+	"encoding/json"
+)
+
+/*
+* Property value encoding.
+* TwinProperty.Value is encoded as text according to TwinProperty.Type:
+*	char:			a single UTF-8 character.
+*	int8..int64:	decimal integer, e.g. "-12".
+*	float:			decimal float, e.g. "3.14".
+*	bool:			"true" or "false".
+*	string:			UTF-8 text.
+*	bytes:			raw bytes.
+*	object:			JSON object, e.g. {"x":1}.
+* Empty type means the value is not typed, any value is accepted.
+*/
+
+// intTypeBits return the bit size of the integer value type.
+func intTypeBits(valueType string) (int, bool) {
+	switch valueType {
+	case TWIN_PROP_VALUE_TYPE_UINT8:
+		return 8, true
+	case TWIN_PROP_VALUE_TYPE_UINT16:
+		return 16, true
+	case TWIN_PROP_VALUE_TYPE_UINT32:
+		return 32, true
+	case TWIN_PROP_VALUE_TYPE_UINT64:
+		return 64, true
+	}
+
+	return 0, false
+}
+
+// IsValidPropertyType check the value type is supported.
+func IsValidPropertyType(valueType string) bool {
+	if _, isInt := intTypeBits(valueType); isInt {
+		return true
+	}
+
+	switch valueType {
+	case "", TWIN_PROP_VALUE_TYPE_CHAR, TWIN_PROP_VALUE_TYPE_STRING,
+		TWIN_PROP_VALUE_TYPE_BYTES, TWIN_PROP_VALUE_TYPE_FLOAT,
+		TWIN_PROP_VALUE_TYPE_BOOL, TWIN_PROP_VALUE_TYPE_OBJECT:
+		return true
+	}
+
+	return false
+}
+
+// DecodePropertyValue decode the value by value type, the result is
+// string for char and string, int64 for integers, float64 for float,
+// bool for bool, map[string]interface{} for object and []byte for others.
+func DecodePropertyValue(valueType string, value []byte) (interface{}, error) {
+	if bits, isInt := intTypeBits(valueType); isInt {
+		v, err := strconv.ParseInt(string(value), 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("value %q is not a valid %s", value, valueType)
+		}
+		return v, nil
+	}
+
+	switch valueType {
+	case "", TWIN_PROP_VALUE_TYPE_BYTES:
+		return value, nil
+	case TWIN_PROP_VALUE_TYPE_CHAR:
+		if !utf8.Valid(value) || utf8.RuneCount(value) != 1 {
+			return nil, fmt.Errorf("value %q is not a single character", value)
+		}
+		return string(value), nil
+	case TWIN_PROP_VALUE_TYPE_STRING:
+		if !utf8.Valid(value) {
+			return nil, fmt.Errorf("value is not a valid UTF-8 string")
+		}
+		return string(value), nil
+	case TWIN_PROP_VALUE_TYPE_FLOAT:
+		v, err := strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("value %q is not a valid float", value)
+		}
+		return v, nil
+	case TWIN_PROP_VALUE_TYPE_BOOL:
+		switch string(value) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("value %q is not a valid bool", value)
+	case TWIN_PROP_VALUE_TYPE_OBJECT:
+		var v map[string]interface{}
+		trimmed := bytes.TrimSpace(value)
+		if len(trimmed) < 1 || trimmed[0] != '{' || json.Unmarshal(trimmed, &v) != nil {
+			return nil, fmt.Errorf("value is not a valid JSON object")
+		}
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("unsupported property type %q", valueType)
+}
+
+// EncodePropertyValue encode the go value by value type.
+func EncodePropertyValue(valueType string, v interface{}) ([]byte, error) {
+	var value []byte
+
+	if _, isInt := intTypeBits(valueType); isInt {
+		switch n := v.(type) {
+		case int:
+			value = []byte(strconv.FormatInt(int64(n), 10))
+		case int8:
+			value = []byte(strconv.FormatInt(int64(n), 10))
+		case int16:
+			value = []byte(strconv.FormatInt(int64(n), 10))
+		case int32:
+			value = []byte(strconv.FormatInt(int64(n), 10))
+		case int64:
+			value = []byte(strconv.FormatInt(n, 10))
+		case uint8:
+			value = []byte(strconv.FormatUint(uint64(n), 10))
+		case uint16:
+			value = []byte(strconv.FormatUint(uint64(n), 10))
+		case uint32:
+			value = []byte(strconv.FormatUint(uint64(n), 10))
+		default:
+			return nil, fmt.Errorf("%T can't be encoded as %s", v, valueType)
+		}
+	}else {
+		switch valueType {
+		case "", TWIN_PROP_VALUE_TYPE_BYTES:
+			switch b := v.(type) {
+			case []byte:
+				value = b
+			case string:
+				value = []byte(b)
+			default:
+				return nil, fmt.Errorf("%T can't be encoded as bytes", v)
+			}
+		case TWIN_PROP_VALUE_TYPE_CHAR:
+			switch c := v.(type) {
+			case rune:
+				value = []byte(string(c))
+			case string:
+				value = []byte(c)
+			default:
+				return nil, fmt.Errorf("%T can't be encoded as char", v)
+			}
+		case TWIN_PROP_VALUE_TYPE_STRING:
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%T can't be encoded as string", v)
+			}
+			value = []byte(s)
+		case TWIN_PROP_VALUE_TYPE_FLOAT:
+			switch f := v.(type) {
+			case float32:
+				value = []byte(strconv.FormatFloat(float64(f), 'g', -1, 32))
+			case float64:
+				value = []byte(strconv.FormatFloat(f, 'g', -1, 64))
+			default:
+				return nil, fmt.Errorf("%T can't be encoded as float", v)
+			}
+		case TWIN_PROP_VALUE_TYPE_BOOL:
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%T can't be encoded as bool", v)
+			}
+			value = []byte(strconv.FormatBool(b))
+		case TWIN_PROP_VALUE_TYPE_OBJECT:
+			var err error
+			if raw, ok := v.(json.RawMessage); ok {
+				value = raw
+			}else if value, err = json.Marshal(v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported property type %q", valueType)
+		}
+	}
+
+	// check the range and format.
+	if _, err := DecodePropertyValue(valueType, value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// ValidatePropertyValue check the value matches the value type.
+func ValidatePropertyValue(valueType string, value []byte) error {
+	_, err := DecodePropertyValue(valueType, value)
+	return err
+}
+
+// SetValue encode the go value into property by the property type.
+func (prop *TwinProperty) SetValue(v interface{}) error {
+	value, err := EncodePropertyValue(prop.Type, v)
+	if err != nil {
+		return err
+	}
+	prop.Value = value
+
+	return nil
+}
+
+// GetValue decode the property value by the property type.
+func (prop *TwinProperty) GetValue() (interface{}, error) {
+	return DecodePropertyValue(prop.Type, prop.Value)
+}
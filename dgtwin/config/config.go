@@ -0,0 +1,203 @@
+package config
+
+import (
+	"time"
+	"k8s.io/klog"
+	"github.com/jwzl/beehive/pkg/common/config"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+)
+
+// DGTwinConfig indicates the digital twin module config
+type DGTwinConfig struct {
+	// StorePath indicates the directory which all twins are persisted in.
+	// default /var/lib/edgeOn/dgtwin
+	StorePath string `json:"storePath,omitempty"`
+	// ModelPath indicates the directory which all device models are in.
+	// default /etc/edgeOn/models
+	ModelPath string `json:"modelPath,omitempty"`
+	// ReconcileInterval indicates the interval (second) to compare desired
+	// and reported properties of all twins.
+	// default 30
+	ReconcileInterval int `json:"reconcileInterval,omitempty"`
+	// ReconcileMaxAttempts indicates how many times an unsatisfied desired
+	// property is pushed to device before it is marked failed.
+	// default 5
+	ReconcileMaxAttempts int `json:"reconcileMaxAttempts,omitempty"`
+	// HistoryMaxCount indicates the max count of values in each property
+	// history, 0 means the history is disabled.
+	// default 100
+	HistoryMaxCount int `json:"historyMaxCount,omitempty"`
+	// HistoryMaxAge indicates the max age (second) of values in history.
+	// default 3600
+	HistoryMaxAge int `json:"historyMaxAge,omitempty"`
+	// RetryPolicies indicates the retry policy of messages to device,
+	// cloud and edge/app, key is types.DGTWINS_RETRY_TARGET_*.
+	RetryPolicies map[string]*types.RetryPolicy `json:"retryPolicies,omitempty"`
+	// Liveness indicates the default liveness policy of twins which
+	// have no policy in twin or device model.
+	Liveness *common.LivenessPolicy `json:"liveness,omitempty"`
+	// ACLPath indicates the access policy document (JSON) of requests,
+	// empty means all requests are allowed.
+	ACLPath string `json:"aclPath,omitempty"`
+	// AuditPath indicates the directory of audit log of twin mutations,
+	// empty means the audit log is disabled.
+	AuditPath string `json:"auditPath,omitempty"`
+	// AuditMaxSize indicates the max size (byte) of audit file before
+	// it's rotated, 0 means never rotated.
+	// default 10485760
+	AuditMaxSize int64 `json:"auditMaxSize,omitempty"`
+	// AuditMaxFiles indicates how many rotated audit files are kept.
+	// default 5
+	AuditMaxFiles int `json:"auditMaxFiles,omitempty"`
+}
+
+// default retry policy of each target.
+var defaultRetryPolicies = map[string]types.RetryPolicy{
+	types.DGTWINS_RETRY_TARGET_DEVICE: {MaxAttempts: 5, InitialBackoff: 2*time.Second,
+					MaxBackoff: 30*time.Second, Multiplier: 2, Jitter: 0.2},
+	types.DGTWINS_RETRY_TARGET_CLOUD: {MaxAttempts: 8, InitialBackoff: 2*time.Second,
+					MaxBackoff: 60*time.Second, Multiplier: 2, Jitter: 0.2},
+	types.DGTWINS_RETRY_TARGET_APP: {MaxAttempts: 5, InitialBackoff: 2*time.Second,
+					MaxBackoff: 30*time.Second, Multiplier: 2, Jitter: 0.2},
+}
+
+func GetDGTwinConfig() *DGTwinConfig {
+	dtConfig := &DGTwinConfig{}
+
+	storePath, err := config.CONFIG.GetValue("dgtwin.store.path").ToString()
+	if err != nil || storePath == "" {
+		klog.Infof("dgtwin.store.path is empty")
+		storePath = "/var/lib/edgeOn/dgtwin"
+	}
+	dtConfig.StorePath = storePath
+
+	modelPath, err := config.CONFIG.GetValue("dgtwin.model.path").ToString()
+	if err != nil || modelPath == "" {
+		klog.Infof("dgtwin.model.path is empty")
+		modelPath = "/etc/edgeOn/models"
+	}
+	dtConfig.ModelPath = modelPath
+
+	interval, err := config.CONFIG.GetValue("dgtwin.reconcile.interval").ToInt()
+	if err != nil || interval <= 0 {
+		klog.Infof("dgtwin.reconcile.interval is empty")
+		interval = 30
+	}
+	dtConfig.ReconcileInterval = interval
+
+	maxAttempts, err := config.CONFIG.GetValue("dgtwin.reconcile.max-attempts").ToInt()
+	if err != nil || maxAttempts <= 0 {
+		klog.Infof("dgtwin.reconcile.max-attempts is empty")
+		maxAttempts = 5
+	}
+	dtConfig.ReconcileMaxAttempts = maxAttempts
+
+	maxCount, err := config.CONFIG.GetValue("dgtwin.history.max-count").ToInt()
+	if err != nil || maxCount < 0 {
+		klog.Infof("dgtwin.history.max-count is empty")
+		maxCount = 100
+	}
+	dtConfig.HistoryMaxCount = maxCount
+
+	maxAge, err := config.CONFIG.GetValue("dgtwin.history.max-age").ToInt()
+	if err != nil || maxAge <= 0 {
+		klog.Infof("dgtwin.history.max-age is empty")
+		maxAge = 3600
+	}
+	dtConfig.HistoryMaxAge = maxAge
+
+	dtConfig.RetryPolicies = make(map[string]*types.RetryPolicy)
+	for target, _ := range defaultRetryPolicies {
+		dtConfig.RetryPolicies[target] = getRetryPolicy(target)
+	}
+
+	dtConfig.Liveness = &common.LivenessPolicy{}
+	interval, err = config.CONFIG.GetValue("dgtwin.liveness.interval").ToInt()
+	if err != nil || interval <= 0 {
+		klog.Infof("dgtwin.liveness.interval is empty")
+		interval = 30
+	}
+	dtConfig.Liveness.Interval = interval
+
+	missTolerance, err := config.CONFIG.GetValue("dgtwin.liveness.miss-tolerance").ToInt()
+	if err != nil || missTolerance <= 0 {
+		klog.Infof("dgtwin.liveness.miss-tolerance is empty")
+		missTolerance = 3
+	}
+	dtConfig.Liveness.MissTolerance = missTolerance
+
+	trafficAsAlive, err := config.CONFIG.GetValue("dgtwin.liveness.traffic-as-alive").ToBool()
+	if err != nil {
+		klog.Infof("dgtwin.liveness.traffic-as-alive is empty")
+		trafficAsAlive = true
+	}
+	dtConfig.Liveness.TrafficAsAlive = trafficAsAlive
+
+	aclPath, err := config.CONFIG.GetValue("dgtwin.acl.path").ToString()
+	if err != nil || aclPath == "" {
+		klog.Infof("dgtwin.acl.path is empty, all requests are allowed")
+		aclPath = ""
+	}
+	dtConfig.ACLPath = aclPath
+
+	auditPath, err := config.CONFIG.GetValue("dgtwin.audit.path").ToString()
+	if err != nil || auditPath == "" {
+		klog.Infof("dgtwin.audit.path is empty, audit log is disabled")
+		auditPath = ""
+	}
+	dtConfig.AuditPath = auditPath
+
+	auditMaxSize, err := config.CONFIG.GetValue("dgtwin.audit.max-size").ToInt64()
+	if err != nil || auditMaxSize < 0 {
+		klog.Infof("dgtwin.audit.max-size is empty")
+		auditMaxSize = 10485760
+	}
+	dtConfig.AuditMaxSize = auditMaxSize
+
+	auditMaxFiles, err := config.CONFIG.GetValue("dgtwin.audit.max-files").ToInt()
+	if err != nil || auditMaxFiles < 0 {
+		klog.Infof("dgtwin.audit.max-files is empty")
+		auditMaxFiles = 5
+	}
+	dtConfig.AuditMaxFiles = auditMaxFiles
+
+	return dtConfig
+}
+
+// getRetryPolicy read the retry policy of the target, the default
+// value is used for the item which is not configured.
+func getRetryPolicy(target string) *types.RetryPolicy {
+	policy := defaultRetryPolicies[target]
+	prefix := "dgtwin.retry." + target
+
+	maxAttempts, err := config.CONFIG.GetValue(prefix + ".max-attempts").ToInt()
+	if err == nil && maxAttempts > 0 {
+		policy.MaxAttempts = maxAttempts
+	}
+
+	initialBackoff, err := config.CONFIG.GetValue(prefix + ".initial-backoff").ToInt()
+	if err == nil && initialBackoff > 0 {
+		policy.InitialBackoff = time.Duration(initialBackoff) * time.Millisecond
+	}
+
+	maxBackoff, err := config.CONFIG.GetValue(prefix + ".max-backoff").ToInt()
+	if err == nil && maxBackoff > 0 {
+		policy.MaxBackoff = time.Duration(maxBackoff) * time.Millisecond
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+
+	multiplier, err := config.CONFIG.GetValue(prefix + ".multiplier").ToFloat64()
+	if err == nil && multiplier >= 1 {
+		policy.Multiplier = multiplier
+	}
+
+	jitter, err := config.CONFIG.GetValue(prefix + ".jitter").ToFloat64()
+	if err == nil && jitter >= 0 && jitter < 1 {
+		policy.Jitter = jitter
+	}
+
+	return &policy
+}
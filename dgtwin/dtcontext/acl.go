@@ -0,0 +1,142 @@
+package dtcontext
+
+import (
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
+)
+
+// aclContent is the twins in all kinds of request content, Twins
+// is for twin message, Twin is for device message and TwinID is for
+// the message of a single twin (e.g. method).
+type aclContent struct {
+	Twins	[]common.DigitalTwin	`json:"twins,omitempty"`
+	Twin	*common.DeviceTwin		`json:"twin,omitempty"`
+	TwinID	string					`json:"twinid,omitempty"`
+}
+
+//LoadACLPolicy load the access policy, empty path means no policy.
+func (dtc *DTContext) LoadACLPolicy(path string) error {
+	if path == "" {
+		dtc.ACLPolicy = nil
+		return nil
+	}
+
+	policy, err := dtstore.LoadACLPolicy(path)
+	if err != nil {
+		return err
+	}
+	dtc.ACLPolicy = policy
+	klog.Infof("%d access rules loaded", len(policy.Rules))
+
+	return nil
+}
+
+//Authorize check the source of message is allowed to do the operation on
+//each twin in message, and return the results of denied twins. the request
+//without twin is authorized once with empty twin ID, and its result twins
+//are authorized by AuthorizeTwin. the response is
+//always allowed since it is the reply of message from dgtwin.
+func (dtc *DTContext) Authorize(msg *model.Message) []common.TwinResult {
+	policy := dtc.ACLPolicy
+	if policy == nil || msg.GetOperation() == common.DGTWINS_OPS_RESPONSE {
+		return nil
+	}
+
+	twinIDs := make([]string, 0)
+	var aclMsg aclContent
+	if content, ok := msg.Content.([]byte); ok && len(content) > 0 {
+		if err := json.Unmarshal(content, &aclMsg); err != nil {
+			klog.Warningf("Authorize message (%s) with invalid content", msg.GetID())
+		}
+	}
+	requested := make(map[string]*common.DigitalTwin)
+	for key, twin := range aclMsg.Twins {
+		twinIDs = append(twinIDs, twin.ID)
+		requested[twin.ID] = &aclMsg.Twins[key]
+	}
+	if aclMsg.Twin != nil {
+		twinIDs = append(twinIDs, aclMsg.Twin.ID)
+	}
+	if aclMsg.TwinID != "" {
+		twinIDs = append(twinIDs, aclMsg.TwinID)
+	}
+	if len(twinIDs) < 1 {
+		twinIDs = append(twinIDs, "")
+	}
+
+	denied := make([]common.TwinResult, 0)
+	for _, twinID := range twinIDs {
+		if !dtc.authorizeTwin(policy, msg, twinID, requested[twinID]) {
+			denied = append(denied, common.TwinResult{
+				TwinID:	twinID,
+				Code:	common.ForbiddenCode,
+				Reason:	"Forbidden",
+			})
+		}
+	}
+
+	return denied
+}
+
+//AuthorizeTwin check the source of message is allowed to do the operation
+//on the twin. the request without twin (e.g. List, Audit of all twins) is
+//authorized by this on each twin in result, so the twin-scoped deny rules
+//also apply to it.
+func (dtc *DTContext) AuthorizeTwin(msg *model.Message, twinID string) bool {
+	policy := dtc.ACLPolicy
+	if policy == nil {
+		return true
+	}
+
+	return dtc.authorizeTwin(policy, msg, twinID, nil)
+}
+
+// authorizeTwin evaluate the request on twin, requested is the twin in
+// the request content.
+func (dtc *DTContext) authorizeTwin(policy *types.ACLPolicy, msg *model.Message, twinID string, requested *common.DigitalTwin) bool {
+	req := &types.ACLRequest{
+		Source:		msg.GetSource(),
+		Operation:	msg.GetOperation(),
+		Resource:	msg.GetResource(),
+		TwinID:		twinID,
+	}
+	// the saved twin is prior to the twin in request, so the
+	// request can't change the model or metadata to gain access.
+	twin := requested
+	if v, exist := dtc.DGTwinList.Load(twinID); exist {
+		if savedTwin, _ := v.(*common.DigitalTwin); savedTwin != nil {
+			twin = savedTwin
+		}
+	}
+	locked := twinID != "" && dtc.Lock(twinID)
+	req.Model, req.MetaData = aclAttributes(twin)
+	if locked {
+		dtc.Unlock(twinID)
+	}
+
+	if !policy.Allowed(req) {
+		klog.Warningf("%s is not allowed to %s %s (%s)", req.Source, req.Operation, req.Resource, twinID)
+		return false
+	}
+
+	return true
+}
+
+func aclAttributes(twin *common.DigitalTwin) (string, map[string]string) {
+	if twin == nil {
+		return "", nil
+	}
+
+	metaData := make(map[string]string)
+	for name, meta := range twin.MetaData {
+		if meta != nil {
+			metaData[name] = meta.Value
+		}
+	}
+
+	return twin.Model, metaData
+}
@@ -0,0 +1,60 @@
+package dtcontext
+
+import (
+	"k8s.io/klog"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
+)
+
+//SetAuditLog set the audit log of twin mutations, nil means disabled.
+func (dtc *DTContext) SetAuditLog(auditLog *dtstore.AuditLog) {
+	dtc.AuditLog = auditLog
+}
+
+//RecordAudit record the mutation of twin by the message, the source of
+//message is who changed the twin. empty name means the whole twin.
+func (dtc *DTContext) RecordAudit(msg *model.Message, twinID, kind, name string, oldValue, newValue []byte) {
+	if dtc.AuditLog == nil || msg == nil {
+		return
+	}
+
+	// the timestamp is set by the audit log, so the records are in time order.
+	record := &common.AuditRecord{
+		Source:		msg.GetSource(),
+		Operation:	msg.GetOperation(),
+		MessageID:	msg.GetID(),
+		TwinID:		twinID,
+		Kind:		kind,
+		Property:	name,
+		OldValue:	oldValue,
+		NewValue:	newValue,
+	}
+	if err := dtc.AuditLog.Append(record); err != nil {
+		klog.Errorf("Record audit of twin (%s) failed (%v)", twinID, err)
+	}
+}
+
+//RecordPropertyAudit record the change of property, oldProp is nil if the
+//property is created and prop is nil if the property is deleted.
+func (dtc *DTContext) RecordPropertyAudit(msg *model.Message, twinID, kind, name string, oldProp, prop *common.TwinProperty) {
+	var oldValue, newValue []byte
+	if oldProp != nil {
+		oldValue = oldProp.Value
+	}
+	if prop != nil {
+		newValue = prop.Value
+	}
+
+	dtc.RecordAudit(msg, twinID, kind, name, oldValue, newValue)
+}
+
+//QueryAudit return at most limit audit records of twin in time range,
+// the first offset records are skipped.
+func (dtc *DTContext) QueryAudit(twinID string, start, end int64, offset, limit int) ([]common.AuditRecord, error) {
+	if dtc.AuditLog == nil {
+		return []common.AuditRecord{}, nil
+	}
+
+	return dtc.AuditLog.Query(twinID, start, end, offset, limit)
+}
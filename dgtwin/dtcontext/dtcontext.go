@@ -7,9 +7,11 @@ import (
 	"strings"
 	"k8s.io/klog"
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/beehive/pkg/core/context"
 	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
 )
 
 type DTContext struct {
@@ -21,11 +23,29 @@ type DTContext struct {
 
 	ModuleHealth	*sync.Map
 	MessageCache	*sync.Map
-	//this is for watch event.
-	WatchCache	[2]*sync.Map
+	//this is for watch event, key is twin ID, value is a *sync.Map
+	// which key is the watcher (message source) and value is *types.WatchEvent.
+	WatchCache	*sync.Map
 	// Cache for digitaltwin	
 	DGTwinList	*sync.Map
 	DGTwinMutex	*sync.Map	
+	// persistent storage for digitaltwin, nil means memory only.
+	Store		dtstore.TwinStore
+	// device models, key is model name, value is *common.DeviceModel.
+	Models		*sync.Map
+	// history of reported properties, key is twin ID.
+	History		*sync.Map
+	// max count and max age of each property history.
+	HistoryMaxCount	int
+	HistoryMaxAge	time.Duration
+	// liveness state of twins, key is twin ID.
+	Liveness	*sync.Map
+	// liveness policy of twins which have no policy in twin or model.
+	DefaultLiveness	*common.LivenessPolicy
+	// access policy of requests, nil means all requests are allowed.
+	ACLPolicy	*types.ACLPolicy
+	// audit log of twin mutations, nil means disabled.
+	AuditLog	*dtstore.AuditLog
 }
 
 func NewDTContext(c *context.Context) *DTContext {
@@ -39,8 +59,12 @@ func NewDTContext(c *context.Context) *DTContext {
 	confirmChan :=	make(chan interface{})
 	var modulesHealth sync.Map
 	var messageCache sync.Map
+	var watchCache sync.Map
 	var dgTwinList sync.Map
 	var dgTwinMutex sync.Map
+	var models sync.Map
+	var history sync.Map
+	var liveness sync.Map
 
 	return &DTContext{
 		Context:	c,
@@ -50,8 +74,19 @@ func NewDTContext(c *context.Context) *DTContext {
 		ConfirmChan:	confirmChan,
 		ModuleHealth:	&modulesHealth,
 		MessageCache:   &messageCache,
+		WatchCache:		&watchCache,
 		DGTwinList: 	&dgTwinList,
 		DGTwinMutex:	&dgTwinMutex,
+		Models:			&models,
+		History:		&history,
+		HistoryMaxCount:	types.DGTWINS_HISTORY_MAX_COUNT,
+		HistoryMaxAge:		types.DGTWINS_HISTORY_MAX_AGE*time.Second,
+		Liveness:		&liveness,
+		DefaultLiveness:	&common.LivenessPolicy{
+			Interval:		types.DGTWINS_LIVENESS_INTERVAL,
+			MissTolerance:	types.DGTWINS_LIVENESS_MISS_TOLERANCE,
+			TrafficAsAlive:	true,
+		},
 	}
 }
 
@@ -136,6 +171,24 @@ func (dtc *DTContext) Unlock (deviceID string) bool {
 	return false
 }
 
+//LockTwin lock the saved twin and check it is still saved, the twin may be
+//deleted (or created again) before the lock is got. the twin is unlocked
+//if false is returned.
+func (dtc *DTContext) LockTwin (twin *common.DigitalTwin) bool {
+	mutex, ok := dtc.GetMutex(twin.ID)
+	if !ok {
+		return false
+	}
+	mutex.Lock()
+
+	if v, exist := dtc.DGTwinList.Load(twin.ID); !exist || v != twin {
+		mutex.Unlock()
+		return false
+	}
+
+	return true
+}
+
 //digital twin is exist.
 func (dtc *DTContext) DGTwinIsExist (deviceID string) bool {
 	v, exist := dtc.DGTwinList.Load(deviceID)
@@ -151,6 +204,109 @@ func (dtc *DTContext) DGTwinIsExist (deviceID string) bool {
 	return true
 }
 
+//SetStore set the persistent storage for digital twins.
+func (dtc *DTContext) SetStore(store dtstore.TwinStore) {
+	dtc.Store = store
+}
+
+//LoadTwins load all saved twins from store into DGTwinList.
+func (dtc *DTContext) LoadTwins() error {
+	if dtc.Store == nil {
+		return nil
+	}
+
+	twins, err := dtc.Store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	for _, twin := range twins {
+		dtc.DGTwinList.Store(twin.ID, twin)
+		var deviceMutex	sync.Mutex
+		dtc.DGTwinMutex.Store(twin.ID, &deviceMutex)
+	}
+	klog.Infof("%d twins loaded from store", len(twins))
+
+	return nil
+}
+
+//LoadModels load all device models from the directory.
+func (dtc *DTContext) LoadModels(dir string) error {
+	models, err := dtstore.LoadModels(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, model := range models {
+		dtc.Models.Store(model.Name, model)
+	}
+	klog.Infof("%d device models loaded", len(models))
+
+	return nil
+}
+
+//GetModel return the device model by name, or nil if it is not exist.
+func (dtc *DTContext) GetModel(name string) *common.DeviceModel {
+	if name == "" {
+		return nil
+	}
+
+	v, exist := dtc.Models.Load(name)
+	if !exist {
+		return nil
+	}
+	model, _ := v.(*common.DeviceModel)
+
+	return model
+}
+
+//GetTwinModels return all device models referenced by the twins.
+func (dtc *DTContext) GetTwinModels(twins []common.DigitalTwin) []common.DeviceModel {
+	models := make([]common.DeviceModel, 0)
+	names := make(map[string]bool)
+
+	for _, twin := range twins {
+		if twin.Model == "" || names[twin.Model] {
+			continue
+		}
+		names[twin.Model] = true
+
+		if model := dtc.GetModel(twin.Model); model != nil {
+			models = append(models, *model)
+		}
+	}
+
+	return models
+}
+
+//SaveTwin save the whole twin into store.
+func (dtc *DTContext) SaveTwin(twin *common.DigitalTwin) error {
+	if dtc.Store == nil {
+		return nil
+	}
+
+	return dtc.Store.Put(twin)
+}
+
+//DeleteSavedTwin delete the twin from store.
+func (dtc *DTContext) DeleteSavedTwin(twinID string) error {
+	if dtc.Store == nil {
+		return nil
+	}
+
+	return dtc.Store.Delete(twinID)
+}
+
+//SaveProperty save the desired/reported property and the twin version into store,
+// if prop is nil, the property will be deleted from store.
+func (dtc *DTContext) SaveProperty(twin *common.DigitalTwin, kind, name string, prop *common.TwinProperty) error {
+	if dtc.Store == nil {
+		return nil
+	}
+
+	return dtc.Store.PatchProperty(twin.ID, twin.Version, kind, name, prop)
+}
+
 func (dtc *DTContext) GetTwinState(twinID string) string {
 	v, _ := dtc.DGTwinList.Load(twinID)
 	dgTwin, _ := v.(*common.DigitalTwin)
@@ -183,14 +339,23 @@ func (dtc *DTContext) Send(module string, msg *model.Message) {
 	dtc.Context.Send(module, msg)
 }
 
-//SendResponseMessage Send Response conten.
-func (dtc *DTContext) SendResponseMessage(requestMsg *model.Message, content []byte){
+//BuildResponseModelMessage build the response of request, it's tagged
+// with the request ID.
+func (dtc *DTContext) BuildResponseModelMessage(requestMsg *model.Message, content []byte) *model.Message {
 	target := requestMsg.GetSource()
 	resource := requestMsg.GetResource()
 
 	modelMsg := dtc.BuildModelMessage(types.MODULE_NAME, target, 
 					common.DGTWINS_OPS_RESPONSE, resource, content)	
 	modelMsg.SetTag(requestMsg.GetID())	
+	trace.Propagate(requestMsg, modelMsg)
+
+	return modelMsg
+}
+
+//SendResponseMessage Send Response conten.
+func (dtc *DTContext) SendResponseMessage(requestMsg *model.Message, content []byte){
+	modelMsg := dtc.BuildResponseModelMessage(requestMsg, content)
 	klog.Infof("Send response message (%v)", modelMsg)
 
 	dtc.SendToModule(types.DGTWINS_MODULE_COMM, modelMsg)
@@ -204,8 +369,27 @@ func (dtc *DTContext) SendSyncMessage(target, resource string, content []byte){
 	dtc.SendToModule(types.DGTWINS_MODULE_COMM, modelMsg)
 }
 
+//SendLifecycleEvent send the lifecycle event of twin to the subscribers.
+func (dtc *DTContext) SendLifecycleEvent(twinID, event, reason string) {
+	lifecycleEvent := &common.LifecycleEvent{
+		TwinID:		twinID,
+		Event:		event,
+		Timestamp:	time.Now().UnixNano() / 1e6,
+		Reason:		reason,
+	}
+	klog.Infof("Twin (%s) lifecycle event %s (%s)", twinID, event, reason)
+
+	dtc.SendToModule(types.DGTWINS_MODULE_LIFECYCLE, lifecycleEvent)
+}
+
 //SendMessage2Device Send twin message to device.
 func (dtc *DTContext) SendMessage2Device(action string, twin *common.DeviceTwin) error {
+	return dtc.SendRequestMessage2Device(nil, action, twin)
+}
+
+//SendRequestMessage2Device Send twin message to device on behalf of the request,
+// the requester will be notified if the message can't be delivered.
+func (dtc *DTContext) SendRequestMessage2Device(requestMsg *model.Message, action string, twin *common.DeviceTwin) error {
 	resource := common.DGTWINS_RESOURCE_DEVICE
 	deviceID := twin.ID
 	target := "device@"+deviceID 
@@ -216,60 +400,152 @@ func (dtc *DTContext) SendMessage2Device(action string, twin *common.DeviceTwin)
 	}
 	modelMsg := common.BuildModelMessage(types.MODULE_NAME, 
 							target, action, resource, msgContent) 
+	trace.Propagate(requestMsg, modelMsg)
 	klog.Infof("Send device message (%v) ", modelMsg)
-	dtc.SendToModule(types.DGTWINS_MODULE_COMM, modelMsg)
+	if requestMsg == nil {
+		dtc.SendToModule(types.DGTWINS_MODULE_COMM, modelMsg)
+	}else {
+		dtc.SendToModule(types.DGTWINS_MODULE_COMM, &types.CachedMessage{
+			Msg:		modelMsg,
+			Requester:	requestMsg,
+		})
+	}
 		
 	return nil
 }
 
-func (dtc *DTContext) UpdateWatchCache(we *types.WatchEvent) {
-	var idx int 
+//SendResponse2Device Send response of the device request to device.
+func (dtc *DTContext) SendResponse2Device(requestMsg *model.Message, deviceID string, content []byte) {
+	modelMsg := dtc.BuildModelMessage(types.MODULE_NAME, "device@"+deviceID,
+					common.DGTWINS_OPS_RESPONSE, requestMsg.GetResource(), content)
+	modelMsg.SetTag(requestMsg.GetID())
+	trace.Propagate(requestMsg, modelMsg)
+	klog.Infof("Send device response message (%v) ", modelMsg)
 
+	dtc.SendToModule(types.DGTWINS_MODULE_COMM, modelMsg)
+}
+
+//UpdateWatchCache add the watch event or merge the watched properties
+// into the exist watch event of this watcher. 
+// empty property list means watch all properties.
+func (dtc *DTContext) UpdateWatchCache(we *types.WatchEvent) {
 	if we == nil {
 		return 
 	}
 
-	if dtc.WatchCache[0] == nil {
-		var watchCache	sync.Map
-		dtc.WatchCache[0] = &watchCache
+	v, _ := dtc.WatchCache.LoadOrStore(we.TwinID, &sync.Map{})
+	watchers := v.(*sync.Map)
+
+	v, exist := watchers.Load(we.Source)
+	watchEvent, isThisType := v.(*types.WatchEvent)
+	if !exist || !isThisType || len(we.List) < 1 {
+		watchers.Store(we.Source, we)
+		return
 	}
-	if dtc.WatchCache[1] == nil {
-		var watchCache1	sync.Map
-		dtc.WatchCache[1] = &watchCache1
+	if len(watchEvent.List) < 1 {
+		//already watch all properties.
+		return
 	}
 
-	if strings.Contains(we.Source, "edge"){
-		idx = 1
+	//copy on write, the old event may be used by others.
+	newEvent := types.CreateWatchEvent(we.MsgID, we.TwinID, we.Source, we.Resource)
+	newEvent.List = append(newEvent.List, watchEvent.List...)
+	for _, value :=  range we.List {
+		ok := false 	
+		for _, val := range newEvent.List {
+			if 	value == val {
+				ok = true
+				break
+			}					
+		}
+		if ok {
+			continue
+		}
+		newEvent.List = append(newEvent.List, value)
+	}
+	watchers.Store(we.Source, newEvent)
+}
+
+//DeleteWatchCache remove the properties in list from watcher's watch event,
+// if list is empty or no property is watched any more, the watch is closed.
+// a watch for all properties can only be closed with an empty list.
+func (dtc *DTContext) DeleteWatchCache(twinID, source string, list []string) {
+	v, exist := dtc.WatchCache.Load(twinID)
+	if !exist {
+		return
+	}
+	watchers := v.(*sync.Map)
+
+	v, exist = watchers.Load(source)
+	watchEvent, isThisType := v.(*types.WatchEvent)
+	if !exist || !isThisType {
+		return
+	}
+
+	if len(list) < 1 {
+		watchers.Delete(source)
+		return
+	}
+	if len(watchEvent.List) < 1 {
+		return
+	}
+
+	newEvent := types.CreateWatchEvent(watchEvent.MsgID, twinID, source, watchEvent.Resource)
+	for _, val := range watchEvent.List {
+		if !containsString(list, val) {
+			newEvent.List = append(newEvent.List, val)
+		}
+	}
+
+	if len(newEvent.List) < 1 {
+		watchers.Delete(source)
 	}else {
-		idx = 0
+		watchers.Store(source, newEvent)
 	}
-		
-	v, exist := dtc.WatchCache[idx].Load(we.TwinID)
+}
+
+//DeleteTwinWatch remove all watch events of the twin.
+func (dtc *DTContext) DeleteTwinWatch(twinID string) {
+	dtc.WatchCache.Delete(twinID)
+}
+
+//GetWatchEvents get all watch events of the twin.
+func (dtc *DTContext) GetWatchEvents(twinID string) []*types.WatchEvent {
+	events := make([]*types.WatchEvent, 0)
+
+	v, exist := dtc.WatchCache.Load(twinID)
 	if !exist {
-		dtc.WatchCache[idx].Store(we.TwinID, we)
-	}else{ 
-		watchEvent, isThisType := v.(*types.WatchEvent)
-		if isThisType {
-			for _, value :=  range we.List {
-				ok := false 	
-				for _, val := range watchEvent.List {
-					if 	value == val {
-						ok = true
-						break
-					}					
-				}
-				if ok {
-					continue
-				}
-				watchEvent.List = append(watchEvent.List, value)
-			}
+		return events
+	}
+
+	v.(*sync.Map).Range(func(key, value interface{}) bool {
+		if we, isThisType := value.(*types.WatchEvent); isThisType {
+			events = append(events, we)
 		}
-	}	
+		return true
+	})
+
+	return events
 }
 
 // RangeWatchCache  Range each watchevent.
 func (dtc *DTContext) RangeWatchCache(f func(key, value interface{}) bool){
-	for _, cacheMap := range dtc.WatchCache	{
-		cacheMap.Range(f)
+	dtc.WatchCache.Range(func(twinID, v interface{}) bool {
+		next := true
+		v.(*sync.Map).Range(func(key, value interface{}) bool {
+			next = f(key, value)
+			return next
+		})
+		return next
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, val := range list {
+		if val == s {
+			return true
+		}
 	}
+
+	return false
 }
@@ -0,0 +1,216 @@
+package dtcontext
+
+import (
+	"sync"
+	"time"
+	"github.com/jwzl/edgeOn/common"
+)
+
+// historyRing is a bounded history of a property, the oldest
+// value is overwritten when it is full.
+type historyRing struct {
+	points		[]common.HistoryPoint
+	// index of the oldest point.
+	start		int
+	size		int
+	valueType	string
+}
+
+func newHistoryRing(capacity int) *historyRing {
+	return &historyRing{points: make([]common.HistoryPoint, capacity)}
+}
+
+func (hr *historyRing) add(point common.HistoryPoint) {
+	capacity := len(hr.points)
+	if hr.size < capacity {
+		hr.points[(hr.start+hr.size)%capacity] = point
+		hr.size++
+	} else {
+		hr.points[hr.start] = point
+		hr.start = (hr.start + 1) % capacity
+	}
+}
+
+// expire drop all points older than deadline.
+func (hr *historyRing) expire(deadline int64) {
+	for hr.size > 0 && hr.points[hr.start].Timestamp < deadline {
+		hr.points[hr.start] = common.HistoryPoint{}
+		hr.start = (hr.start + 1) % len(hr.points)
+		hr.size--
+	}
+}
+
+// rangeOf return the points in time range [start, end], 0 means no limit.
+func (hr *historyRing) rangeOf(start, end int64) []common.HistoryPoint {
+	points := make([]common.HistoryPoint, 0)
+
+	for i := 0; i < hr.size; i++ {
+		point := hr.points[(hr.start+i)%len(hr.points)]
+		if start > 0 && point.Timestamp < start {
+			continue
+		}
+		if end > 0 && point.Timestamp > end {
+			break
+		}
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// twinHistory is the history of all reported properties of a twin.
+type twinHistory struct {
+	sync.Mutex
+	props		map[string]*historyRing
+}
+
+//SetHistoryLimit set the max count and max age of each property history.
+func (dtc *DTContext) SetHistoryLimit(maxCount int, maxAge time.Duration) {
+	dtc.HistoryMaxCount = maxCount
+	dtc.HistoryMaxAge = maxAge
+}
+
+//RecordHistory append the reported property value into its history.
+func (dtc *DTContext) RecordHistory(twinID string, prop *common.TwinProperty) {
+	if prop == nil || dtc.HistoryMaxCount <= 0 {
+		return
+	}
+
+	v, _ := dtc.History.LoadOrStore(twinID, &twinHistory{props: make(map[string]*historyRing)})
+	history := v.(*twinHistory)
+
+	now := time.Now().UnixNano() / 1e6
+	value := make([]byte, len(prop.Value))
+	copy(value, prop.Value)
+
+	history.Lock()
+	ring, exist := history.props[prop.Name]
+	if !exist {
+		ring = newHistoryRing(dtc.HistoryMaxCount)
+		history.props[prop.Name] = ring
+	}
+	ring.valueType = prop.Type
+	ring.expire(now - int64(dtc.HistoryMaxAge/time.Millisecond))
+	ring.add(common.HistoryPoint{Timestamp: now, Value: value})
+	history.Unlock()
+}
+
+//QueryHistory return the history of the properties in time range [start, end] of
+// the twin, empty names means all properties. if interval > 0, the values
+// are downsampled into buckets of interval millisecond.
+func (dtc *DTContext) QueryHistory(twinID string, names []string, start, end, interval int64) []common.PropertyHistory {
+	result := make([]common.PropertyHistory, 0)
+
+	v, exist := dtc.History.Load(twinID)
+	if !exist {
+		return result
+	}
+	history := v.(*twinHistory)
+	deadline := time.Now().UnixNano()/1e6 - int64(dtc.HistoryMaxAge/time.Millisecond)
+
+	history.Lock()
+	defer history.Unlock()
+
+	if len(names) < 1 {
+		for name, _ := range history.props {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		ring, exist := history.props[name]
+		if !exist {
+			continue
+		}
+
+		ring.expire(deadline)
+		points := ring.rangeOf(start, end)
+		if interval > 0 {
+			points = downsample(ring.valueType, points, interval)
+		}
+		result = append(result, common.PropertyHistory{
+			TwinID:	twinID,
+			Name:	name,
+			Type:	ring.valueType,
+			Points:	points,
+		})
+	}
+
+	return result
+}
+
+//DeleteHistory delete the history of the properties of the twin,
+// empty names means the whole twin.
+func (dtc *DTContext) DeleteHistory(twinID string, names ...string) {
+	if len(names) < 1 {
+		dtc.History.Delete(twinID)
+		return
+	}
+
+	v, exist := dtc.History.Load(twinID)
+	if !exist {
+		return
+	}
+	history := v.(*twinHistory)
+
+	history.Lock()
+	for _, name := range names {
+		delete(history.props, name)
+	}
+	history.Unlock()
+}
+
+// downsample merge the points into buckets, the buckets are aligned to
+// multiple of interval.
+func downsample(valueType string, points []common.HistoryPoint, interval int64) []common.HistoryPoint {
+	buckets := make([]common.HistoryPoint, 0)
+	var sum float64
+	numbers := 0
+
+	for _, point := range points {
+		bucketStart := point.Timestamp - point.Timestamp%interval
+		if len(buckets) < 1 || buckets[len(buckets)-1].Timestamp != bucketStart {
+			buckets = append(buckets, common.HistoryPoint{Timestamp: bucketStart})
+			sum = 0
+			numbers = 0
+		}
+		bucket := &buckets[len(buckets)-1]
+		bucket.Value = point.Value
+		bucket.Count++
+
+		number, isNumber := numberValue(valueType, point.Value)
+		if !isNumber {
+			continue
+		}
+		if bucket.Min == nil || number < *bucket.Min {
+			min := number
+			bucket.Min = &min
+		}
+		if bucket.Max == nil || number > *bucket.Max {
+			max := number
+			bucket.Max = &max
+		}
+		sum += number
+		numbers++
+		avg := sum / float64(numbers)
+		bucket.Avg = &avg
+	}
+
+	return buckets
+}
+
+// numberValue decode the numeric value.
+func numberValue(valueType string, value []byte) (float64, bool) {
+	v, err := common.DecodePropertyValue(valueType, value)
+	if err != nil {
+		return 0, false
+	}
+
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
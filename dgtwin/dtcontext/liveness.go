@@ -0,0 +1,120 @@
+package dtcontext
+
+import (
+	"sync"
+	"time"
+	"github.com/jwzl/edgeOn/common"
+)
+
+// livenessState is the liveness of a twin.
+type livenessState struct {
+	sync.Mutex
+	// last time the device is proved alive.
+	lastSeen	time.Time
+	// last time the device is pinged.
+	lastPing	time.Time
+	// the last ping is not answered yet.
+	pending		bool
+	// count of the continuous missed pings.
+	misses		int
+}
+
+//SetLivenessPolicy set the default liveness policy.
+func (dtc *DTContext) SetLivenessPolicy(policy *common.LivenessPolicy) {
+	if policy != nil && policy.Check() == nil {
+		dtc.DefaultLiveness = policy
+	}
+}
+
+//GetLivenessPolicy return the liveness policy of the twin, the policy of
+// twin overrides the policy of its model, and then the default policy.
+func (dtc *DTContext) GetLivenessPolicy(twinID string) *common.LivenessPolicy {
+	v, _ := dtc.DGTwinList.Load(twinID)
+	if twin, _ := v.(*common.DigitalTwin); twin != nil {
+		if twin.Liveness != nil {
+			return twin.Liveness
+		}
+		if devModel := dtc.GetModel(twin.Model); devModel != nil && devModel.Liveness != nil {
+			return devModel.Liveness
+		}
+	}
+
+	return dtc.DefaultLiveness
+}
+
+func (dtc *DTContext) getLivenessState(twinID string) *livenessState {
+	v, _ := dtc.Liveness.LoadOrStore(twinID, &livenessState{})
+	return v.(*livenessState)
+}
+
+//MarkAlive mark the device is alive. byTraffic means the device just
+// has traffic (Sync/Update/Response) but not answers the ping, it is
+// ignored unless the policy treats traffic as proof of life.
+func (dtc *DTContext) MarkAlive(twinID string, byTraffic bool) {
+	if !dtc.DGTwinIsExist(twinID) {
+		return
+	}
+	if byTraffic && !dtc.GetLivenessPolicy(twinID).TrafficAsAlive {
+		return
+	}
+
+	state := dtc.getLivenessState(twinID)
+	state.Lock()
+	state.lastSeen = time.Now()
+	state.pending = false
+	state.misses = 0
+	state.Unlock()
+}
+
+//MarkMissed record a miss of the device (e.g. the message to device is
+// failed), the device is marked offline by CheckLiveness when it has
+// missed too many times.
+func (dtc *DTContext) MarkMissed(twinID string) {
+	if !dtc.DGTwinIsExist(twinID) {
+		return
+	}
+
+	state := dtc.getLivenessState(twinID)
+	state.Lock()
+	state.misses++
+	state.Unlock()
+}
+
+//CheckLiveness check the liveness of the twin at now, it returns whether
+// the device should be pinged, and whether the online device has missed
+// too many pings and should be marked offline.
+func (dtc *DTContext) CheckLiveness(twinID string, now time.Time) (bool, bool) {
+	policy := dtc.GetLivenessPolicy(twinID)
+	interval := time.Duration(policy.Interval) * time.Second
+	online := dtc.GetTwinState(twinID) == common.DGTWINS_STATE_ONLINE
+	offline := false
+
+	state := dtc.getLivenessState(twinID)
+	state.Lock()
+	defer state.Unlock()
+
+	if now.Sub(state.lastPing) < interval {
+		return false, false
+	}
+	// the online device has traffic recently, skip the ping.
+	if online && policy.TrafficAsAlive && now.Sub(state.lastSeen) < interval {
+		return false, false
+	}
+
+	if state.pending {
+		state.misses++
+	}
+	if online && state.misses >= policy.MissTolerance {
+		offline = true
+		state.misses = 0
+	}
+	state.pending = true
+	state.lastPing = now
+
+	return true, offline
+}
+
+//DeleteLiveness delete the liveness state of the twin.
+func (dtc *DTContext) DeleteLiveness(twinID string) {
+	dtc.Liveness.Delete(twinID)
+}
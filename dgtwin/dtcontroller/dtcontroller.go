@@ -4,10 +4,16 @@ import (
 	"time"
 	"errors"
 	"strings"	
+	"encoding/json"
 	"k8s.io/klog"
 	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/beehive/pkg/core/context"
 	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/config"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
 	"github.com/jwzl/edgeOn/dgtwin/dtmodule"
 )
@@ -28,7 +34,9 @@ func NewDGTwinController(id	string, c *context.Context) *DGTwinController {
 	stop := make(chan bool, 1)
 
 	// create and register all modules.
-	modules := []string{types.DGTWINS_MODULE_COMM, types.DGTWINS_MODULE_TWINS, types.DGTWINS_MODULE_PROPERTY}
+	modules := []string{types.DGTWINS_MODULE_COMM, types.DGTWINS_MODULE_TWINS, 
+						types.DGTWINS_MODULE_PROPERTY, types.DGTWINS_MODULE_RECONCILE,
+						types.DGTWINS_MODULE_LIFECYCLE, types.DGTWINS_MODULE_METHOD}
 	for _, name := range modules {
 		dtm := dtmodule.NewDTModule(name)
 		ctx.RegisterDTModule(dtm)
@@ -43,6 +51,15 @@ func NewDGTwinController(id	string, c *context.Context) *DGTwinController {
 }
 
 func (dtc *DGTwinController) Start() error {
+	//Load all saved twins before sub-modules start.
+	dtc.initStore()
+	dtc.initModels()
+	dtc.initACL()
+	dtc.initHistory()
+	dtc.initAudit()
+	dtc.context.SetLivenessPolicy(config.GetDGTwinConfig().Liveness)
+	dtc.initMetrics()
+
 	//Start all sub-modules.
 	for _ , module := range dtc.context.Modules {
 		go module.Start()
@@ -76,6 +93,7 @@ func (dtc *DGTwinController) Start() error {
 			for name , _ := range dtc.context.Modules {
 				dtc.context.StopModule(name) 
 			}
+			dtc.closeStore()
 
 			return nil
 		}
@@ -86,6 +104,100 @@ func (dtc *DGTwinController) CleanUp(){
 	for name , _ := range dtc.context.Modules {
 		dtc.context.StopModule(name) 
 	}
+	dtc.closeStore()
+}
+
+// initStore open the twin store and load all saved twins.
+// If the store can't be opened, twins are kept in memory only.
+func (dtc *DGTwinController) initStore() {
+	conf := config.GetDGTwinConfig()
+	store, err := dtstore.NewFileStore(conf.StorePath)
+	if err != nil {
+		klog.Errorf("Open twin store %s failed (%v), twins will not be saved", conf.StorePath, err)
+		return
+	}
+
+	dtc.context.SetStore(store)
+	err = dtc.context.LoadTwins()
+	if err != nil {
+		klog.Errorf("Load twins from store failed (%v)", err)
+	}
+}
+
+// initHistory set the limit of property history.
+func (dtc *DGTwinController) initHistory() {
+	conf := config.GetDGTwinConfig()
+	dtc.context.SetHistoryLimit(conf.HistoryMaxCount, time.Duration(conf.HistoryMaxAge)*time.Second)
+}
+
+// initAudit open the audit log of twin mutations.
+func (dtc *DGTwinController) initAudit() {
+	conf := config.GetDGTwinConfig()
+	if conf.AuditPath == "" {
+		return
+	}
+
+	auditLog, err := dtstore.NewAuditLog(conf.AuditPath, conf.AuditMaxSize, conf.AuditMaxFiles)
+	if err != nil {
+		klog.Errorf("Open audit log %s failed (%v), twin mutations will not be audited", conf.AuditPath, err)
+		return
+	}
+	dtc.context.SetAuditLog(auditLog)
+}
+
+// initModels load all device models.
+func (dtc *DGTwinController) initModels() {
+	conf := config.GetDGTwinConfig()
+	err := dtc.context.LoadModels(conf.ModelPath)
+	if err != nil {
+		klog.Errorf("Load device models from %s failed (%v)", conf.ModelPath, err)
+	}
+}
+
+// initACL load the access policy, all requests are denied if
+// the policy can't be loaded.
+func (dtc *DGTwinController) initACL() {
+	conf := config.GetDGTwinConfig()
+	err := dtc.context.LoadACLPolicy(conf.ACLPath)
+	if err != nil {
+		klog.Errorf("Load access policy from %s failed (%v), all requests are denied", conf.ACLPath, err)
+		dtc.context.ACLPolicy = &types.ACLPolicy{Default: types.ACL_EFFECT_DENY}
+	}
+}
+
+// initMetrics register the gauges of twins and message cache.
+func (dtc *DGTwinController) initMetrics() {
+	metrics.NewGaugeFunc("edgeon_dgtwin_twins", "Digital twins by state.", []string{"state"},
+		func(observe func(value float64, labelValues ...string)) {
+			dtc.context.DGTwinList.Range(func(key, value interface{}) bool {
+				state := dtc.context.GetTwinState(key.(string))
+				if state == "" {
+					state = "unknown"
+				}
+				observe(1, state)
+				return true
+			})
+		})
+	metrics.NewGaugeFunc("edgeon_dgtwin_message_cache_depth", "Messages which wait for response.", nil,
+		func(observe func(value float64, labelValues ...string)) {
+			depth := 0
+			dtc.context.MessageCache.Range(func(key, value interface{}) bool {
+				depth++
+				return true
+			})
+			observe(float64(depth))
+		})
+}
+
+func (dtc *DGTwinController) closeStore() {
+	if dtc.context.Store != nil {
+		dtc.context.Store.Close()
+		dtc.context.SetStore(nil)
+	}
+	if dtc.context.AuditLog != nil {
+		dtc.context.AuditLog.Close()
+		dtc.context.SetAuditLog(nil)
+	}
 }
 
 func (dtc *DGTwinController) RecvModuleMsg(){
@@ -117,10 +229,48 @@ func (dtc *DGTwinController) dispatch(msg *model.Message) error {
 		return errors.New("message is not to this module ")
 	}
 
+	start := time.Now()
+	trace.Start(msg)
+	// the message queued by hub is delivered, so comm stops resending it.
+	if msg.GetOperation() == common.DGTWINS_OPS_QUEUED && msg.GetSource() == common.HubModuleName {
+		dtc.context.SendToModule(types.DGTWINS_MODULE_COMM, msg)
+		trace.Record(types.MODULE_NAME, msg, start, trace.SPAN_OUTCOME_OK)
+		return nil
+	}
+	if denied := dtc.context.Authorize(msg); len(denied) > 0 {
+		trace.Record(types.MODULE_NAME, msg, start, trace.SPAN_OUTCOME_DENIED)
+		dtc.sendForbidden(msg, denied)
+		return errors.New(msg.GetSource() + " is not allowed to " + msg.GetOperation() + " " + resource)
+	}
+
 	if strings.Contains(resource, types.DGTWINS_MODULE_TWINS){
 		dtc.context.SendToModule(types.DGTWINS_MODULE_TWINS, msg)
 	}else if strings.Contains(resource, types.DGTWINS_MODULE_PROPERTY) {
 		dtc.context.SendToModule(types.DGTWINS_MODULE_PROPERTY, msg)
+	}else if strings.Contains(resource, types.DGTWINS_MODULE_LIFECYCLE) {
+		dtc.context.SendToModule(types.DGTWINS_MODULE_LIFECYCLE, msg)
+	}else if strings.Contains(resource, types.DGTWINS_MODULE_METHOD) {
+		dtc.context.SendToModule(types.DGTWINS_MODULE_METHOD, msg)
 	}
+	opLabel, resourceLabel := common.MetricLabels(msg.GetOperation(), resource)
+	metrics.MessagesTotal.Inc(common.TwinModuleName, opLabel, resourceLabel)
+	trace.Record(types.MODULE_NAME, msg, start, trace.SPAN_OUTCOME_OK)
+
 	return nil
 }
+
+// sendForbidden reply the denied request with ForbiddenCode, the
+// denied twins are in the twin results.
+func (dtc *DGTwinController) sendForbidden(msg *model.Message, denied []common.TwinResult) {
+	content, err := json.Marshal(&common.TwinResponse{
+		Code:			common.ForbiddenCode,
+		Reason:			"Forbidden",
+		TwinResults:	denied,
+	})
+	if err != nil {
+		klog.Errorf("Build forbidden response failed (%v)", err)
+		return
+	}
+
+	dtc.context.SendResponseMessage(msg, content)
+}
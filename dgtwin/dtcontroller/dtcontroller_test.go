@@ -18,7 +18,9 @@ package dtcontroller
 import (
 	"reflect"	
 	"testing"
+	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/beehive/pkg/core/context"
+	"github.com/jwzl/edgeOn/common"
 	"github.com/jwzl/edgeOn/dgtwin/types"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
 )
@@ -43,7 +45,8 @@ func TestNewDGTwinController(t *testing.T){
 				Stop: make(chan bool, 1),
 				context: ctx,
 			},
-			list:	[]string {types.DGTWINS_MODULE_COMM, types.DGTWINS_MODULE_TWINS, types.DGTWINS_MODULE_PROPERTY},				
+			list:	[]string {types.DGTWINS_MODULE_COMM, types.DGTWINS_MODULE_TWINS, 
+							types.DGTWINS_MODULE_PROPERTY, types.DGTWINS_MODULE_RECONCILE},				
 		},
 	}
 
@@ -85,3 +88,89 @@ func TestNewDGTwinController(t *testing.T){
 }
 
 
+
+func TestDispatchACL(t *testing.T) {
+	c := context.GetContext(context.MsgCtxTypeChannel)
+	dtc := NewDGTwinController("", c)
+	dtc.context.ACLPolicy = &types.ACLPolicy{
+		Default: types.ACL_EFFECT_ALLOW,
+		Rules: []types.ACLRule{
+			{Effect: types.ACL_EFFECT_ALLOW, Sources: []string{"edge/app/thirdparty"},
+				Operations: []string{common.DGTWINS_OPS_GET, common.DGTWINS_OPS_WATCH}, Models: []string{"sensor"}},
+			{Effect: types.ACL_EFFECT_DENY, Sources: []string{"edge/app/thirdparty"}},
+		},
+	}
+	dtc.context.DGTwinList.Store("sensor01", &common.DigitalTwin{ID: "sensor01", Model: "sensor"})
+	dtc.context.DGTwinList.Store("switch01", &common.DigitalTwin{ID: "switch01", Model: "actuator"})
+
+	buildMessage := func(source, operation string, twinIDs ...string) *model.Message {
+		twins := make([]common.DigitalTwin, 0)
+		for _, twinID := range twinIDs {
+			// the model in request can't override the saved model.
+			twins = append(twins, common.DigitalTwin{ID: twinID, Model: "sensor"})
+		}
+		content, _ := common.BuildTwinMessage(twins)
+		return common.BuildModelMessage(source, types.MODULE_NAME, operation, common.DGTWINS_RESOURCE_PROPERTY, content)
+	}
+
+	tests := []struct {
+		name	string
+		msg		*model.Message
+		denied	[]string
+	}{
+		{"third party get sensor", buildMessage("edge/app/thirdparty", common.DGTWINS_OPS_GET, "sensor01"), nil},
+		{"third party update sensor", buildMessage("edge/app/thirdparty", common.DGTWINS_OPS_UPDATE, "sensor01"), []string{"sensor01"}},
+		{"third party get actuator", buildMessage("edge/app/thirdparty", common.DGTWINS_OPS_GET, "sensor01", "switch01"), []string{"switch01"}},
+		{"third party get all", buildMessage("edge/app/thirdparty", common.DGTWINS_OPS_GET), []string{""}},
+		{"cloud update actuator", buildMessage(common.CloudName, common.DGTWINS_OPS_UPDATE, "switch01"), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := dtc.dispatch(test.msg)
+			if len(test.denied) < 1 {
+				msg := (<-dtc.context.CommChan[types.DGTWINS_MODULE_PROPERTY]).(*model.Message)
+				if err != nil || msg.GetID() != test.msg.GetID() {
+					t.Errorf("request is not dispatched (%v)", err)
+				}
+				return
+			}
+
+			resp := (<-dtc.context.CommChan[types.DGTWINS_MODULE_COMM]).(*model.Message)
+			twinResp, _ := common.UnMarshalResponseMessage(resp)
+			if err == nil || resp.GetTag() != test.msg.GetID() || twinResp == nil ||
+					twinResp.Code != common.ForbiddenCode || len(twinResp.TwinResults) != len(test.denied) {
+				t.Fatalf("request is not denied (%v %v)", err, twinResp)
+			}
+			for key, result := range twinResp.TwinResults {
+				if result.TwinID != test.denied[key] || result.Code != common.ForbiddenCode {
+					t.Errorf("unexpected twin result %v", result)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchQueued(t *testing.T) {
+	c := context.GetContext(context.MsgCtxTypeChannel)
+	dtc := NewDGTwinController("", c)
+	dtc.context.ACLPolicy = &types.ACLPolicy{Default: types.ACL_EFFECT_DENY}
+
+	// the queued notice of hub is passed to comm module without authorization.
+	queued := common.BuildModelMessage(common.HubModuleName, types.MODULE_NAME,
+					common.DGTWINS_OPS_QUEUED, common.DGTWINS_RESOURCE_PROPERTY, nil)
+	queued.SetTag("1001")
+	if err := dtc.dispatch(queued); err != nil {
+		t.Fatalf("dispatch queued notice failed (%v)", err)
+	}
+	msg := (<-dtc.context.CommChan[types.DGTWINS_MODULE_COMM]).(*model.Message)
+	if msg.GetID() != queued.GetID() {
+		t.Errorf("queued notice is not passed to comm module")
+	}
+
+	// other sources can't send it.
+	queued.Router.Source = common.CloudName
+	if err := dtc.dispatch(queued); err == nil {
+		t.Errorf("queued notice from cloud should be denied")
+	}
+}
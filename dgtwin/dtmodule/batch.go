@@ -0,0 +1,95 @@
+package dtmodule
+
+import (
+	"encoding/json"
+	"github.com/jwzl/edgeOn/common"
+)
+
+// batchResponse collect the result of each twin in a bulk request, then
+// the request is replied by a single response with a code and reason per
+// twin. the code of response is the code of all twins if they are same,
+// or MultiStatusCode.
+type batchResponse struct {
+	twins		[]common.DigitalTwin
+	results		[]common.PropertyResult
+	twinResults	[]common.TwinResult
+	// actions to do after the response is sent, e.g. notify the device.
+	deferred	[]func()
+}
+
+func newBatchResponse() *batchResponse {
+	return &batchResponse{
+		twins:			make([]common.DigitalTwin, 0),
+		results:		make([]common.PropertyResult, 0),
+		twinResults:	make([]common.TwinResult, 0),
+	}
+}
+
+// add add the result of the twin, twins and results are merged into response.
+func (br *batchResponse) add(twinID string, code int, reason string, twins []common.DigitalTwin, results []common.PropertyResult) {
+	br.twins = append(br.twins, twins...)
+	br.results = append(br.results, results...)
+	br.twinResults = append(br.twinResults, common.TwinResult{
+		TwinID:	twinID,
+		Code:	code,
+		Reason:	reason,
+	})
+}
+
+// deferAction do the action after the response is sent.
+func (br *batchResponse) deferAction(fn func()) {
+	br.deferred = append(br.deferred, fn)
+}
+
+// done do all deferred actions.
+func (br *batchResponse) done() {
+	for _, fn := range br.deferred {
+		fn()
+	}
+	br.deferred = nil
+}
+
+func (br *batchResponse) isEmpty() bool {
+	return len(br.twinResults) < 1
+}
+
+// status return the code and reason of the whole response.
+func (br *batchResponse) status() (int, string) {
+	if br.isEmpty() {
+		return common.BadRequestCode, "No twin in request"
+	}
+
+	code := br.twinResults[0].Code
+	reason := br.twinResults[0].Reason
+	for _, result := range br.twinResults[1:] {
+		if result.Code != code {
+			return common.MultiStatusCode, "See twin results"
+		}
+		if result.Reason != reason {
+			reason = "See twin results"
+		}
+	}
+
+	return code, reason
+}
+
+// build build the response content with the device models of twins.
+func (br *batchResponse) build(models []common.DeviceModel) ([]byte, error) {
+	code, reason := br.status()
+	resp := &common.TwinResponse{
+		Code:	code,
+		Reason:	reason,
+		Twins:	br.twins,
+		Results:	br.results,
+		TwinResults:	br.twinResults,
+		Models:	models,
+	}
+	if len(resp.Twins) < 1 {
+		resp.Twins = nil
+	}
+	if len(resp.Results) < 1 {
+		resp.Results = nil
+	}
+
+	return json.Marshal(resp)
+}
@@ -1,17 +1,28 @@
 package dtmodule
 
 import (
+	"fmt"
 	"time"
 	"strings"
 	"k8s.io/klog"
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/config"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
 )
 
 type CommandFunc  func(msg interface{}) error
 
+var (
+	messageRetriesTotal = metrics.NewCounter("edgeon_dgtwin_message_retries_total",
+						"Messages resent by comm module.", "target")
+	messageTimeoutsTotal = metrics.NewCounter("edgeon_dgtwin_message_timeouts_total",
+						"Messages failed after max attempts by comm module.", "target")
+)
+
 type CommModule struct {
 	name	string
 	context			*dtcontext.DTContext
@@ -21,6 +32,8 @@ type CommModule struct {
 	heartBeatChan	chan interface{}
 	confirmChan		chan interface{}
 	CommandTbl 	map[string]CommandFunc
+	// retry policy of each target, key is types.DGTWINS_RETRY_TARGET_*.
+	retryPolicies	map[string]*types.RetryPolicy
 }
 
 func NewCommModule() *CommModule {
@@ -37,6 +50,7 @@ func (cm *CommModule) InitModule(dtc *dtcontext.DTContext, comm, heartBeat, conf
 	cm.recieveChan = comm
 	cm.heartBeatChan = heartBeat
 	cm.confirmChan = confirm
+	cm.retryPolicies = config.GetDGTwinConfig().RetryPolicies
 	//cm.initDeviceCommandTable()
 }
 
@@ -44,7 +58,7 @@ func (cm *CommModule) InitModule(dtc *dtcontext.DTContext, comm, heartBeat, conf
 //TODO: Device should has a healthcheck.
 func (cm *CommModule) Start(){
 	//Start loop.
-	checkTimeoutCh := time.After(2*time.Second)
+	checkTimeoutCh := time.After(types.DGTWINS_RETRY_CHECK_INTERVAL)
 	for {
 		select {
 		case msg, ok := <-cm.recieveChan:
@@ -53,30 +67,12 @@ func (cm *CommModule) Start(){
 				return
 			}
 			
-			message, isMsgType := msg.(*model.Message )
-			if isMsgType {
-		 		// do handle.
-				target := message.GetTarget()
-				if strings.Contains(target, common.DeviceName) {
-					//send to device.
-					klog.Infof("send to device")	
-					cm.sendMessageToDevice(message) 	
-				}else if strings.Contains(target, common.CloudName) {
-					//send to message cloud.
-					klog.Infof("send to cloud")
-					cm.sendMessageToHub(message)	
-				}else if strings.Contains(target, "edge") {
-					if strings.Contains(target, types.MODULE_NAME) {
-						//this is response or internal communication.
-						cm.dealMessageToTwin(message)
-					}else {
-						//this is edge/app
-						klog.Infof("send to edge/app")
-						cm.sendMessageToHub(message)
-					}
-				}else{
-					klog.Warningf("error message format, Ignore (%v)", message)
-				}				
+			switch message := msg.(type) {
+			case *model.Message:
+				cm.dispatch(message, nil)
+			case *types.CachedMessage:
+				// message with its requester.
+				cm.dispatch(message.Msg, message.Requester)
 			}
 		case v, ok := <-cm.heartBeatChan:
 			if !ok {
@@ -91,40 +87,85 @@ func (cm *CommModule) Start(){
 		case <-checkTimeoutCh:
 			//check  the MessageCache for response.
 			cm.dealMessageTimeout()	
-			checkTimeoutCh = time.After(2*time.Second)
+			checkTimeoutCh = time.After(types.DGTWINS_RETRY_CHECK_INTERVAL)
 		}
 	}
 }
 
-// sendMessageToDevice
-func (cm *CommModule) sendMessageToDevice(msg *model.Message) {
-	operation := msg.GetOperation()
-
-	if strings.Compare(common.DGTWINS_OPS_RESPONSE, operation) != 0 {
-		//cache this message for confirm recieve the response.
-		id := msg.GetID() 
-		_, exist := cm.context.MessageCache.Load(id)
-		if !exist {	
-			cm.context.MessageCache.Store(id, msg)
+// dispatch send the message by its target, the message which is not response
+// is cached until the response is recieved or it's failed.
+func (cm *CommModule) dispatch(message *model.Message, requester *model.Message) {
+	start := time.Now()
+	outcome := trace.SPAN_OUTCOME_OK
+	defer func() {
+		trace.Record(cm.Name(), message, start, outcome)
+	}()
+
+	target := message.GetTarget()
+	if strings.Contains(target, common.DeviceName) {
+		//send to device.
+		klog.Infof("send to device")	
+		cm.cacheMessage(message, requester, types.DGTWINS_RETRY_TARGET_DEVICE)
+		cm.sendMessageToDevice(message) 	
+	}else if strings.Contains(target, common.CloudName) {
+		//send to message cloud.
+		klog.Infof("send to cloud")
+		cm.cacheMessage(message, requester, types.DGTWINS_RETRY_TARGET_CLOUD)
+		cm.sendMessageToHub(message)	
+	}else if strings.Contains(target, "edge") {
+		if strings.Contains(target, types.MODULE_NAME) {
+			//this is response or internal communication.
+			cm.dealMessageToTwin(message)
+		}else {
+			//this is edge/app
+			klog.Infof("send to edge/app")
+			cm.cacheMessage(message, requester, types.DGTWINS_RETRY_TARGET_APP)
+			cm.sendMessageToHub(message)
 		}
+	}else{
+		klog.Warningf("error message format, Ignore (%v)", message)
+		outcome = trace.SPAN_OUTCOME_DROPPED
+	}
+}
+
+// cacheMessage cache this message for confirm recieve the response.
+func (cm *CommModule) cacheMessage(msg *model.Message, requester *model.Message, target string) {
+	if strings.Compare(common.DGTWINS_OPS_RESPONSE, msg.GetOperation()) == 0 {
+		return
 	}
+	// the pings are tracked by the liveness policy of twin module.
+	if requester == nil && strings.Compare(common.DGTWINS_OPS_DETECT, msg.GetOperation()) == 0 {
+		return
+	}
+
+	id := msg.GetID() 
+	if _, exist := cm.context.MessageCache.Load(id); exist {
+		return
+	}
+
+	policy := cm.retryPolicies[target]
+	if policy == nil {
+		policy = &types.RetryPolicy{MaxAttempts: 1, InitialBackoff: types.DGTWINS_MSG_TIMEOUT*time.Second,
+								MaxBackoff: types.DGTWINS_MSG_TIMEOUT*time.Second}
+	}
+	cm.context.MessageCache.Store(id, &types.CachedMessage{
+		Msg:		msg,
+		Requester:	requester,
+		Attempts:	1,
+		NextRetry:	time.Now().Add(policy.Backoff(1)),
+		Policy:		policy,
+		RetryTarget:	target,
+	})
+}
 
+// sendMessageToDevice
+func (cm *CommModule) sendMessageToDevice(msg *model.Message) {
 	//send message to protocol bus.
 	cm.context.Send(common.BusModuleName, msg)
 }
 
 //sendMessageToHub
 func (cm *CommModule) sendMessageToHub(msg *model.Message) {
-	operation := msg.GetOperation()
-
-	if strings.Compare(common.DGTWINS_OPS_RESPONSE, operation) != 0 {
-		//cache this message for confirm recieve the response.
-		id := msg.GetID() 
-		_, exist := cm.context.MessageCache.Load(id)
-		if !exist {
-			cm.context.MessageCache.Store(id, msg)
-		}
-	}
 	//send message to message hub.
 	cm.context.Send(common.HubModuleName, msg)
 }
@@ -147,69 +188,69 @@ func (cm *CommModule) dealMessageToTwin(msg *model.Message) {
 }
 
 //dealMessageTimeout
+// resend the cached message when its backoff is expired, and the message
+// is failed when it has been sent MaxAttempts times.
 func (cm *CommModule) dealMessageTimeout() {
+	now := time.Now()
+
 	cm.context.MessageCache.Range(func (key interface{}, value interface{}) bool {
-		msg, isMsgType := value.(*model.Message)
-		if isMsgType {
-			target := msg.GetTarget()
-			operation := msg.GetOperation()
-
-			timeStamp := msg.GetTimestamp()/1e3
-			now	:= time.Now().UnixNano() / 1e9
-			if now - timeStamp >= types.DGTWINS_MSG_TIMEOUT {
-				if strings.Contains(target, common.DeviceName) {
-					if strings.Compare(common.DGTWINS_OPS_RESPONSE, operation) != 0 {
-						//mark device status is offline.
-						//send package and tell twin module, device is offline.
-						twinID := common.GetTwinID(msg)
-						dgtwin := &common.DeviceTwin{
-							ID: twinID,
-							State:	common.DGTWINS_STATE_OFFLINE,
-						}
-		
-						msgContent, err := common.BuildDeviceMessage(dgtwin)
-						if err == nil {
-							modelMsg := common.BuildModelMessage(types.MODULE_NAME, types.MODULE_NAME, common.DGTWINS_OPS_UPDATE, 
-																	common.DGTWINS_RESOURCE_TWINS, msgContent)
-							cm.context.SendToModule(types.DGTWINS_MODULE_TWINS, modelMsg)
-						}
-					}	
-				}
-				cm.context.MessageCache.Delete(key)
-				return true
-			}else{
-				if strings.Contains(target, common.DeviceName) && 
-						strings.Compare(common.DGTWINS_OPS_DETECT, operation) == 0 {
-					// this is a ping message to device, then, we delete this mark
-					// and make this state as offline.
-					twinID := common.GetTwinID(msg)
-					twinState := cm.context.GetTwinState(twinID)
-					if twinState != common.DGTWINS_STATE_CREATED &&
-					   		twinState != common.DGTWINS_STATE_OFFLINE {
-
-						dgtwin := &common.DeviceTwin{
-							ID: twinID,
-							State:	common.DGTWINS_STATE_OFFLINE,
-						}
-		
-						msgContent, err := common.BuildDeviceMessage(dgtwin)
-						if err == nil {
-							modelMsg := common.BuildModelMessage(types.MODULE_NAME, types.MODULE_NAME, common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_TWINS, msgContent)
-							cm.context.SendToModule(types.DGTWINS_MODULE_TWINS, modelMsg)
-						}
-						
-						klog.Infof("### Detect Device(%s) is offline", twinID)
-					}
-					cm.context.MessageCache.Delete(key)
-				}else {
-					//resend this message.
-					klog.Infof("### Resend this message...")
-					cm.context.SendToModule(types.DGTWINS_MODULE_COMM, msg)
-				}
-				return true
+		cached, isCachedType := value.(*types.CachedMessage)
+		if !isCachedType {
+			cm.context.MessageCache.Delete(key)
+			return true
+		}
+		if now.Before(cached.NextRetry) {
+			return true
+		}
+
+		msg := cached.Msg
+		target := msg.GetTarget()
+		if cached.Attempts >= cached.Policy.MaxAttempts {
+			klog.Warningf("### Message (%s) to %s is failed after %d attempts", msg.GetID(), target, cached.Attempts)
+			messageTimeoutsTotal.Inc(cached.RetryTarget)
+			trace.Record(cm.Name(), msg, now, trace.SPAN_OUTCOME_TIMEOUT)
+			cm.context.MessageCache.Delete(key)
+			if strings.Contains(target, common.DeviceName) {
+				// the liveness policy decides whether the device is offline.
+				cm.context.MarkMissed(common.GetTwinID(msg))
 			}
+			cm.sendDeliveryFailed(cached)
+			return true
 		}
 
-		return false
+		//resend this message.
+		klog.Infof("### Resend this message (%s), attempts %d", msg.GetID(), cached.Attempts+1)
+		messageRetriesTotal.Inc(cached.RetryTarget)
+		trace.Record(cm.Name(), msg, now, trace.SPAN_OUTCOME_RETRY)
+		cached.Attempts++
+		cached.NextRetry = now.Add(cached.Policy.Backoff(cached.Attempts))
+		if strings.Contains(target, common.DeviceName) {
+			cm.sendMessageToDevice(msg)
+		}else {
+			cm.sendMessageToHub(msg)
+		}
+
+		return true
 	})
 }
+
+// sendDeliveryFailed tell the requester the message can't be delivered,
+// the response is tagged with the request ID. it runs in comm module, so the
+// response is dispatched directly, sending it to the channel of comm module
+// blocks when the channel is full.
+func (cm *CommModule) sendDeliveryFailed(cached *types.CachedMessage) {
+	requester := cached.Requester
+	if requester == nil || requester.GetSource() == types.MODULE_NAME {
+		return
+	}
+
+	twinID := common.GetTwinID(cached.Msg)
+	twins := []common.DigitalTwin{common.DigitalTwin{ID: twinID}}
+	reason := fmt.Sprintf("Delivery to %s failed after %d attempts", cached.Msg.GetTarget(), cached.Attempts)
+	msgContent, err := common.BuildResponseMessage(common.DeliveryFailedCode, reason, twins)
+	if err != nil {
+		return
+	}
+
+	cm.dispatch(cm.context.BuildResponseModelMessage(requester, msgContent), nil)
+}
@@ -3,6 +3,7 @@ package dtmodule
 import (
 	"time"
 	"testing"
+	"github.com/jwzl/edgeOn/common"
 	"github.com/jwzl/beehive/pkg/core/context"
 	"github.com/jwzl/edgeOn/dgtwin/types"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
@@ -25,7 +26,7 @@ func TestStart(t *testing.T) {
 	commModule.InitModule(dtcontext, comm, heartBeat, nil) 
 
 	modelMsg := dtcontext.BuildModelMessage(types.MODULE_NAME, "device", 
-					types.DGTWINS_OPS_GET, types.DGTWINS_RESOURCE_DEVICE, "helloworld") 
+					common.DGTWINS_OPS_GET, common.DGTWINS_RESOURCE_DEVICE, "helloworld") 
 	modelMsg.Header.ID ="message"
 
 	//send message
@@ -45,3 +46,135 @@ func TestStart(t *testing.T) {
 	t.Log("recieve message")
 	heartBeat <- "stop"
 }
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &types.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second,
+					MaxBackoff: 5*time.Second, Multiplier: 2}
+
+	expected := []time.Duration{time.Second, 2*time.Second, 4*time.Second, 5*time.Second, 5*time.Second}
+	for i, backoff := range expected {
+		if policy.Backoff(i+1) != backoff {
+			t.Errorf("backoff of attempts %d is %v, expected %v", i+1, policy.Backoff(i+1), backoff)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		if backoff < time.Second || backoff > 3*time.Second {
+			t.Fatalf("backoff %v is out of jitter range", backoff)
+		}
+	}
+}
+
+// TestDeliveryFailed test the message is resent until max attempts, then the
+// requester is notified.
+func TestDeliveryFailed(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	commModule := NewCommModule()
+	comm := make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = comm
+	dtcontext.CommChan[types.DGTWINS_MODULE_TWINS] = make(chan interface{}, 128)
+
+	commModule.InitModule(dtcontext, comm, make(chan interface{}, 128), nil)
+	commModule.retryPolicies[types.DGTWINS_RETRY_TARGET_DEVICE] = &types.RetryPolicy{
+		MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 2}
+
+	requester := dtcontext.BuildModelMessage("cloud", types.MODULE_NAME, 
+					common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_PROPERTY, []byte("{}")) 
+	dtcontext.DGTwinList.Store("dev001", &common.DigitalTwin{ID: "dev001", State: common.DGTWINS_STATE_ONLINE,
+		Liveness: &common.LivenessPolicy{Interval: 10, MissTolerance: 1}})
+	devTwin := &common.DeviceTwin{ID: "dev001"}
+	dtcontext.SendRequestMessage2Device(requester, common.DGTWINS_OPS_UPDATE, devTwin)
+	commModule.dispatch(GetModelMessage(<-comm), requester)
+
+	for i := 1; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		commModule.dealMessageTimeout()
+	}
+	count := 0
+	dtcontext.MessageCache.Range(func(key, value interface{}) bool {
+		count++
+		if value.(*types.CachedMessage).Attempts != 3 {
+			t.Errorf("message should be sent 3 times")
+		}
+		return true
+	})
+	if count != 1 {
+		t.Fatalf("message should be cached until it's failed")
+	}
+
+	ctx.AddModule(common.HubModuleName)
+	time.Sleep(2 * time.Millisecond)
+	commModule.dealMessageTimeout()
+	if len(comm) != 0 {
+		t.Fatal("delivery failed message should not be sent to comm module")
+	}
+	v, _ := ctx.Receive(common.HubModuleName)
+	resp := GetDTResponse(v)
+	message := GetModelMessage(v)
+	if resp == nil || resp.Code != common.DeliveryFailedCode || message.GetTag() != requester.GetID() {
+		t.Fatalf("unexpected delivery failed message (%v)", v)
+	}
+	// the failure is a miss of liveness, the device is offline by its policy.
+	if len(dtcontext.CommChan[types.DGTWINS_MODULE_TWINS]) != 0 {
+		t.Fatal("device should not be marked offline by comm module")
+	}
+	if _, offline := dtcontext.CheckLiveness("dev001", time.Now()); !offline {
+		t.Fatal("device should be offline after the missed message")
+	}
+}
+
+// TestDeliveryFailedBulk test the comm module is not blocked when more
+// messages than its channel can hold are failed at once.
+func TestDeliveryFailedBulk(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	ctx.AddModule(common.HubModuleName)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	commModule := NewCommModule()
+	comm := make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = comm
+
+	commModule.InitModule(dtcontext, comm, make(chan interface{}, 128), nil)
+	commModule.retryPolicies[types.DGTWINS_RETRY_TARGET_DEVICE] = &types.RetryPolicy{
+		MaxAttempts: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	count := 2 * cap(comm)
+	for i := 0; i < count; i++ {
+		requester := dtcontext.BuildModelMessage("cloud", types.MODULE_NAME, 
+						common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_PROPERTY, []byte("{}")) 
+		deviceMsg := dtcontext.BuildModelMessage(types.MODULE_NAME, "device@dev001",
+						common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_DEVICE, []byte("{}"))
+		commModule.cacheMessage(deviceMsg, requester, types.DGTWINS_RETRY_TARGET_DEVICE)
+	}
+
+	received := make(chan int)
+	go func() {
+		failed := 0
+		for failed < count {
+			v, _ := ctx.Receive(common.HubModuleName)
+			if resp := GetDTResponse(v); resp != nil && resp.Code == common.DeliveryFailedCode {
+				failed++
+			}
+		}
+		received <- failed
+	}()
+
+	time.Sleep(2 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		commModule.dealMessageTimeout()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("comm module is blocked by the delivery failed messages")
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requesters are not notified")
+	}
+}
@@ -1,6 +1,8 @@
 package dtmodule
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 	"strconv"
@@ -8,7 +10,9 @@ import (
 	"strings"
 	"k8s.io/klog"
 	"encoding/json"
+	"encoding/base64"
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/edgeOn/dgtwin/types"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
@@ -40,6 +44,8 @@ func (dm *TwinModule) initDeviceCommandTable() {
 	dm.deviceCommandTbl[common.DGTWINS_OPS_UPDATE] = dm.deviceUpdateHandle
 	dm.deviceCommandTbl[common.DGTWINS_OPS_DELETE] = dm.deviceDeleteHandle	
 	dm.deviceCommandTbl[common.DGTWINS_OPS_GET] = dm.deviceGetHandle	
+	dm.deviceCommandTbl[common.DGTWINS_OPS_List] = dm.twinsListHandle	
+	dm.deviceCommandTbl[common.DGTWINS_OPS_AUDIT] = dm.twinsAuditHandle
 	dm.deviceCommandTbl[common.DGTWINS_OPS_RESPONSE] = dm.deviceResponseHandle	
 }
 
@@ -58,7 +64,7 @@ func (dm *TwinModule) InitModule(dtc *dtcontext.DTContext, comm, heartBeat, conf
 
 //Start Device module
 func (dm *TwinModule) Start(){
-	KeepaliveCh := time.After(5 *time.Second)
+	KeepaliveCh := time.After(types.DGTWINS_LIVENESS_CHECK_INTERVAL)
 	//Start loop.
 	for {
 		select {
@@ -73,14 +79,19 @@ func (dm *TwinModule) Start(){
 				klog.Infof("twin message arrived {Header:%v Router:%v-}", 
 												message.Header, message.Router)
 		 		// do handle.
+				start := time.Now()
+				outcome := trace.SPAN_OUTCOME_OK
 				if fn, exist := dm.deviceCommandTbl[message.GetOperation()]; exist {
 					_, err := fn(message)
 					if err != nil {
 						klog.Errorf("Handle %s failed, ignored", message.GetOperation())
+						outcome = trace.SPAN_OUTCOME_ERROR
 					}
 				}else {
 					klog.Errorf("No this handle for %s, ignored", message.GetOperation())
+					outcome = trace.SPAN_OUTCOME_DROPPED
 				}
+				trace.Record(dm.Name(), message, start, outcome)
 			}
 		case v, ok := <-dm.heartBeatChan:
 			if !ok {
@@ -94,9 +105,8 @@ func (dm *TwinModule) Start(){
 			}
 		case <-KeepaliveCh:
 			//Check & sync device's state.
-			klog.Infof("#######  ping device  #############")
 			dm.PingDevice()	
-			KeepaliveCh = time.After(5 *time.Second)
+			KeepaliveCh = time.After(types.DGTWINS_LIVENESS_CHECK_INTERVAL)
 		}
 	}
 }
@@ -124,25 +134,62 @@ func (dm *TwinModule) twinsCreateHandle(msg *model.Message) (interface{}, error)
 	}
 	
 	//get all requested twins
+	resp := newBatchResponse()
 	for key, _ := range twinMsg.Twins	{
 		twin := &twinMsg.Twins[key]
+		twins := []common.DigitalTwin{*twin}
 		//for each dgtwin
 		twinID := twin.ID
+		if twinID == "" {
+			resp.add(twinID, common.BadRequestCode, "Twin ID is empty", twins, nil)
+			continue
+		}
+		//check the referenced device model.
+		if twin.Model != "" && dm.context.GetModel(twin.Model) == nil {
+			reason := fmt.Sprintf("Model (%s) not found", twin.Model)
+			resp.add(twinID, common.BadRequestCode, reason, twins, nil)
+			continue
+		}
+		if twin.Liveness != nil {
+			if err := twin.Liveness.Check(); err != nil {
+				reason := fmt.Sprintf("Invalid liveness policy (%v)", err)
+				resp.add(twinID, common.BadRequestCode, reason, twins, nil)
+				continue
+			}
+		}
+
 		exist := dm.context.DGTwinIsExist(twinID)
 		if !exist {
 			dgTwin := &common.DigitalTwin{
 				ID:	twinID,
 				State: common.DGTWINS_STATE_CREATED,
+				Model: twin.Model,
+				Liveness: twin.Liveness,
+				Version: 1,
+			}
+			// all properties declared in model can be reported by device.
+			if devModel := dm.context.GetModel(twin.Model); devModel != nil {
+				dgTwin.Properties.Reported = make(map[string]*common.TwinProperty)
+				for _, schema := range devModel.Properties {
+					dgTwin.Properties.Reported[schema.Name] = &common.TwinProperty{
+						Name:	schema.Name,
+						Type:	schema.Type,
+					}
+				}
 			}
 			
 			//Create DGTwin is always success since it just create data startuctre
-			// in memory  and database.
-			//Infutre, we will store DGTwin into sqlite database. 
+			// in memory  and store.
 			dm.context.DGTwinList.Store(twinID, dgTwin)
 			var deviceMutex	sync.Mutex
 			dm.context.DGTwinMutex.Store(twinID, &deviceMutex)
-			//save to sqlite, implement in future.
-			//TODO:	
+			//save to store.
+			if err := dm.context.SaveTwin(dgTwin); err != nil {
+				klog.Errorf("Save twin (%s) failed (%v)", twinID, err)
+			}
+			twinJSON, _ := json.Marshal(dgTwin)
+			dm.context.RecordAudit(msg, twinID, "", "", nil, twinJSON)
+			dm.context.SendLifecycleEvent(twinID, common.LIFECYCLE_EVENT_CREATED, "created by "+msgSource)
 
 			//detect the physical device	
 			// send broadcast to all device, and wait (own this ID) device's response,
@@ -151,18 +198,20 @@ func (dm *TwinModule) twinsCreateHandle(msg *model.Message) (interface{}, error)
 				ID: twinID,
 				State:	common.DGTWINS_STATE_CREATED,
 			}
-			dm.context.SendMessage2Device(common.DGTWINS_OPS_DETECT, deviceTwin)
+			dm.context.SendRequestMessage2Device(msg, common.DGTWINS_OPS_DETECT, deviceTwin)
+			resp.add(twinID, common.RequestSuccessCode, "Success", twins, nil)
+		}else {
+			resp.add(twinID, common.RequestSuccessCode, "Already exists", twins, nil)
 		}
 	}
 	
 	//Send response.
-	msgContent, err := common.BuildResponseMessage(common.RequestSuccessCode, "Success", twinMsg.Twins)
+	msgContent, err := resp.build(nil)
 	if err != nil {
 		//Internal err			
 		return nil,  err
-	}else{
-		dm.context.SendResponseMessage(msg, msgContent)
 	}
+	dm.context.SendResponseMessage(msg, msgContent)
 
 	return nil, nil	
 }
@@ -193,21 +242,39 @@ func (dm *TwinModule) deviceUpdateHandle(msg *model.Message ) (interface{}, erro
 	twinID := devMsg.Twin.ID
 	exist := dm.context.DGTwinIsExist(twinID)
 	if exist {
+		if strings.Contains(msgSource, common.DGTWINS_RESOURCE_DEVICE) {
+			dm.context.MarkAlive(twinID, true)
+		}
+
 		//Update Twin
 		dm.context.Lock(twinID)
 		v, _ := dm.context.DGTwinList.Load(twinID)
 		oldTwin, _ :=v.(*common.DigitalTwin)
+		lastState := oldTwin.State
 
 		//deal device update
-		err = dm.dealTwinUpdate(oldTwin, &devMsg.Twin)
+		var twins []common.DigitalTwin
+		err = dm.dealTwinUpdate(msg, oldTwin, &devMsg.Twin)
+		if err == nil {
+			if saveErr := dm.context.SaveTwin(oldTwin); saveErr != nil {
+				klog.Errorf("Save twin (%s) failed (%v)", twinID, saveErr)
+			}
+			// the twin is changed by other modules after unlock, so
+			// copy it for the sync message here.
+			twins = []common.DigitalTwin{twinCopy(oldTwin)}
+		}
 		dm.context.Unlock(twinID)
 
 		if err == nil {
-			klog.Infof("######### (%s) is %s  ##########", twinID, oldTwin.State)
+			state := twins[0].State
+			klog.Infof("######### (%s) is %s  ##########", twinID, state)
 			klog.Infof("######### Device information update successful  ##########")
 
+			if lastState != state {
+				dm.stateChanged(twinID, lastState, state, msgSource, devMsg.Reason)
+			}
+
 			//notify others about device is online
-			twins := []common.DigitalTwin{*oldTwin}
 	 		msgContent, err := common.BuildTwinMessage(twins)
 			if err != nil {
 				return nil, err
@@ -224,9 +291,29 @@ func (dm *TwinModule) deviceUpdateHandle(msg *model.Message ) (interface{}, erro
 	return nil, nil
 }
 
+// stateChanged emit the lifecycle events of the device state change.
+func (dm *TwinModule) stateChanged(twinID, lastState, state, msgSource, reason string) {
+	if reason == "" && strings.Contains(msgSource, common.DGTWINS_RESOURCE_DEVICE) {
+		reason = common.LIFECYCLE_REASON_REPORTED
+	}
+
+	switch state {
+	case common.DGTWINS_STATE_ONLINE:
+		if lastState == common.DGTWINS_STATE_CREATED {
+			dm.context.SendLifecycleEvent(twinID, common.LIFECYCLE_EVENT_FIRSTSEEN, reason)
+		}
+		dm.context.SendLifecycleEvent(twinID, common.LIFECYCLE_EVENT_ONLINE, reason)
+		// device is online, reconcile the desired properties.
+		dm.context.SendToModule(types.DGTWINS_MODULE_RECONCILE, twinID)
+	case common.DGTWINS_STATE_OFFLINE:
+		dm.context.SendLifecycleEvent(twinID, common.LIFECYCLE_EVENT_OFFLINE, reason)
+	}
+}
+
 //deal twin update.
-//this is a patch for the old device state.
-func (dm *TwinModule) dealTwinUpdate(oldTwin *common.DigitalTwin, newTwin *common.DeviceTwin) error {
+//this is a patch for the old device state, the changed properties are
+//audited as the mutation by msg.
+func (dm *TwinModule) dealTwinUpdate(msg *model.Message, oldTwin *common.DigitalTwin, newTwin *common.DeviceTwin) error {
 	if oldTwin == nil || newTwin == nil {
 		return errors.New("error oldTwin or newTwin")
 	}
@@ -245,14 +332,17 @@ func (dm *TwinModule) dealTwinUpdate(oldTwin *common.DigitalTwin, newTwin *commo
 		oldTwin.LastState = oldTwin.State 
 		oldTwin.State = newTwin.State		
 	}
+	oldTwin.Version++
+	devModel := dm.context.GetModel(oldTwin.Model)
 
 	//patch all metadata to oldTwin.
 	if oldTwin.MetaData == nil {
 		oldTwin.MetaData = make(map[string]*common.MetaType)
 	} 
 	if len(newTwin.MetaData) > 0 {
-		for _ , meta := range newTwin.MetaData {
-			oldTwin.MetaData[meta.Name] = &meta
+		for key , _ := range newTwin.MetaData {
+			meta := &newTwin.MetaData[key]
+			oldTwin.MetaData[meta.Name] = meta
 		}
 	}
 
@@ -262,8 +352,19 @@ func (dm *TwinModule) dealTwinUpdate(oldTwin *common.DigitalTwin, newTwin *commo
 			oldTwin.Properties.Desired = make(map[string]*common.TwinProperty)
 		}
 
-		for _ , prop := range newTwin.Properties.Desired {
-			oldTwin.Properties.Desired[prop.Name] = &prop
+		for key , _ := range newTwin.Properties.Desired {
+			prop := &newTwin.Properties.Desired[key]
+			if err := checkProperty(devModel, common.TWIN_PROP_KIND_DESIRED, oldTwin.Properties.Desired, prop); err != nil {
+				klog.Warningf("Drop desired property (%s/%s): %v", oldTwin.ID, prop.Name, err)
+				continue
+			}
+			prop.Type = propertyType(devModel, oldTwin.Properties.Desired, prop)
+			prop.Version = nextPropertyVersion(oldTwin.Properties.Desired, prop.Name)
+			prop.Status = ""
+			dm.context.RecordPropertyAudit(msg, oldTwin.ID, common.TWIN_PROP_KIND_DESIRED, prop.Name,
+										oldTwin.Properties.Desired[prop.Name], prop)
+			oldTwin.Properties.Desired[prop.Name] = prop
+			refreshDesiredStatus(oldTwin, prop.Name)
 		}
 	}	
 
@@ -273,8 +374,19 @@ func (dm *TwinModule) dealTwinUpdate(oldTwin *common.DigitalTwin, newTwin *commo
 			oldTwin.Properties.Reported = make(map[string]*common.TwinProperty)
 		}
 
-		for _ , prop := range newTwin.Properties.Reported {
-			oldTwin.Properties.Desired[prop.Name] = &prop
+		for key , _ := range newTwin.Properties.Reported {
+			prop := &newTwin.Properties.Reported[key]
+			if err := checkProperty(devModel, common.TWIN_PROP_KIND_REPORTED, oldTwin.Properties.Reported, prop); err != nil {
+				klog.Warningf("Drop reported property (%s/%s): %v", oldTwin.ID, prop.Name, err)
+				continue
+			}
+			prop.Type = propertyType(devModel, oldTwin.Properties.Reported, prop)
+			prop.Version = nextPropertyVersion(oldTwin.Properties.Reported, prop.Name)
+			dm.context.RecordPropertyAudit(msg, oldTwin.ID, common.TWIN_PROP_KIND_REPORTED, prop.Name,
+										oldTwin.Properties.Reported[prop.Name], prop)
+			oldTwin.Properties.Reported[prop.Name] = prop
+			dm.context.RecordHistory(oldTwin.ID, prop)
+			refreshDesiredStatus(oldTwin, prop.Name)
 		}
 	}	
 
@@ -303,48 +415,187 @@ func (dm *TwinModule) deviceDeleteHandle(msg *model.Message) (interface{}, error
 		return nil, err
 	}
 
-	if len(twinMsg.Twins) > 0 {
-		var msgContent  []byte
-		//get the first twin since we just support delete a twin.
-		dgTwin := &twinMsg.Twins[0]
-
+	//delete all requested twins.
+	resp := newBatchResponse()
+	for key, _ := range twinMsg.Twins {
+		dgTwin := &twinMsg.Twins[key]
 		twinID := dgTwin.ID
+		twins := []common.DigitalTwin{*dgTwin}
+
 		exist := dm.context.DGTwinIsExist(twinID)
 		if !exist {
-			msgContent, err = common.BuildResponseMessage(common.NotFoundCode, "Not found", twinMsg.Twins)
-			if err != nil {
-				//Internal err.
-				return nil, err
-			}
-		} else {
-			//delete the device & mutex.
-			dm.context.Lock(twinID)
-			dm.context.DGTwinList.Delete(twinID)
+			resp.add(twinID, common.NotFoundCode, "Not found", twins, nil)
+			continue
+		}
+
+		dm.context.Lock(twinID)
+		v, _ := dm.context.DGTwinList.Load(twinID)
+		savedTwin, _ := v.(*common.DigitalTwin)
+		if dgTwin.Version != 0 && savedTwin != nil && dgTwin.Version != savedTwin.Version {
+			// the expected version is stale.
+			twins = []common.DigitalTwin{twinSummary(savedTwin)}
 			dm.context.Unlock(twinID)
-			dm.context.DGTwinMutex.Delete(twinID)
+			resp.add(twinID, common.ConflictCode, "Version conflict", twins, nil)
+			continue
+		}
 
-			msgContent, err = common.BuildResponseMessage(common.RequestSuccessCode, "Deleted", twinMsg.Twins)
+		//delete the device & mutex.
+		twinJSON, _ := json.Marshal(savedTwin)
+		dm.context.DGTwinList.Delete(twinID)
+		if err := dm.context.DeleteSavedTwin(twinID); err != nil {
+			klog.Errorf("Delete saved twin (%s) failed (%v)", twinID, err)
+		}
+		dm.context.RecordAudit(msg, twinID, "", "", twinJSON, nil)
+		dm.context.Unlock(twinID)
+		dm.context.DGTwinMutex.Delete(twinID)
+		dm.context.DeleteTwinWatch(twinID)
+		dm.context.DeleteHistory(twinID)
+		dm.context.DeleteLiveness(twinID)
+		dm.context.SendLifecycleEvent(twinID, common.LIFECYCLE_EVENT_DELETED, "deleted by "+msgSource)
+		resp.add(twinID, common.RequestSuccessCode, "Deleted", twins, nil)
+
+		//notify the device delete link with dgtwin.
+		devTwin := &common.DeviceTwin{ID: twinID}
+		dm.context.SendRequestMessage2Device(msg, common.DGTWINS_OPS_DELETE, devTwin)
+	}
+
+	msgContent, err := resp.build(nil)
+	if err != nil {
+		//Internal err.
+		return nil, err
+	}
+	dm.context.SendResponseMessage(msg, msgContent)
+
+	return nil, nil
+}
+
+// twinsAuditHandle: query the audit records of twin mutations.
+// the twin may be deleted, so it's not required to exist.
+func (dm *TwinModule) twinsAuditHandle(msg *model.Message) (interface{}, error) {
+	auditMsg, err := common.UnMarshalTwinAuditMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if auditMsg.End > 0 && auditMsg.Start > auditMsg.End {
+		msgContent, err := common.BuildResponseMessage(common.BadRequestCode, "Invalid time range", nil)
+		if err != nil {
+			return nil, err
+		}
+		dm.context.SendResponseMessage(msg, msgContent)
+		return nil, nil
+	}
+
+	pageSize := auditMsg.PageSize
+	if pageSize <= 0 {
+		pageSize = types.DGTWINS_AUDIT_PAGE_SIZE
+	}else if pageSize > types.DGTWINS_AUDIT_MAX_PAGE_SIZE {
+		pageSize = types.DGTWINS_AUDIT_MAX_PAGE_SIZE
+	}
+
+	start, offset := auditMsg.Start, 0
+	if auditMsg.Continue != "" {
+		var ok bool
+		start, offset, ok = decodeAuditContinue(auditMsg.Continue)
+		if !ok || start < auditMsg.Start {
+			msgContent, err := common.BuildResponseMessage(common.BadRequestCode, "Invalid continue token", nil)
 			if err != nil {
-				//Internal err.
 				return nil, err
 			}
+			dm.context.SendResponseMessage(msg, msgContent)
+			return nil, nil
 		}
+	}
 
-		//notify the device delete link with dgtwin.
-		devTwin := &common.DeviceTwin{ID: twinID}
-		dm.context.SendMessage2Device(common.DGTWINS_OPS_DELETE, devTwin)
+	// one more record tells whether there is next page.
+	records, err := dm.context.QueryAudit(auditMsg.TwinID, start, auditMsg.End, offset, pageSize+1)
+	if err != nil {
+		klog.Errorf("Query audit of twin (%s) failed (%v)", auditMsg.TwinID, err)
+		msgContent, err := common.BuildResponseMessage(common.InternalErrorCode, "Query audit failed", nil)
+		if err != nil {
+			return nil, err
+		}
 		dm.context.SendResponseMessage(msg, msgContent)
+		return nil, nil
+	}
+
+	cont := ""
+	if len(records) > pageSize {
+		records = records[:pageSize]
+		cont = encodeAuditContinue(records, start, offset)
+	}
+	records = dm.authorizedAudit(msg, records)
+
+	msgContent, err := common.BuildAuditResponseMessage(common.RequestSuccessCode, "Audit", records, cont)
+	if err != nil {
+		return nil, err
 	}
+	dm.context.SendResponseMessage(msg, msgContent)
 
 	return nil, nil
 }
 
+// authorizedAudit drop the records of twins which the requester is denied.
+func (dm *TwinModule) authorizedAudit(msg *model.Message, records []common.AuditRecord) []common.AuditRecord {
+	allowed := make(map[string]bool)
+	authorized := make([]common.AuditRecord, 0, len(records))
+	for _, record := range records {
+		isAllowed, exist := allowed[record.TwinID]
+		if !exist {
+			isAllowed = dm.context.AuthorizeTwin(msg, record.TwinID)
+			allowed[record.TwinID] = isAllowed
+		}
+		if isAllowed {
+			authorized = append(authorized, record)
+		}
+	}
+
+	return authorized
+}
+
+// encodeAuditContinue return the continue token after the page of records,
+// which are queried from start and offset. the records are in time order, so
+// the next page starts at the timestamp of last record, and skips the records
+// at that timestamp which are returned.
+func encodeAuditContinue(records []common.AuditRecord, start int64, offset int) string {
+	last := records[len(records)-1].Timestamp
+	skip := 0
+	for key := len(records) - 1; key >= 0 && records[key].Timestamp == last; key-- {
+		skip++
+	}
+	if skip == len(records) && last == start {
+		skip += offset
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%d", last, skip)))
+}
+
+func decodeAuditContinue(cont string) (int64, int, bool) {
+	bytes, err := base64.RawURLEncoding.DecodeString(cont)
+	if err != nil {
+		return 0, 0, false
+	}
+	fields := strings.Split(string(bytes), "/")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	skip, err := strconv.Atoi(fields[1])
+	if err != nil || skip < 0 {
+		return 0, 0, false
+	}
+
+	return start, skip, true
+}
+
 //deviceGetHandle
 // this function will return exist twin json profile to requester. 
 // If request twin is not exit, this func will return empty list.
 func (dm *TwinModule) deviceGetHandle(msg *model.Message) (interface{}, error) {
 	var twinMsg	common.TwinMessage
-	twins := make([]common.DigitalTwin, 0)
 
 	content, ok := msg.Content.([]byte)
 	if !ok {
@@ -356,26 +607,30 @@ func (dm *TwinModule) deviceGetHandle(msg *model.Message) (interface{}, error) {
 		return nil, err
 	}
 
-	for _, twin := range twinMsg.Twins	{
+	resp := newBatchResponse()
+	for key, _ := range twinMsg.Twins	{
 		//for each dgtwin
+		twin := &twinMsg.Twins[key]
 		twinID := twin.ID
 
-		exist := dm.context.DGTwinIsExist(twinID)
-		if exist {
-			v, _ := dm.context.DGTwinList.Load(twinID)
-			savedTwin, isDgTwinType  :=v.(*common.DigitalTwin)
-			if !isDgTwinType {
-				return nil,  errors.New("invalud digital twin type")
-			}
-
-			twins = append(twins, *savedTwin)
-		}else {
-			// not exist, ignore.
+		v, _ := dm.context.DGTwinList.Load(twinID)
+		savedTwin, _ := v.(*common.DigitalTwin)
+		if savedTwin == nil {
+			resp.add(twinID, common.NotFoundCode, "Not found", nil, nil)
+			continue
 		}
+
+		// the saved twin is changed by other modules under the lock,
+		// so copy it before the response is built.
+		dm.context.Lock(twinID)
+		twins := []common.DigitalTwin{twinCopy(savedTwin)}
+		dm.context.Unlock(twinID)
+		resp.add(twinID, common.RequestSuccessCode, "Get", twins, nil)
 	}
 
 	//Send the response.
-	msgContent, err := common.BuildResponseMessage(common.RequestSuccessCode, "Get", twins)
+	models := dm.context.GetTwinModels(resp.twins)
+	msgContent, err := resp.build(models)
 	if err != nil {
 		//Internal err.
 		return nil, err
@@ -385,6 +640,146 @@ func (dm *TwinModule) deviceGetHandle(msg *model.Message) (interface{}, error) {
 	return nil, nil
 }	
 
+//twinsListHandle
+// this function will return the summary (without properties) of twins which
+// match the filter, twins are sorted by ID and returned page by page. the 
+// continue token in response is used to get the next page.
+func (dm *TwinModule) twinsListHandle(msg *model.Message) (interface{}, error) {
+	listMsg, err := common.UnMarshalTwinListMessage(msg)
+	if err != nil {
+		msgContent, err := common.BuildResponseMessage(common.BadRequestCode, "Invalid list message", nil)
+		if err != nil {
+			return nil, err
+		}
+		dm.context.SendResponseMessage(msg, msgContent)
+		return nil, nil
+	}
+
+	pageSize := listMsg.PageSize
+	if pageSize <= 0 {
+		pageSize = types.DGTWINS_LIST_PAGE_SIZE
+	}else if pageSize > types.DGTWINS_LIST_MAX_PAGE_SIZE {
+		pageSize = types.DGTWINS_LIST_MAX_PAGE_SIZE
+	}
+
+	lastID := ""
+	if listMsg.Continue != "" {
+		bytes, err := base64.RawURLEncoding.DecodeString(listMsg.Continue)
+		if err != nil {
+			msgContent, err := common.BuildResponseMessage(common.BadRequestCode, "Invalid continue token", nil)
+			if err != nil {
+				return nil, err
+			}
+			dm.context.SendResponseMessage(msg, msgContent)
+			return nil, nil
+		}
+		lastID = string(bytes)
+	}
+
+	//collect all matched twins after the last page.
+	summaries := make(map[string]common.DigitalTwin)
+	ids := make([]string, 0)
+	dm.context.DGTwinList.Range(func(key, value interface{}) bool {
+		twinID := key.(string)
+		savedTwin, isDgTwinType := value.(*common.DigitalTwin)
+		if !isDgTwinType || (lastID != "" && twinID <= lastID) {
+			return true
+		}
+
+		dm.context.Lock(twinID)
+		matched := matchTwinFilter(savedTwin, listMsg)
+		summary := twinSummary(savedTwin)
+		dm.context.Unlock(twinID)
+
+		// the denied twins are not listed.
+		if matched && dm.context.AuthorizeTwin(msg, twinID) {
+			summaries[twinID] = summary
+			ids = append(ids, twinID)
+		}
+		return true
+	})
+	sort.Strings(ids)
+
+	cont := ""
+	if len(ids) > pageSize {
+		ids = ids[:pageSize]
+		cont = base64.RawURLEncoding.EncodeToString([]byte(ids[pageSize-1]))
+	}
+
+	twins := make([]common.DigitalTwin, 0, len(ids))
+	for _, twinID := range ids {
+		twins = append(twins, summaries[twinID])
+	}
+
+	msgContent, err := common.BuildListResponseMessage(common.RequestSuccessCode, "List", twins, cont)
+	if err != nil {
+		return nil, err
+	}
+	dm.context.SendResponseMessage(msg, msgContent)
+
+	return nil, nil
+}
+
+// matchTwinFilter check the twin match all filters in list message.
+func matchTwinFilter(twin *common.DigitalTwin, listMsg *common.TwinListMessage) bool {
+	if listMsg.State != "" && twin.State != listMsg.State {
+		return false
+	}
+	if !strings.HasPrefix(twin.Name, listMsg.NamePrefix) {
+		return false
+	}
+
+	for _, filter := range listMsg.MetaData {
+		meta, exist := twin.MetaData[filter.Name]
+		if !exist || meta == nil {
+			return false
+		}
+		if filter.Value != "" && meta.Value != filter.Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// twinSummary copy the twin without properties.
+func twinSummary(twin *common.DigitalTwin) common.DigitalTwin {
+	summary := common.DigitalTwin{
+		ID:			twin.ID,
+		Name:		twin.Name,
+		Description: twin.Description,
+		State:		twin.State,
+		LastState:	twin.LastState,
+		Model:		twin.Model,
+		Version:	twin.Version,
+	}
+
+	if len(twin.MetaData) > 0 {
+		summary.MetaData = make(map[string]*common.MetaType)
+		for name, meta := range twin.MetaData {
+			if meta != nil {
+				value := *meta
+				summary.MetaData[name] = &value
+			}
+		}
+	}
+
+	return summary
+}
+
+// twinCopy copy the twin with its properties.
+func twinCopy(twin *common.DigitalTwin) common.DigitalTwin {
+	copied := twinSummary(twin)
+	if twin.Liveness != nil {
+		liveness := *twin.Liveness
+		copied.Liveness = &liveness
+	}
+	copied.Properties.Desired = copyProperties(twin.Properties.Desired, twin.Properties.Desired)
+	copied.Properties.Reported = copyProperties(twin.Properties.Reported, twin.Properties.Reported)
+
+	return copied
+}
+
 // deviceResponseHandle: handle response.
 func (dm *TwinModule) deviceResponseHandle(msg *model.Message) (interface{}, error) {
 	msgSource := msg.GetSource()
@@ -402,12 +797,18 @@ func (dm *TwinModule) deviceResponseHandle(msg *model.Message) (interface{}, err
     		return nil, err
     	}
 
+		// the online code is the answer of ping.
+		dm.context.MarkAlive(resp.Twin.ID, code != common.OnlineCode)
+
 		switch code {
 		case common.OnlineCode:
 			//Mark the state is online.
 			resp.Twin.State = common.DGTWINS_STATE_ONLINE
 
-			content, _ := common.BuildDeviceMessage(&resp.Twin)
+			content, _ := json.Marshal(&common.DeviceMessage{
+				Twin:	resp.Twin,
+				Reason:	common.LIFECYCLE_REASON_DETECTED,
+			})
 			deviceMsg := common.BuildModelMessage(types.MODULE_NAME, types.MODULE_NAME, 
 					common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_TWINS, content)
 
@@ -430,11 +831,23 @@ func (dm *TwinModule) deviceResponseHandle(msg *model.Message) (interface{}, err
 }	
 
 
-//PingDevice: ping device.
-//device should reply the online code for that device is alive.  
+//PingDevice: ping device by its liveness policy.
+//device should reply the online code for that device is alive, and
+//the online device is marked offline after it missed too many pings.
 func (dm *TwinModule) PingDevice() {
+	now := time.Now()
+
 	dm.context.DGTwinList.Range(func(key, value interface{}) bool {
 		twinID := key.(string)
+		ping, offline := dm.context.CheckLiveness(twinID, now)
+		if offline {
+			klog.Infof("### Detect Device(%s) is offline", twinID)
+			dm.markDeviceOffline(twinID, common.LIFECYCLE_REASON_DETECT_TIMEOUT)
+		}
+		if !ping {
+			return true
+		}
+
 		twin :=	&common.DeviceTwin{
 			ID: twinID,
 			State:	dm.context.GetTwinState(twinID),
@@ -445,6 +858,18 @@ func (dm *TwinModule) PingDevice() {
 	})	
 }
 
+// markDeviceOffline update the twin state as offline.
+func (dm *TwinModule) markDeviceOffline(twinID, reason string) {
+	msgContent, err := common.BuildDeviceStateMessage(twinID, common.DGTWINS_STATE_OFFLINE, reason)
+	if err != nil {
+		return
+	}
+
+	modelMsg := common.BuildModelMessage(types.MODULE_NAME, types.MODULE_NAME, common.DGTWINS_OPS_UPDATE, 
+											common.DGTWINS_RESOURCE_TWINS, msgContent)
+	dm.deviceUpdateHandle(modelMsg)
+}
+
 // convert digital twins to device twins. 
 func (dm *TwinModule) Digital2Device(savedTwin *common.DigitalTwin) *common.DeviceTwin {
 	deviceTwin := &common.DeviceTwin{
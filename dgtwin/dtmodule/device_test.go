@@ -1,13 +1,19 @@
 package dtmodule
 
 import (
+	"os"
+	"fmt"
 	"sync"
 	"time"
+	"strconv"
 	"testing"
+	"io/ioutil"
 	"encoding/json"
+	"github.com/jwzl/edgeOn/common"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/beehive/pkg/core/context"
 	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"	
 )
 
@@ -29,17 +35,17 @@ func TestCreateTwin(t *testing.T) {
 	deviceModule.InitModule(dtcontext, comm, heartBeat, nil)
 	t.Log("Start test CreateTwin")
 
-	dgTwin := &types.DigitalTwin{
+	dgTwin := common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
 		State: "offline",
 	}
-	twins := []*types.DigitalTwin{dgTwin}
-	bytes, err := types.BuildTwinMessage(types.DGTWINS_OPS_UPDATE, twins)
+	twins := []common.DigitalTwin{dgTwin}
+	bytes, err := common.BuildTwinMessage(twins)
 	if err == nil {
 		modelMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
-							types.DGTWINS_OPS_UPDATE, types.DGTWINS_MODULE_TWINS, bytes)
+							common.DGTWINS_OPS_CREATE, types.DGTWINS_MODULE_TWINS, bytes)
 		comm <- modelMsg
 		heartBeat <- "ping"
 	}
@@ -61,6 +67,7 @@ func TestCreateTwin(t *testing.T) {
 func TestUpdateTwin(t *testing.T) {
 	ctx := context.GetContext(context.MsgCtxTypeChannel)
 	dtcontext := dtcontext.NewDTContext(ctx)
+	dtcontext.CommChan["comm"] = make(chan interface{}, 128)
 	deviceModule := NewTwinModule()
 	comm := make(chan interface{}, 128)
 	heartBeat := make(chan interface{}, 128)
@@ -68,7 +75,7 @@ func TestUpdateTwin(t *testing.T) {
 	deviceModule.InitModule(dtcontext, comm, heartBeat, nil)
 	t.Log("Start test UpdateTwin")
 
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
@@ -79,39 +86,45 @@ func TestUpdateTwin(t *testing.T) {
 	var deviceMutex	sync.Mutex
 	dtcontext.DGTwinMutex.Store("dev001", &deviceMutex)
 
-	newTwin := &types.DigitalTwin{
+	newTwin := &common.DeviceTwin{
 		ID:	"dev001",
 		Name:	"sensor1",
 		Description: "",
 		State: "offline",
 	}
-	twins := []*types.DigitalTwin{newTwin}
-	bytes, err := types.BuildTwinMessage(types.DGTWINS_OPS_UPDATE, twins)
+	bytes, err := common.BuildDeviceMessage(newTwin)
 	if err == nil {
-		modelMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
-							types.DGTWINS_OPS_UPDATE, types.DGTWINS_MODULE_TWINS, bytes)
+		modelMsg := dtcontext.BuildModelMessage(common.DeviceName, types.MODULE_NAME, 
+							common.DGTWINS_OPS_UPDATE, types.DGTWINS_MODULE_TWINS, bytes)
 		comm <- modelMsg
 		heartBeat <- "ping"
 	}
 	
 	t.Run("Update", func(t *testing.T){
 		go deviceModule.Start()
-		time.Sleep(10 * time.Millisecond)
+		// the twin is updated before the sync message.
+		message := GetModelMessage(<-dtcontext.CommChan["comm"])
+		if message == nil || message.GetOperation() != common.DGTWINS_OPS_SYNC {
+			t.Fatalf("unexpected message (%v)", message)
+		}
 		
 		v, exist := dtcontext.DGTwinList.Load("dev001")
 		if !exist {
-			t.Errorf("No Such twin!")
+			t.Fatalf("No Such twin!")
 		}
-		oldTwin, isDgTwinType  :=v.(*types.DigitalTwin)
+		oldTwin, isDgTwinType  :=v.(*common.DigitalTwin)
 		if !isDgTwinType {
-			t.Errorf("invalud digital twin type")
+			t.Fatalf("invalud digital twin type")
 		}
 
-		if oldTwin.Name != newTwin.Name {
-			t.Errorf("Name err %s != %s", oldTwin.Name, newTwin.Name)
+		dtcontext.Lock("dev001")
+		name, description := oldTwin.Name, oldTwin.Description
+		dtcontext.Unlock("dev001")
+		if name != newTwin.Name {
+			t.Errorf("Name err %s != %s", name, newTwin.Name)
 		}
-		if oldTwin.Description != dgTwin.Description {
-			t.Errorf("Name err %s != %s", oldTwin.Name, newTwin.Name)
+		if description != dgTwin.Description {
+			t.Errorf("Description err %s != %s", description, dgTwin.Description)
 		}
 	})
 
@@ -128,7 +141,7 @@ func TestDeleteTwin(t *testing.T) {
 	deviceModule.InitModule(dtcontext, comm, heartBeat, nil)
 	t.Log("Start test DeleteTwin")
 
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
@@ -139,14 +152,14 @@ func TestDeleteTwin(t *testing.T) {
 	var deviceMutex	sync.Mutex
 	dtcontext.DGTwinMutex.Store("dev001", &deviceMutex)
 
-	newTwin := &types.DigitalTwin{
+	newTwin := common.DigitalTwin{
 		ID:	"dev001",
 	}
-	twins := []*types.DigitalTwin{newTwin}
-	bytes, err := types.BuildTwinMessage(types.DGTWINS_OPS_DELETE, twins)
+	twins := []common.DigitalTwin{newTwin}
+	bytes, err := common.BuildTwinMessage(twins)
 	if err == nil {
 		modelMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
-							types.DGTWINS_OPS_DELETE, types.DGTWINS_MODULE_TWINS, bytes)
+							common.DGTWINS_OPS_DELETE, types.DGTWINS_MODULE_TWINS, bytes)
 		comm <- modelMsg
 		heartBeat <- "ping"
 	}
@@ -181,13 +194,13 @@ func TestGetTwin(t *testing.T) {
 	deviceModule.InitModule(dtcontext, comm, heartBeat, nil)
 	t.Log("Start test DeleteTwin")
 
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
 		State: "offline",
 	}
-	dgTwin2 := &types.DigitalTwin{
+	dgTwin2 := &common.DigitalTwin{
 		ID:	"dev002",
 		Name:	"sensor1",
 		Description: "None",
@@ -202,18 +215,18 @@ func TestGetTwin(t *testing.T) {
 	dtcontext.DGTwinMutex.Store("dev002", &deviceMutex2)
 
 	
-	newTwin := &types.DigitalTwin{
+	newTwin := common.DigitalTwin{
 		ID:	"dev001",
 	}
-	newTwin2 := &types.DigitalTwin{
+	newTwin2 := common.DigitalTwin{
 		ID:	"dev002",
 	}
 
-	twins := []*types.DigitalTwin{newTwin, newTwin2}
-	bytes, err := types.BuildTwinMessage(types.DGTWINS_OPS_GET, twins)
+	twins := []common.DigitalTwin{newTwin, newTwin2}
+	bytes, err := common.BuildTwinMessage(twins)
 	if err == nil {
 		modelMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
-							types.DGTWINS_OPS_GET, types.DGTWINS_MODULE_TWINS, bytes)
+							common.DGTWINS_OPS_GET, types.DGTWINS_MODULE_TWINS, bytes)
 		comm <- modelMsg
 		heartBeat <- "ping"
 	}
@@ -234,7 +247,7 @@ func TestGetTwin(t *testing.T) {
 	if !ok {
 		t.Errorf("invaliad message content")
 	}
-	var dgTwinMsg types.DGTwinMessage
+	var dgTwinMsg common.TwinResponse
 	json.Unmarshal(content, &dgTwinMsg)
 	
 	t.Logf("dgTwinMsg (%v)", dgTwinMsg)
@@ -254,6 +267,7 @@ func TestResponseHandle(t *testing.T) {
 	dtcontext := dtcontext.NewDTContext(ctx)
 	dtcontext.CommChan["comm"] = make(chan interface{}, 128)
 	dtcontext.HeartBeatChan["comm"] = make(chan interface{}, 128)
+	dtcontext.CommChan["twins"] = make(chan interface{}, 128)
 	deviceModule := NewTwinModule()
 	comm := make(chan interface{}, 128)
 	heartBeat := make(chan interface{}, 128)
@@ -261,7 +275,7 @@ func TestResponseHandle(t *testing.T) {
 	deviceModule.InitModule(dtcontext, comm, heartBeat, nil)
 	t.Log("Start test ResponseHandle")
 	
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
@@ -272,12 +286,12 @@ func TestResponseHandle(t *testing.T) {
 	var deviceMutex	sync.Mutex
 	dtcontext.DGTwinMutex.Store("dev001", &deviceMutex)
 
-	twins := []*types.DigitalTwin{dgTwin}
-	msgContent, err := types.BuildResponseMessage(types.OnlineCode, "SYNC", twins)
+	devTwin := &common.DeviceTwin{ID: "dev001"}
+	msgContent, err := common.BuildDeviceResponseMessage(strconv.Itoa(common.OnlineCode), "SYNC", devTwin)
 	if err != nil {
 		return 
 	}
-	msg := dtcontext.BuildModelMessage("device", "edge/twin", types.DGTWINS_OPS_RESPONSE, "device", msgContent) 
+	msg := dtcontext.BuildModelMessage("device", "edge/twin", common.DGTWINS_OPS_RESPONSE, "device", msgContent) 
 
 	comm <- msg
 	heartBeat <- "ping"
@@ -285,28 +299,323 @@ func TestResponseHandle(t *testing.T) {
 	go deviceModule.Start()
 	time.Sleep(10 * time.Millisecond)
 
-	v, ok := <-dtcontext.CommChan["comm"]
+	v, ok := <-dtcontext.CommChan["twins"]
 	if !ok {
 		t.Errorf("channel closed")
 	}
 	message, isMsgType := v.(*model.Message )
 	if !isMsgType {
-		t.Errorf("Not message type")
+		t.Fatalf("Not message type")
 	}
 
-	content, ok := message.Content.([]byte)
-	if !ok {
-		t.Errorf("invaliad message content")
+	devMsg, err := common.UnMarshalDeviceMessage(message)
+	if err != nil {
+		t.Fatalf("invaliad message content")
 	}
-	var dgTwinMsg types.DGTwinMessage
-	json.Unmarshal(content, &dgTwinMsg)
-	for _, dgTwin := range dgTwinMsg.Twins	{
-		deviceID := dgTwin.ID
-		if deviceID != "dev001" {
-			t.Errorf("deviceID != dev001 ")
-		} 
-		if dgTwin.State != types.DGTWINS_STATE_ONLINE {
-			t.Errorf("deviceID should be online ")
+	if devMsg.Twin.ID != "dev001" {
+		t.Errorf("deviceID != dev001 ")
+	} 
+	if devMsg.Twin.State != common.DGTWINS_STATE_ONLINE {
+		t.Errorf("deviceID should be online ")
+	}
+	heartBeat <- "stop"
+}
+
+func TestListTwin(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	dtcontext.CommChan["comm"] = make(chan interface{}, 128)
+	deviceModule := NewTwinModule()
+	comm := make(chan interface{}, 128)
+	heartBeat := make(chan interface{}, 128)
+
+	deviceModule.InitModule(dtcontext, comm, heartBeat, nil)
+	t.Log("Start test ListTwin")
+
+	for i := 0; i < 5; i++ {
+		twinID := fmt.Sprintf("dev00%d", i)
+		dgTwin := &common.DigitalTwin{
+			ID:	twinID,
+			Name:	fmt.Sprintf("sensor%d", i),
+			State: common.DGTWINS_STATE_ONLINE,
+			MetaData: map[string]*common.MetaType{
+				"room": &common.MetaType{Name: "room", Value: "101"},
+			},
+		}
+		if i == 4 {
+			dgTwin.Name = "light0"
 		}
+		if i == 3 {
+			dgTwin.State = common.DGTWINS_STATE_OFFLINE
+		}
+		dtcontext.DGTwinList.Store(twinID, dgTwin)
+		var deviceMutex	sync.Mutex
+		dtcontext.DGTwinMutex.Store(twinID, &deviceMutex)
+	}
+	go deviceModule.Start()
+
+	list := func(listMsg *common.TwinListMessage) *common.TwinResponse {
+		bytes, _ := json.Marshal(listMsg)
+		comm <- dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
+							common.DGTWINS_OPS_List, types.DGTWINS_MODULE_TWINS, bytes)
+		v := <-dtcontext.CommChan["comm"]
+		message, _ := v.(*model.Message)
+		resp, err := common.UnMarshalResponseMessage(message)
+		if err != nil {
+			t.Fatalf("invaliad response (%v)", err)
+		}
+		return resp
+	}
+
+	listMsg := &common.TwinListMessage{
+		State:	common.DGTWINS_STATE_ONLINE,
+		NamePrefix:	"sensor",
+		MetaData: []common.MetaType{{Name: "room", Value: "101"}},
+		PageSize: 2,
+	}
+	resp := list(listMsg)
+	if resp.Code != common.RequestSuccessCode || len(resp.Twins) != 2 || resp.Continue == "" {
+		t.Fatalf("error first page (%v)", resp)
+	}
+	if resp.Twins[0].ID != "dev000" || resp.Twins[1].ID != "dev001" {
+		t.Errorf("error twins order (%v)", resp.Twins)
+	}
+
+	listMsg.Continue = resp.Continue
+	resp = list(listMsg)
+	if len(resp.Twins) != 1 || resp.Twins[0].ID != "dev002" || resp.Continue != "" {
+		t.Errorf("error last page (%v)", resp)
+	}
+
+	resp = list(&common.TwinListMessage{MetaData: []common.MetaType{{Name: "floor"}}})
+	if len(resp.Twins) != 0 {
+		t.Errorf("twins should not match metadata (%v)", resp.Twins)
+	}
+
+	heartBeat <- "stop"
+}
+
+func TestLiveness(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = make(chan interface{}, 128)
+	deviceModule := NewTwinModule()
+	deviceModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State: common.DGTWINS_STATE_ONLINE,
+		Liveness: &common.LivenessPolicy{Interval: 10, MissTolerance: 2, TrafficAsAlive: true},
+	}
+	dtcontext.DGTwinList.Store("dev001", dgTwin)
+	var deviceMutex	sync.Mutex
+	dtcontext.DGTwinMutex.Store("dev001", &deviceMutex)
+
+	now := time.Now()
+	// the traffic of device is proof of life.
+	dtcontext.MarkAlive("dev001", true)
+	if ping, _ := dtcontext.CheckLiveness("dev001", now); ping {
+		t.Errorf("ping should be skipped since device has traffic")
+	}
+
+	// the first ping is sent after interval.
+	now = now.Add(11 * time.Second)
+	if ping, offline := dtcontext.CheckLiveness("dev001", now); !ping || offline {
+		t.Errorf("device should be pinged")
+	}
+	// the answered ping is not a miss.
+	dtcontext.MarkAlive("dev001", false)
+	now = now.Add(11 * time.Second)
+	if ping, offline := dtcontext.CheckLiveness("dev001", now); !ping || offline {
+		t.Errorf("device should be pinged again")
+	}
+	now = now.Add(11 * time.Second)
+	if _, offline := dtcontext.CheckLiveness("dev001", now); offline {
+		t.Errorf("device should be online after one miss")
+	}
+	now = now.Add(11 * time.Second)
+	if _, offline := dtcontext.CheckLiveness("dev001", now); !offline {
+		t.Fatalf("device should be offline after two misses")
+	}
+
+	deviceModule.markDeviceOffline("dev001", common.LIFECYCLE_REASON_DETECT_TIMEOUT)
+	if dtcontext.GetTwinState("dev001") != common.DGTWINS_STATE_OFFLINE {
+		t.Errorf("device should be marked offline")
+	}
+
+	// traffic isn't proof of life when the policy disables it.
+	dgTwin.Liveness = &common.LivenessPolicy{Interval: 10, MissTolerance: 1}
+	dgTwin.State = common.DGTWINS_STATE_ONLINE
+	dtcontext.MarkAlive("dev001", true)
+	now = now.Add(11 * time.Second)
+	if ping, offline := dtcontext.CheckLiveness("dev001", now); !ping || !offline {
+		t.Errorf("device should be offline after the pending ping is missed")
+	}
+}
+
+func TestBulkDeleteTwin(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	comm := make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = comm
+	deviceModule := NewTwinModule()
+	deviceModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+
+	for _, twinID := range []string{"dev001", "dev002"} {
+		dtcontext.DGTwinList.Store(twinID, &common.DigitalTwin{ID: twinID, State: common.DGTWINS_STATE_ONLINE})
+		var deviceMutex	sync.Mutex
+		dtcontext.DGTwinMutex.Store(twinID, &deviceMutex)
+	}
+
+	twins := []common.DigitalTwin{{ID: "dev001"}, {ID: "dev002"}, {ID: "dev003"}}
+	bytes, _ := common.BuildTwinMessage(twins)
+	modelMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
+						common.DGTWINS_OPS_DELETE, types.DGTWINS_MODULE_TWINS, bytes)
+	deviceModule.deviceDeleteHandle(modelMsg)
+
+	for _, twinID := range []string{"dev001", "dev002"} {
+		if dtcontext.DGTwinIsExist(twinID) {
+			t.Errorf("twin (%s) should be deleted", twinID)
+		}
+	}
+
+	var resp *common.TwinResponse
+	for len(comm) > 0 {
+		message := GetModelMessage(<-comm)
+		if message.GetOperation() == common.DGTWINS_OPS_RESPONSE {
+			resp = GetDTResponse(message)
+		}
+	}
+	if resp == nil || resp.Code != common.MultiStatusCode || len(resp.TwinResults) != 3 {
+		t.Fatalf("response should have result of each twin (%v)", resp)
+	}
+	if resp.TwinResults[2].TwinID != "dev003" || resp.TwinResults[2].Code != common.NotFoundCode {
+		t.Errorf("dev003 should be not found")
+	}
+}
+
+// TestAuditTwin test the audit records are returned page by page, the records
+// at same timestamp are not lost or repeated between pages.
+func TestAuditTwin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+	auditLog, err := dtstore.NewAuditLog(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed (%v)", err)
+	}
+	defer auditLog.Close()
+	for key, timestamp := range []int64{1, 2, 2, 2, 3} {
+		auditLog.Append(&common.AuditRecord{Timestamp: timestamp, TwinID: "dev001",
+					MessageID: strconv.Itoa(key)})
+	}
+
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	dtcontext.CommChan["comm"] = make(chan interface{}, 128)
+	dtcontext.SetAuditLog(auditLog)
+	deviceModule := NewTwinModule()
+	deviceModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+
+	audit := func(auditMsg *common.TwinAuditMessage) *common.TwinResponse {
+		bytes, _ := json.Marshal(auditMsg)
+		deviceModule.twinsAuditHandle(dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME,
+							common.DGTWINS_OPS_AUDIT, types.DGTWINS_MODULE_TWINS, bytes))
+		message, _ := (<-dtcontext.CommChan["comm"]).(*model.Message)
+		resp, err := common.UnMarshalResponseMessage(message)
+		if err != nil {
+			t.Fatalf("invaliad response (%v)", err)
+		}
+		return resp
+	}
+
+	auditMsg := &common.TwinAuditMessage{TwinID: "dev001", PageSize: 2}
+	ids := ""
+	for page := 0; page < 3; page++ {
+		resp := audit(auditMsg)
+		if resp.Code != common.RequestSuccessCode || len(resp.Audit) == 0 {
+			t.Fatalf("error page %d (%v)", page, resp)
+		}
+		for _, record := range resp.Audit {
+			ids += record.MessageID
+		}
+		if (page < 2) != (resp.Continue != "") {
+			t.Fatalf("error continue token of page %d (%v)", page, resp)
+		}
+		auditMsg.Continue = resp.Continue
+	}
+	if ids != "01234" {
+		t.Errorf("records of pages are %s, want 01234", ids)
+	}
+
+	auditMsg.Continue = "invalid"
+	if resp := audit(auditMsg); resp.Code != common.BadRequestCode {
+		t.Errorf("invalid continue token is accepted (%v)", resp)
+	}
+}
+
+// TestTwinlessACL test the twin-scoped deny rules apply to the twins in the
+// result of List and Audit, which are requested without twin.
+func TestTwinlessACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+	auditLog, err := dtstore.NewAuditLog(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed (%v)", err)
+	}
+	defer auditLog.Close()
+
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	dtcontext.CommChan["comm"] = make(chan interface{}, 128)
+	dtcontext.SetAuditLog(auditLog)
+	dtcontext.ACLPolicy = &types.ACLPolicy{
+		Default: types.ACL_EFFECT_ALLOW,
+		Rules: []types.ACLRule{
+			{Effect: types.ACL_EFFECT_DENY, Sources: []string{"edge/app/thirdparty"}, Twins: []string{"dev001"}},
+		},
+	}
+	for _, twinID := range []string{"dev000", "dev001"} {
+		dtcontext.DGTwinList.Store(twinID, &common.DigitalTwin{ID: twinID, State: common.DGTWINS_STATE_ONLINE})
+		var deviceMutex	sync.Mutex
+		dtcontext.DGTwinMutex.Store(twinID, &deviceMutex)
+		auditLog.Append(&common.AuditRecord{Timestamp: 1, TwinID: twinID, NewValue: []byte("20")})
+	}
+	deviceModule := NewTwinModule()
+	deviceModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+
+	request := func(operation string, content interface{}) *common.TwinResponse {
+		bytes, _ := json.Marshal(content)
+		msg := dtcontext.BuildModelMessage("edge/app/thirdparty", types.MODULE_NAME,
+							operation, types.DGTWINS_MODULE_TWINS, bytes)
+		if denied := dtcontext.Authorize(msg); len(denied) != 0 {
+			t.Fatalf("request without twin is denied (%v)", denied)
+		}
+		if operation == common.DGTWINS_OPS_List {
+			deviceModule.twinsListHandle(msg)
+		}else {
+			deviceModule.twinsAuditHandle(msg)
+		}
+		message, _ := (<-dtcontext.CommChan["comm"]).(*model.Message)
+		resp, err := common.UnMarshalResponseMessage(message)
+		if err != nil {
+			t.Fatalf("invaliad response (%v)", err)
+		}
+		return resp
+	}
+
+	resp := request(common.DGTWINS_OPS_List, &common.TwinListMessage{})
+	if len(resp.Twins) != 1 || resp.Twins[0].ID != "dev000" {
+		t.Errorf("denied twin is listed (%v)", resp.Twins)
+	}
+
+	resp = request(common.DGTWINS_OPS_AUDIT, &common.TwinAuditMessage{})
+	if len(resp.Audit) != 1 || resp.Audit[0].TwinID != "dev000" {
+		t.Errorf("audit of denied twin is returned (%v)", resp.Audit)
 	}
 }
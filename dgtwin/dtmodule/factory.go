@@ -15,6 +15,12 @@ func NewDTModule(moduleName string) dtcontext.DTModule {
 		return NewPropertyModule()
 	case types.DGTWINS_MODULE_TWINS:
 		return NewTwinModule()
+	case types.DGTWINS_MODULE_RECONCILE:
+		return NewReconcileModule()
+	case types.DGTWINS_MODULE_LIFECYCLE:
+		return NewLifecycleModule()
+	case types.DGTWINS_MODULE_METHOD:
+		return NewMethodModule()
 	default:
 		klog.Errorf("moduleName is invaild.")
 		return nil
@@ -0,0 +1,173 @@
+package dtmodule
+
+import (
+	"errors"
+	"k8s.io/klog"
+	"encoding/json"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+// LifecycleModule deliver the lifecycle events of twins (created, firstseen,
+// online, offline, deleted) to the subscribers. cloud and edge/app subscribe
+// the events by Watch the lifecycle resource, and close the subscription by
+// reply the sync message with CloseWatchCode.
+type LifecycleModule struct {
+	// module name
+	name			string
+	context			*dtcontext.DTContext
+	//for msg communication
+	recieveChan		chan interface{}
+	// for module's health check.
+	heartBeatChan	chan interface{}
+	confirmChan		chan interface{}
+	// subscribers, key is the subscriber (message source), value is the
+	// set of subscribed twin IDs, empty set means all twins.
+	subscribers		map[string]map[string]bool
+}
+
+func NewLifecycleModule() *LifecycleModule {
+	return &LifecycleModule{name: types.DGTWINS_MODULE_LIFECYCLE}
+}
+
+func (lm *LifecycleModule) Name() string {
+	return lm.name
+}
+
+//Init the lifecycle module.
+func (lm *LifecycleModule) InitModule(dtc *dtcontext.DTContext, comm, heartBeat, confirm chan interface{}) {
+	lm.context = dtc
+	lm.recieveChan = comm
+	lm.heartBeatChan = heartBeat
+	lm.confirmChan = confirm
+	lm.subscribers = make(map[string]map[string]bool)
+}
+
+//Start lifecycle module
+func (lm *LifecycleModule) Start() {
+	//Start loop.
+	for {
+		select {
+		case v, ok := <-lm.recieveChan:
+			if !ok {
+				//channel closed.
+				return
+			}
+
+			switch msg := v.(type) {
+			case *common.LifecycleEvent:
+				lm.publish(msg)
+			case *model.Message:
+				klog.Infof("lifecycle message arrived {Header:%v Router:%v-}", msg.Header, msg.Router)
+				if err := lm.handleMessage(msg); err != nil {
+					klog.Errorf("Handle %s failed (%v), ignored", msg.GetOperation(), err)
+				}
+			}
+		case v, ok := <-lm.heartBeatChan:
+			if !ok {
+				return
+			}
+
+			err := lm.context.HandleHeartBeat(lm.Name(), v.(string))
+			if err != nil {
+				klog.Infof("%s module stopped", lm.Name())
+				return
+			}
+		}
+	}
+}
+
+func (lm *LifecycleModule) handleMessage(msg *model.Message) error {
+	switch msg.GetOperation() {
+	case common.DGTWINS_OPS_WATCH:
+		return lm.watchHandle(msg)
+	case common.DGTWINS_OPS_RESPONSE:
+		return lm.responseHandle(msg)
+	}
+
+	return errors.New("No this handle for " + msg.GetOperation())
+}
+
+// watchHandle subscribe the lifecycle events of the twins in request,
+// no twins in request means all twins.
+func (lm *LifecycleModule) watchHandle(msg *model.Message) error {
+	var twinMsg	common.TwinMessage
+
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		return errors.New("invaliad message content")
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &twinMsg); err != nil {
+			return err
+		}
+	}
+
+	source := msg.GetSource()
+	twinIDs, exist := lm.subscribers[source]
+	if !exist || len(twinMsg.Twins) < 1 {
+		twinIDs = make(map[string]bool)
+	}
+	if !exist || len(twinIDs) > 0 {
+		for _, twin := range twinMsg.Twins {
+			twinIDs[twin.ID] = true
+		}
+	}
+	lm.subscribers[source] = twinIDs
+	klog.Infof("%s watch the lifecycle of twins %v", source, twinMsg.Twins)
+
+	msgContent, err := common.BuildResponseMessage(common.RequestSuccessCode, "Watched", twinMsg.Twins)
+	if err != nil {
+		return err
+	}
+	lm.context.SendResponseMessage(msg, msgContent)
+
+	return nil
+}
+
+// responseHandle close the subscription if the subscriber reply
+// the CloseWatchCode, the twins in response are the twins to unwatch,
+// no twins means close the whole subscription.
+func (lm *LifecycleModule) responseHandle(msg *model.Message) error {
+	resp, err := common.UnMarshalResponseMessage(msg)
+	if err != nil {
+		klog.Warningf("error message content format, ignore.")
+	}else if resp.Code == common.CloseWatchCode {
+		source := msg.GetSource()
+		twinIDs := lm.subscribers[source]
+		if len(resp.Twins) < 1 || len(twinIDs) < 1 {
+			delete(lm.subscribers, source)
+		}else {
+			for _, twin := range resp.Twins {
+				delete(twinIDs, twin.ID)
+			}
+			if len(twinIDs) < 1 {
+				delete(lm.subscribers, source)
+			}
+		}
+		klog.Infof("%s close the watch of lifecycle %v", source, resp.Twins)
+	}
+
+	// pass the message to comm module to unmark the sync message.
+	lm.context.SendToModule(types.DGTWINS_MODULE_COMM, msg)
+
+	return nil
+}
+
+// publish send the event to each subscriber of this twin.
+func (lm *LifecycleModule) publish(event *common.LifecycleEvent) {
+	msgContent, err := common.BuildLifecycleMessage([]common.LifecycleEvent{*event})
+	if err != nil {
+		klog.Errorf("Build lifecycle message failed (%v)", err)
+		return
+	}
+
+	for source, twinIDs := range lm.subscribers {
+		if len(twinIDs) > 0 && !twinIDs[event.TwinID] {
+			continue
+		}
+		lm.context.SendSyncMessage(source, common.DGTWINS_RESOURCE_LIFECYCLE, msgContent)
+	}
+}
@@ -0,0 +1,100 @@
+package dtmodule
+
+import (
+	"sync"
+	"testing"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/beehive/pkg/core/context"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+func TestLifecycleWatch(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	comm := make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = comm
+	lifecycleModule := NewLifecycleModule()
+	lifecycleModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+
+	twins := []common.DigitalTwin{common.DigitalTwin{ID: "dev001"}}
+	content, _ := common.BuildTwinMessage(twins)
+	watchMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
+					common.DGTWINS_OPS_WATCH, common.DGTWINS_RESOURCE_LIFECYCLE, content)
+	if err := lifecycleModule.handleMessage(watchMsg); err != nil {
+		t.Fatalf("watch failed (%v)", err)
+	}
+	resp := GetDTResponse(<-comm)
+	if resp == nil || resp.Code != common.RequestSuccessCode {
+		t.Fatalf("watch should be success")
+	}
+
+	lifecycleModule.publish(&common.LifecycleEvent{TwinID: "dev002", Event: common.LIFECYCLE_EVENT_ONLINE})
+	lifecycleModule.publish(&common.LifecycleEvent{TwinID: "dev001", Event: common.LIFECYCLE_EVENT_OFFLINE,
+								Reason: common.LIFECYCLE_REASON_DETECT_TIMEOUT})
+	if len(comm) != 1 {
+		t.Fatalf("subscriber should just recieve the events of dev001")
+	}
+	message := GetModelMessage(<-comm)
+	if message.GetTarget() != "edge/app" || message.GetOperation() != common.DGTWINS_OPS_SYNC {
+		t.Fatalf("unexpected sync message (%v)", message)
+	}
+	lifecycleMsg, err := common.UnMarshalLifecycleMessage(message)
+	if err != nil || len(lifecycleMsg.Events) != 1 {
+		t.Fatalf("invalid lifecycle message")
+	}
+	if event := lifecycleMsg.Events[0]; event.TwinID != "dev001" || event.Event != common.LIFECYCLE_EVENT_OFFLINE ||
+			event.Reason != common.LIFECYCLE_REASON_DETECT_TIMEOUT {
+		t.Errorf("unexpected event (%v)", event)
+	}
+
+	// close the watch.
+	content, _ = common.BuildResponseMessage(common.CloseWatchCode, "Close", nil)
+	closeMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME, 
+					common.DGTWINS_OPS_RESPONSE, common.DGTWINS_RESOURCE_LIFECYCLE, content)
+	lifecycleModule.handleMessage(closeMsg)
+	<-comm
+	lifecycleModule.publish(&common.LifecycleEvent{TwinID: "dev001", Event: common.LIFECYCLE_EVENT_ONLINE})
+	if len(comm) != 0 {
+		t.Errorf("subscriber should not recieve events after close")
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	lifecycle := make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_LIFECYCLE] = lifecycle
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_RECONCILE] = make(chan interface{}, 128)
+	deviceModule := NewTwinModule()
+	deviceModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+
+	dtcontext.DGTwinList.Store("dev001", &common.DigitalTwin{ID: "dev001", State: common.DGTWINS_STATE_CREATED})
+	var deviceMutex	sync.Mutex
+	dtcontext.DGTwinMutex.Store("dev001", &deviceMutex)
+
+	content, _ := common.BuildDeviceStateMessage("dev001", common.DGTWINS_STATE_ONLINE, common.LIFECYCLE_REASON_DETECTED)
+	msg := dtcontext.BuildModelMessage(types.MODULE_NAME, types.MODULE_NAME, 
+					common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_TWINS, content)
+	deviceModule.deviceUpdateHandle(msg)
+	deviceModule.markDeviceOffline("dev001", common.LIFECYCLE_REASON_DETECT_TIMEOUT)
+
+	expected := []common.LifecycleEvent{
+		{TwinID: "dev001", Event: common.LIFECYCLE_EVENT_FIRSTSEEN, Reason: common.LIFECYCLE_REASON_DETECTED},
+		{TwinID: "dev001", Event: common.LIFECYCLE_EVENT_ONLINE, Reason: common.LIFECYCLE_REASON_DETECTED},
+		{TwinID: "dev001", Event: common.LIFECYCLE_EVENT_OFFLINE, Reason: common.LIFECYCLE_REASON_DETECT_TIMEOUT},
+	}
+	if len(lifecycle) != len(expected) {
+		t.Fatalf("expect %d events, but got %d", len(expected), len(lifecycle))
+	}
+	for _, want := range expected {
+		event := (<-lifecycle).(*common.LifecycleEvent)
+		if event.TwinID != want.TwinID || event.Event != want.Event || event.Reason != want.Reason {
+			t.Errorf("expect event %v, but got %v", want, *event)
+		}
+		if event.Timestamp == 0 {
+			t.Errorf("event should have timestamp")
+		}
+	}
+}
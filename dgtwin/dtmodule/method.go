@@ -0,0 +1,207 @@
+package dtmodule
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/trace"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+// methodCall is an invocation which waits for the result from device.
+type methodCall struct {
+	requester	*model.Message
+	twinID		string
+	method		string
+	deadline	time.Time
+}
+
+// MethodModule invoke the methods of devices (e.g. reboot, calibrate), the
+// invocation is delivered to device@<id> and the result of device is replied
+// to the caller. the method may be not idempotent, so it's sent once without
+// retry of comm module, and it's failed if no result in its own timeout.
+type MethodModule struct {
+	// module name
+	name			string
+	context			*dtcontext.DTContext
+	//for msg communication
+	recieveChan		chan interface{}
+	// for module's health check.
+	heartBeatChan	chan interface{}
+	confirmChan		chan interface{}
+	// invocations which wait for result, key is the ID of message to device.
+	calls			map[string]*methodCall
+}
+
+func NewMethodModule() *MethodModule {
+	return &MethodModule{name: types.DGTWINS_MODULE_METHOD}
+}
+
+func (mm *MethodModule) Name() string {
+	return mm.name
+}
+
+//Init the method module.
+func (mm *MethodModule) InitModule(dtc *dtcontext.DTContext, comm, heartBeat, confirm chan interface{}) {
+	mm.context = dtc
+	mm.recieveChan = comm
+	mm.heartBeatChan = heartBeat
+	mm.confirmChan = confirm
+	mm.calls = make(map[string]*methodCall)
+}
+
+//Start method module
+func (mm *MethodModule) Start() {
+	checkTimeoutCh := time.After(types.DGTWINS_METHOD_CHECK_INTERVAL)
+	//Start loop.
+	for {
+		select {
+		case v, ok := <-mm.recieveChan:
+			if !ok {
+				//channel closed.
+				return
+			}
+
+			if msg, isMsgType := v.(*model.Message); isMsgType {
+				klog.Infof("method message arrived {Header:%v Router:%v-}", msg.Header, msg.Router)
+				start := time.Now()
+				outcome := trace.SPAN_OUTCOME_OK
+				if err := mm.handleMessage(msg); err != nil {
+					klog.Errorf("Handle %s failed (%v), ignored", msg.GetOperation(), err)
+					outcome = trace.SPAN_OUTCOME_ERROR
+				}
+				trace.Record(mm.Name(), msg, start, outcome)
+			}
+		case v, ok := <-mm.heartBeatChan:
+			if !ok {
+				return
+			}
+
+			err := mm.context.HandleHeartBeat(mm.Name(), v.(string))
+			if err != nil {
+				klog.Infof("%s module stopped", mm.Name())
+				return
+			}
+		case <-checkTimeoutCh:
+			mm.dealCallTimeout(time.Now())
+			checkTimeoutCh = time.After(types.DGTWINS_METHOD_CHECK_INTERVAL)
+		}
+	}
+}
+
+func (mm *MethodModule) handleMessage(msg *model.Message) error {
+	switch msg.GetOperation() {
+	case common.DGTWINS_OPS_INVOKE:
+		return mm.invokeHandle(msg)
+	case common.DGTWINS_OPS_RESPONSE:
+		return mm.resultHandle(msg)
+	}
+
+	return errors.New("No this handle for " + msg.GetOperation())
+}
+
+// invokeHandle deliver the invocation to device, and wait for its result.
+// device can't invoke the method.
+func (mm *MethodModule) invokeHandle(msg *model.Message) error {
+	if strings.Contains(msg.GetSource(), common.DGTWINS_RESOURCE_DEVICE) {
+		return nil
+	}
+
+	methodMsg, err := common.UnMarshalMethodMessage(msg)
+	if err != nil {
+		return mm.sendResult(msg, common.BadRequestCode, "Invalid method message", nil)
+	}
+	result := &common.MethodResult{TwinID: methodMsg.TwinID, Method: methodMsg.Method}
+	if methodMsg.Method == "" || methodMsg.Timeout < 0 {
+		return mm.sendResult(msg, common.BadRequestCode, "Invalid method or timeout", result)
+	}
+	if !mm.context.DGTwinIsExist(methodMsg.TwinID) {
+		return mm.sendResult(msg, common.NotFoundCode, "Twin Not found", result)
+	}
+
+	timeout := time.Duration(methodMsg.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = types.DGTWINS_METHOD_TIMEOUT
+		methodMsg.Timeout = int64(timeout / time.Millisecond)
+	}
+	content, err := json.Marshal(methodMsg)
+	if err != nil {
+		return err
+	}
+
+	deviceMsg := common.BuildModelMessage(types.MODULE_NAME, "device@"+methodMsg.TwinID,
+						common.DGTWINS_OPS_INVOKE, common.DGTWINS_RESOURCE_METHOD, content)
+	trace.Propagate(msg, deviceMsg)
+	mm.calls[deviceMsg.GetID()] = &methodCall{
+		requester:	msg,
+		twinID:		methodMsg.TwinID,
+		method:		methodMsg.Method,
+		deadline:	time.Now().Add(timeout),
+	}
+	klog.Infof("Invoke method %s of twin (%s), timeout %v", methodMsg.Method, methodMsg.TwinID, timeout)
+	mm.context.Send(common.BusModuleName, deviceMsg)
+
+	return nil
+}
+
+// resultHandle reply the result of device to the caller, the result
+// is correlated with the invocation by the tag.
+func (mm *MethodModule) resultHandle(msg *model.Message) error {
+	call, exist := mm.calls[msg.GetTag()]
+	if !exist {
+		klog.Infof("No invocation waits for result (%s), Ignored", msg.GetTag())
+		return nil
+	}
+	resp, err := common.UnMarshalDeviceMethodResponseMessage(msg)
+	if err == nil && resp.TwinID != "" && resp.TwinID != call.twinID {
+		return errors.New("result of " + call.twinID + " from " + resp.TwinID)
+	}
+	delete(mm.calls, msg.GetTag())
+	mm.context.MarkAlive(call.twinID, true)
+
+	result := &common.MethodResult{TwinID: call.twinID, Method: call.method}
+	if err != nil {
+		return mm.sendResult(call.requester, common.InternalErrorCode, "Invalid result from device", result)
+	}
+	code, err := strconv.Atoi(resp.Code)
+	if err != nil {
+		return mm.sendResult(call.requester, common.InternalErrorCode, "Invalid result code from device", result)
+	}
+	result.Result = resp.Result
+
+	return mm.sendResult(call.requester, code, resp.Reason, result)
+}
+
+// dealCallTimeout fail the invocations which have no result before deadline.
+func (mm *MethodModule) dealCallTimeout(now time.Time) {
+	for msgID, call := range mm.calls {
+		if now.Before(call.deadline) {
+			continue
+		}
+
+		delete(mm.calls, msgID)
+		klog.Warningf("### Method %s of twin (%s) is timeout", call.method, call.twinID)
+		result := &common.MethodResult{TwinID: call.twinID, Method: call.method}
+		reason := fmt.Sprintf("No result from device@%s before timeout", call.twinID)
+		if err := mm.sendResult(call.requester, common.DeliveryFailedCode, reason, result); err != nil {
+			klog.Errorf("Send timeout of method %s failed (%v)", call.method, err)
+		}
+	}
+}
+
+func (mm *MethodModule) sendResult(requester *model.Message, code int, reason string, result *common.MethodResult) error {
+	msgContent, err := common.BuildMethodResponseMessage(code, reason, result)
+	if err != nil {
+		return err
+	}
+	mm.context.SendResponseMessage(requester, msgContent)
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package dtmodule
+
+import (
+	"time"
+	"testing"
+	"encoding/json"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/beehive/pkg/core/context"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+func TestMethodInvoke(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	ctx.AddModule(common.BusModuleName)
+	dtcontext := dtcontext.NewDTContext(ctx)
+	comm := make(chan interface{}, 128)
+	dtcontext.CommChan[types.DGTWINS_MODULE_COMM] = comm
+	methodModule := NewMethodModule()
+	methodModule.InitModule(dtcontext, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+	dtcontext.DGTwinList.Store("dev001", &common.DigitalTwin{ID: "dev001"})
+
+	// invoke the method of unknown twin.
+	content, _ := json.Marshal(&common.MethodMessage{TwinID: "dev002", Method: "reboot"})
+	invokeMsg := dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME,
+					common.DGTWINS_OPS_INVOKE, common.DGTWINS_RESOURCE_METHOD, content)
+	methodModule.handleMessage(invokeMsg)
+	if resp := GetDTResponse(<-comm); resp == nil || resp.Code != common.NotFoundCode {
+		t.Fatalf("invoke should be failed for unknown twin")
+	}
+
+	// the result of device is replied to the caller.
+	content, _ = json.Marshal(&common.MethodMessage{TwinID: "dev001", Method: "reboot",
+								Params: json.RawMessage(`{"delay":1}`)})
+	invokeMsg = dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME,
+					common.DGTWINS_OPS_INVOKE, common.DGTWINS_RESOURCE_METHOD, content)
+	if err := methodModule.handleMessage(invokeMsg); err != nil {
+		t.Fatalf("invoke failed (%v)", err)
+	}
+	v, _ := ctx.Receive(common.BusModuleName)
+	deviceMsg := GetModelMessage(v)
+	if deviceMsg.GetTarget() != "device@dev001" || deviceMsg.GetOperation() != common.DGTWINS_OPS_INVOKE {
+		t.Fatalf("unexpected device message (%v)", deviceMsg)
+	}
+	methodMsg, err := common.UnMarshalMethodMessage(deviceMsg)
+	if err != nil || methodMsg.Method != "reboot" || string(methodMsg.Params) != `{"delay":1}` ||
+			methodMsg.Timeout != int64(types.DGTWINS_METHOD_TIMEOUT/time.Millisecond) {
+		t.Fatalf("unexpected method message (%v)", methodMsg)
+	}
+
+	content, _ = json.Marshal(&common.DeviceMethodResponse{Code: "200", Result: json.RawMessage(`{"done":true}`)})
+	resultMsg := dtcontext.BuildModelMessage("device", types.MODULE_NAME,
+					common.DGTWINS_OPS_RESPONSE, common.DGTWINS_RESOURCE_METHOD, content)
+	resultMsg.SetTag(deviceMsg.GetID())
+	methodModule.handleMessage(resultMsg)
+	message := GetModelMessage(<-comm)
+	resp := GetDTResponse(message)
+	if message.GetTag() != invokeMsg.GetID() || resp == nil || resp.Code != common.RequestSuccessCode ||
+			resp.Method == nil || string(resp.Method.Result) != `{"done":true}` {
+		t.Fatalf("unexpected method result (%v)", resp)
+	}
+	if len(methodModule.calls) != 0 {
+		t.Errorf("invocation should be done after result")
+	}
+
+	// invocation is failed after its own timeout.
+	content, _ = json.Marshal(&common.MethodMessage{TwinID: "dev001", Method: "calibrate", Timeout: 50})
+	invokeMsg = dtcontext.BuildModelMessage("edge/app", types.MODULE_NAME,
+					common.DGTWINS_OPS_INVOKE, common.DGTWINS_RESOURCE_METHOD, content)
+	methodModule.handleMessage(invokeMsg)
+	ctx.Receive(common.BusModuleName)
+	methodModule.dealCallTimeout(time.Now())
+	if len(comm) != 0 {
+		t.Fatalf("invocation should not be timeout before deadline")
+	}
+	methodModule.dealCallTimeout(time.Now().Add(50*time.Millisecond))
+	message = GetModelMessage(<-comm)
+	resp = GetDTResponse(message)
+	if message.GetTag() != invokeMsg.GetID() || resp == nil || resp.Code != common.DeliveryFailedCode {
+		t.Fatalf("invocation should be timeout (%v)", resp)
+	}
+	if len(methodModule.calls) != 0 {
+		t.Errorf("invocation should be done after timeout")
+	}
+}
@@ -1,19 +1,22 @@
 package dtmodule
 
 import (
+	"fmt"
+	"time"
 	"errors"
 	"strings"
-	_"strconv"
+	"strconv"
 	"k8s.io/klog"
 	"encoding/json"
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/edgeOn/dgtwin/types"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
 )
 
 type PropertyCmdFunc  func(msg *model.Message ) error
-type PropActionHandle func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin) error	
+type PropActionHandle func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin, resp *batchResponse) error	
 type PropertyModule struct {
 	// module name
 	name			string
@@ -38,10 +41,11 @@ func (pm *PropertyModule) initPropertyCmdTbl() {
 	pm.propertyCmdTbl = make(map[string]PropertyCmdFunc)
 
 	pm.propertyCmdTbl[common.DGTWINS_OPS_UPDATE] = pm.propUpdateHandle
-	//pm.propertyCmdTbl[common.DGTWINS_OPS_DELETE] = pm.propDeleteHandle
-	//pm.propertyCmdTbl[common.DGTWINS_OPS_GET] = pm.propGetHandle
+	pm.propertyCmdTbl[common.DGTWINS_OPS_DELETE] = pm.propDeleteHandle
+	pm.propertyCmdTbl[common.DGTWINS_OPS_GET] = pm.propGetHandle
 	pm.propertyCmdTbl[common.DGTWINS_OPS_WATCH] = pm.propWatchHandle
 	pm.propertyCmdTbl[common.DGTWINS_OPS_SYNC] = pm.propSyncHandle
+	pm.propertyCmdTbl[common.DGTWINS_OPS_HISTORY] = pm.propHistoryHandle
 	pm.propertyCmdTbl[common.DGTWINS_OPS_RESPONSE] = pm.propResponseHandle
 }
 
@@ -67,14 +71,19 @@ func (pm *PropertyModule) Start() {
 			if isMsgType {
 				klog.Infof("property message arrived {Header:%v Router:%v-}", 
 												message.Header, message.Router)
+				start := time.Now()
+				outcome := trace.SPAN_OUTCOME_OK
 				if fn, exist := pm.propertyCmdTbl[message.GetOperation()]; exist {
 					err := fn(message)
 					if err != nil {
 						klog.Errorf("Handle failed, ignored (%v)", message)
+						outcome = trace.SPAN_OUTCOME_ERROR
 					}
 				}else {
 					klog.Errorf("No this handle for %s, ignored", message.GetOperation())
+					outcome = trace.SPAN_OUTCOME_DROPPED
 				}
+				trace.Record(pm.Name(), message, start, outcome)
 			}
 		case v, ok := <-pm.heartBeatChan:
 			if !ok {
@@ -91,266 +100,432 @@ func (pm *PropertyModule) Start() {
 }
 
 //propUpdateHandle: handle update property. 
+// if the twin or property version is given in request, it must be equal
+// to the saved version, or the update will be rejected with ConflictCode.
 func (pm *PropertyModule) propUpdateHandle(msg *model.Message ) error {
-	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin) error{
+	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin, resp *batchResponse) error{
 		//savedTwin and msgTwin are always != nil
 		twinID := savedTwin.ID 
-		pm.context.Lock(twinID)
+		if !pm.context.LockTwin(savedTwin) {
+			return sendTwinNotFound(resp, msgTwin)
+		}
 		
 		if savedTwin.Properties.Desired == nil {
 			savedTwin.Properties.Desired = make(map[string]*common.TwinProperty)
 		}
 
-		//if msgTwin.Properties != nil {
 		savedDesired  := savedTwin.Properties.Desired	
 		newDesired := msgTwin.Properties.Desired
+		if conflictTwin := checkVersion(savedTwin, msgTwin); conflictTwin != nil {
+			pm.context.Unlock(twinID)
+			return sendConflictResult(resp, conflictTwin)
+		}
+		devModel := pm.context.GetModel(savedTwin.Model)
+		if results := checkPropertyValues(devModel, twinID, common.TWIN_PROP_KIND_DESIRED, savedDesired, newDesired); len(results) > 0 {
+			pm.context.Unlock(twinID)
+			return sendBadValueResult(resp, savedTwin, results)
+		}
+
 		notifyDesired := make([]common.TwinProperty, 0)
+		respTwin := DumpDigitalTwin(savedTwin)
+		respTwin.Properties.Desired = make(map[string]*common.TwinProperty)
+		if len(newDesired) > 0 {
+			savedTwin.Version++
+			respTwin.Version = savedTwin.Version
+		}
 			
 		//Update twin property.
-		for _ , prop := range newDesired {
-			savedDesired[prop.Name] = prop
-			notifyDesired = append(notifyDesired, *prop)
-		}
-		//}	
-		pm.context.Unlock(twinID)
-
-		//Send the response
-		msgRespWhere := msg.GetSource()
-		twins := []common.DigitalTwin{*msgTwin}
-
-		if strings.Compare(msgRespWhere, types.MODULE_NAME) != 0 {
-			msgContent, err := common.BuildResponseMessage(common.RequestSuccessCode, "Success", twins)
+		for name, prop := range newDesired {
+			if prop == nil {
+				continue
+			}
+			newProp := *prop
+			newProp.Name = name
+			newProp.Type = propertyType(devModel, savedDesired, &newProp)
+			newProp.Version = nextPropertyVersion(savedDesired, name)
+			// a new desired value restart the reconciliation.
+			newProp.Status = ""
+			pm.context.RecordPropertyAudit(msg, twinID, common.TWIN_PROP_KIND_DESIRED, name, savedDesired[name], &newProp)
+			savedDesired[name] = &newProp
+			refreshDesiredStatus(savedTwin, name)
+			notifyDesired = append(notifyDesired, newProp)
+			respProp := newProp
+			respTwin.Properties.Desired[name] = &respProp
+
+			err := pm.context.SaveProperty(savedTwin, common.TWIN_PROP_KIND_DESIRED, name, &newProp)
 			if err != nil {
-				return err
-			}else{
-				//send the msg to comm module and process it
-				pm.context.SendResponseMessage(msg, msgContent)
+				klog.Errorf("Save property (%s/%s) failed (%v)", twinID, name, err)
 			}
 		}
+		pm.context.Unlock(twinID)
+
+		twins := []common.DigitalTwin{*respTwin}
+		resp.add(twinID, common.RequestSuccessCode, "Success", twins, nil)
 
 		// notify the device.
 		devTwin := &common.DeviceTwin{ID : twinID}
 		devTwin.Properties.Desired = notifyDesired
-		pm.context.SendMessage2Device(common.DGTWINS_OPS_UPDATE, devTwin)
+		resp.deferAction(func() {
+			pm.context.SendRequestMessage2Device(msg, common.DGTWINS_OPS_UPDATE, devTwin)
+		})
 
 		return nil
 	})
 }
 
+// checkVersion check the expected twin and property versions in request message,
+// return the twin with current versions if any version is stale, or nil.
+func checkVersion(savedTwin, msgTwin *common.DigitalTwin) *common.DigitalTwin {
+	conflict := msgTwin.Version != 0 && msgTwin.Version != savedTwin.Version
+	conflictTwin := DumpDigitalTwin(savedTwin)
+
+	check := func(saved, props map[string]*common.TwinProperty) map[string]*common.TwinProperty {
+		current := make(map[string]*common.TwinProperty)
+		for name, prop := range props {
+			if prop == nil || prop.Version == 0 {
+				continue
+			}
+			savedProp, exist := saved[name]
+			if exist && savedProp != nil && savedProp.Version == prop.Version {
+				continue
+			}
+
+			conflict = true
+			currentProp := common.TwinProperty{Name: name}
+			if exist && savedProp != nil {
+				currentProp = *savedProp
+			}
+			current[name] = &currentProp
+		}
+		if len(current) < 1 {
+			return nil
+		}
+		return current
+	}
+	conflictTwin.Properties.Desired = check(savedTwin.Properties.Desired, msgTwin.Properties.Desired)
+	conflictTwin.Properties.Reported = check(savedTwin.Properties.Reported, msgTwin.Properties.Reported)
+
+	if !conflict {
+		return nil
+	}
+
+	return conflictTwin
+}
+
+// nextPropertyVersion return the new version of the property in saved properties.
+func nextPropertyVersion(saved map[string]*common.TwinProperty, name string) uint64 {
+	if prop, exist := saved[name]; exist && prop != nil {
+		return prop.Version + 1
+	}
+
+	return 1
+}
+
+// declaredType return the declared type of the property, the type in device
+// model is used if the twin has model, and then the type of saved property.
+func declaredType(devModel *common.DeviceModel, saved map[string]*common.TwinProperty, name string) string {
+	if devModel != nil {
+		if schema := devModel.GetProperty(name); schema != nil {
+			return schema.Type
+		}
+	}
+	if savedProp, exist := saved[name]; exist && savedProp != nil {
+		return savedProp.Type
+	}
+
+	return ""
+}
+
+// propertyType return the type of the property, it's the declared type,
+// or the type in request for the new property.
+func propertyType(devModel *common.DeviceModel, saved map[string]*common.TwinProperty, prop *common.TwinProperty) string {
+	if declared := declaredType(devModel, saved, prop.Name); declared != "" {
+		return declared
+	}
+
+	return prop.Type
+}
+
+// checkProperty check the property value against its declared type, and the
+// declaration, writability and range in device model if the twin has model.
+// the request can't change the declared type.
+func checkProperty(devModel *common.DeviceModel, kind string, saved map[string]*common.TwinProperty, prop *common.TwinProperty) error {
+	if declared := declaredType(devModel, saved, prop.Name); prop.Type != "" && declared != "" && prop.Type != declared {
+		return fmt.Errorf("type %s mismatches the declared type %s", prop.Type, declared)
+	}
+	if devModel == nil {
+		return common.ValidatePropertyValue(propertyType(nil, saved, prop), prop.Value)
+	}
+
+	schema := devModel.GetProperty(prop.Name)
+	if schema == nil {
+		return fmt.Errorf("property is not declared in model (%s)", devModel.Name)
+	}
+	if kind == common.TWIN_PROP_KIND_DESIRED && schema.ReadOnly {
+		return fmt.Errorf("property is read-only in model (%s)", devModel.Name)
+	}
+
+	return schema.Validate(prop.Value)
+}
+
+// checkPropertyValues check each property in request, return the BadRequest
+// result for each mismatched property.
+func checkPropertyValues(devModel *common.DeviceModel, twinID, kind string, saved, props map[string]*common.TwinProperty) []common.PropertyResult {
+	results := make([]common.PropertyResult, 0)
+
+	for name, prop := range props {
+		if prop == nil {
+			continue
+		}
+		checkProp := *prop
+		checkProp.Name = name
+		if err := checkProperty(devModel, kind, saved, &checkProp); err != nil {
+			results = append(results, common.PropertyResult{
+				TwinID:	twinID,
+				Kind:	kind,
+				Name:	name,
+				Code:	common.BadRequestCode,
+				Reason:	err.Error(),
+			})
+		}
+	}
+
+	return results
+}
+
+// sendBadValueResult reply the BadRequest with the mismatched properties.
+func sendBadValueResult(resp *batchResponse, savedTwin *common.DigitalTwin, results []common.PropertyResult) error {
+	reason := "Invalid property value"
+	if len(results) == 1 {
+		reason = fmt.Sprintf("Invalid property (%s): %s", results[0].Name, results[0].Reason)
+	}
+
+	twins := []common.DigitalTwin{twinSummary(savedTwin)}
+	resp.add(savedTwin.ID, common.BadRequestCode, reason, twins, results)
+
+	return nil
+}
+
+// sendTwinNotFound add the result of twin which is deleted before it's locked.
+func sendTwinNotFound(resp *batchResponse, msgTwin *common.DigitalTwin) error {
+	twins := []common.DigitalTwin{*msgTwin}
+	resp.add(msgTwin.ID, common.NotFoundCode, "Twin Not found", twins, nil)
+
+	return nil
+}
+
+func sendConflictResult(resp *batchResponse, conflictTwin *common.DigitalTwin) error {
+	twins := []common.DigitalTwin{*conflictTwin}
+	resp.add(conflictTwin.ID, common.ConflictCode, "Version conflict", twins, nil)
+
+	return nil
+}
+
 //propDeleteHandle: delete property
+// remove the requested desired and reported properties from the twin, and
+// notify the device to drop these properties. the property which is not
+// exist will has a NotFound result in the response.
 func (pm *PropertyModule) propDeleteHandle(msg *model.Message ) error {
-	return pm.handleMessage(msg, func(msg *model.Message, savedTwin,msgTwin *common.DigitalTwin) error{
-		/*twinID := savedTwin.ID 
-		pm.context.Lock(twinID)
-		
-		savedDesired  := savedTwin.Properties.Desired
-		savedReported := savedTwin.Properties.Reported		
+	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin, resp *batchResponse) error{
+		twinID := savedTwin.ID 
 		newDesired := msgTwin.Properties.Desired
 		newReported := msgTwin.Properties.Reported
-		
-		if newDesired != nil && len(newDesired) > 0 {
-			if savedDesired == nil {
-				pm.context.Unlock(twinID)
-				pm.sendNotFoundPropMessage(msg, msgTwin)
-				return nil
-			}
 
-			for _ , prop := range newDesired {
-				if _, exist := savedDesired[prop.Name]; !exist {
-					pm.context.Unlock(twinID)
-					pm.sendNotFoundPropMessage(msg, msgTwin)
-					return nil
-				}
-				delete(savedDesired, prop.Name)
-			}
+		if len(newDesired) < 1 && len(newReported) < 1 {
+			twins := []common.DigitalTwin{*msgTwin}
+			resp.add(twinID, common.BadRequestCode, "No property to delete", twins, nil)
+			return nil
 		}
-		
-		if newReported != nil && len(newReported) > 0 {
-			if savedReported == nil {
-				pm.context.Unlock(twinID)
-				pm.sendNotFoundPropMessage(msg, msgTwin)
-				return nil
-			}
 
-			for _ , prop := range newReported {
-				if _, exist := savedReported[prop.Name]; !exist {
-					pm.context.Unlock(twinID)
-					pm.sendNotFoundPropMessage(msg, msgTwin)
-					return nil
-				}
-				delete(savedReported, prop.Name)
-			}
+		if !pm.context.LockTwin(savedTwin) {
+			return sendTwinNotFound(resp, msgTwin)
+		}
+		if conflictTwin := checkVersion(savedTwin, msgTwin); conflictTwin != nil {
+			pm.context.Unlock(twinID)
+			return sendConflictResult(resp, conflictTwin)
 		}
-		pm.context.Unlock(twinID)
 
-		twins := []common.DeviceTwin{*msgTwin}
-		msgContent, err := common.BuildResponseMessage(common.RequestSuccessCode, "Success", twins)
-		if err != nil {
-			return err
+		respTwin := DumpDigitalTwin(savedTwin)
+		results := make([]common.PropertyResult, 0)
+		results = append(results, notFoundResults(twinID, common.TWIN_PROP_KIND_DESIRED,
+								savedTwin.Properties.Desired, newDesired)...)
+		results = append(results, notFoundResults(twinID, common.TWIN_PROP_KIND_REPORTED,
+								savedTwin.Properties.Reported, newReported)...)
+		respTwin.Properties.Desired = pm.deleteProperties(savedTwin, common.TWIN_PROP_KIND_DESIRED, 
+								savedTwin.Properties.Desired, newDesired)
+		respTwin.Properties.Reported = pm.deleteProperties(savedTwin, common.TWIN_PROP_KIND_REPORTED, 
+								savedTwin.Properties.Reported, newReported)
+		respTwin.Version = savedTwin.Version
+		for name, prop := range respTwin.Properties.Desired {
+			pm.context.RecordPropertyAudit(msg, twinID, common.TWIN_PROP_KIND_DESIRED, name, prop, nil)
 		}
-			
-		//send the msg to comm module and process it
-		pm.context.SendResponseMessage(msg, msgContent)
+		for name, prop := range respTwin.Properties.Reported {
+			pm.context.RecordPropertyAudit(msg, twinID, common.TWIN_PROP_KIND_REPORTED, name, prop, nil)
+		}
+		pm.context.Unlock(twinID)
+
+		twins := []common.DigitalTwin{*respTwin}
+		resp.add(twinID, common.RequestSuccessCode, "Deleted", twins, results)
 		
 		//send delete to device.  
-		if (newReported != nil && len(newReported) > 0 ) || 
-					(newDesired != nil && len(newDesired) > 0 ) {
-			pm.context.SendMessage2Device(common.DGTWINS_OPS_DELETE, msgTwin)
-		}*/
+		if len(respTwin.Properties.Desired) > 0 || len(respTwin.Properties.Reported) > 0 {
+			devTwin := &common.DeviceTwin{ID : twinID}
+			for name, _ := range respTwin.Properties.Desired {
+				devTwin.Properties.Desired = append(devTwin.Properties.Desired, common.TwinProperty{Name: name})
+			}
+			for name, _ := range respTwin.Properties.Reported {
+				devTwin.Properties.Reported = append(devTwin.Properties.Reported, common.TwinProperty{Name: name})
+			}
+			resp.deferAction(func() {
+				pm.context.SendRequestMessage2Device(msg, common.DGTWINS_OPS_DELETE, devTwin)
+			})
+		}
 		
 		return nil
 	})
-	
+}
+
+// deleteProperties delete the properties in names from saved properties,
+// and return the deleted properties.
+func (pm *PropertyModule) deleteProperties(savedTwin *common.DigitalTwin, kind string, saved, names map[string]*common.TwinProperty) map[string]*common.TwinProperty {
+	deleted := make(map[string]*common.TwinProperty)
+
+	for name, _ := range names {
+		prop, exist := saved[name]
+		if !exist {
+			continue
+		}
+
+		delete(saved, name)
+		deleted[name] = prop
+		if kind == common.TWIN_PROP_KIND_REPORTED {
+			pm.context.DeleteHistory(savedTwin.ID, name)
+		}
+		savedTwin.Version++
+		err := pm.context.SaveProperty(savedTwin, kind, name, nil)
+		if err != nil {
+			klog.Errorf("Delete property (%s/%s) failed (%v)", savedTwin.ID, name, err)
+		}
+	}
+
+	if len(deleted) < 1 {
+		return nil
+	}
+
+	return deleted
 }
 
 //propGetHandle: Get property.
+// return the requested desired and reported properties, if no property is
+// requested, return all properties of this twin. the property which is not
+// exist will has a NotFound result in the response.
 func (pm *PropertyModule) propGetHandle (msg *model.Message ) error {
-	
-	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin) error{
-		/*twinID := savedTwin.ID 
-		
-		pm.context.Lock(twinID)
-		savedDesired  := savedTwin.Properties.Desired
-		savedReported := savedTwin.Properties.Reported		
+	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin, resp *batchResponse) error{
+		twinID := savedTwin.ID 
+		results := make([]common.PropertyResult, 0)
+
+		if !pm.context.LockTwin(savedTwin) {
+			return sendTwinNotFound(resp, msgTwin)
+		}
+		respTwin := DumpDigitalTwin(savedTwin)
 		newDesired := msgTwin.Properties.Desired
 		newReported := msgTwin.Properties.Reported
 
-		desiredProps := make([]common.TwinProperty, 0)
-		if newDesired != nil && len(newDesired) > 0 {
-			if savedDesired == nil {
-				pm.context.Unlock(twinID)
-				pm.sendNotFoundPropMessage(msg, msgTwin)
-				return nil
-			}
-
-			for _, prop := range newDesired {
-				if value, exist := savedDesired[prop.Name]; !exist {
-					desiredProps = append(desiredProps, common.TwinProperty{Name: prop.Name})
-					msgTwin.Properties.Desired = desiredProps
-					msgTwin.Properties.Reported = nil
-					msgTwin.State = savedTwin.State 
-					
-					pm.context.Unlock(twinID)
-
-					pm.sendNotFoundPropMessage(msg, msgTwin)
-					return nil
-				}else {
-					desiredProps = append(desiredProps, *value)
-				}
-			}
+		if len(newDesired) < 1 && len(newReported) < 1 {
+			//Get all properties.
+			savedDesired := savedTwin.Properties.Desired
+			savedReported := savedTwin.Properties.Reported
+			respTwin.Properties.Desired = copyProperties(savedDesired, savedDesired)
+			respTwin.Properties.Reported = copyProperties(savedReported, savedReported)
+		}else {
+			respTwin.Properties.Desired = copyProperties(savedTwin.Properties.Desired, newDesired)
+			respTwin.Properties.Reported = copyProperties(savedTwin.Properties.Reported, newReported)
+			results = append(results, notFoundResults(twinID, common.TWIN_PROP_KIND_DESIRED,
+									savedTwin.Properties.Desired, newDesired)...)
+			results = append(results, notFoundResults(twinID, common.TWIN_PROP_KIND_REPORTED,
+									savedTwin.Properties.Reported, newReported)...)
 		}
-		
-		reportedProps := make([]common.TwinProperty, 0)
-		if newReported != nil && len(newReported) > 0 {
-			if savedReported == nil {
-				pm.context.Unlock(twinID)
-				pm.sendNotFoundPropMessage(msg, msgTwin)
-				return nil
-			}
+		pm.context.Unlock(twinID)
 
-			for _, prop := range newReported {
-				if value, exist := savedReported[prop.Name]; !exist {
-					reportedProps = append(reportedProps, common.TwinProperty{Name: prop.Name})
-					msgTwin.Properties.Reported = reportedProps
-					msgTwin.Properties.Desired = nil
-					msgTwin.State = savedTwin.State 
-					
-					pm.context.Unlock(twinID)
-	
-					//Not found this message.
-					pm.sendNotFoundPropMessage(msg, msgTwin)
-					
-					return nil
-				}else {
-					reportedProps = append(reportedProps, *value)
-				}	
-			}
-		}
+		twins := []common.DigitalTwin{*respTwin}
+		resp.add(twinID, common.RequestSuccessCode, "Get", twins, results)
 
-			
-		msgTwin.Properties.Desired = desiredProps
-		msgTwin.Properties.Reported = reportedProps
-		msgTwin.State = savedTwin.State
+		return nil
+	})
+}
 
-		pm.context.Unlock(twinID)
+// copyProperties copy the properties in names from saved properties.
+func copyProperties(saved, names map[string]*common.TwinProperty) map[string]*common.TwinProperty {
+	props := make(map[string]*common.TwinProperty)
 
-		twins := []common.DeviceTwin{*msgTwin}
-		msgContent, err := common.BuildResponseMessage(common.RequestSuccessCode, "Success", twins)
-		if err != nil {
-			return err
+	for name, _ := range names {
+		if prop, exist := saved[name]; exist && prop != nil {
+			value := *prop
+			props[name] = &value
 		}
-		pm.context.SendResponseMessage(msg, msgContent)			
-		*/
+	}
+
+	if len(props) < 1 {
 		return nil
-	})
-	
+	}
+
+	return props
+}
+
+// notFoundResults build the NotFound result for each property in names
+// but not in saved properties.
+func notFoundResults(twinID, kind string, saved, names map[string]*common.TwinProperty) []common.PropertyResult {
+	results := make([]common.PropertyResult, 0)
+
+	for name, _ := range names {
+		if prop, exist := saved[name]; !exist || prop == nil {
+			results = append(results, common.PropertyResult{
+				TwinID:	twinID,
+				Kind:	kind,
+				Name:	name,
+				Code:	common.NotFoundCode,
+				Reason:	"Property not found",
+			})
+		}
+	}
+
+	return results
 }
 
 // propWatchHandle: handle property watch.
 // We don't know we send the property's update to who , since there are 2 reciever(cloud and edge/app)
 // So reciever must call watch to recieve these twin properties 's update.
 // If Properties is nil or no  properties in request message, we consider it to watch all properties of 
-// this twin.
+// this twin. the watcher can close the watch by reply the sync message with CloseWatchCode.
 func (pm *PropertyModule) propWatchHandle (msg *model.Message ) error {
-	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin) error{
-		/*twinID := savedTwin.ID 
-		if savedTwin.Properties == nil || len(savedTwin.Properties.Reported) < 1 {
-			pm.sendNotFoundPropMessage(msg, msgTwin)
-		}else {
-			watchEvent := types.CreateWatchEvent(msg.GetID(), twinID, msg.GetSource(), msg.GetResource())
-
-			pm.context.Lock(twinID)
-
-			savedReported := savedTwin.Properties.Reported	
-			reportedProps := make(map[string]*types.PropertyValue)
-
-			if msgTwin.Properties == nil || len(msgTwin.Properties.Reported) < 1 {
-				reportedProps = savedReported
-				for propName, _ := range savedReported {
-					watchEvent.List = append(watchEvent.List, propName)
-				}
-			}else {	
-				newReported := msgTwin.Properties.Reported
-			
-				for propName, _:= range newReported {
-					if value, exist := savedReported[propName]; !exist {
-						reportedProps[propName] = nil
-						twinProperties:= &types.TwinProperties{
-							Reported: reportedProps,
-						}
-						msgTwin.Properties = twinProperties
-						msgTwin.State = savedTwin.State 
-					
-						pm.context.Unlock(twinID)
-	
-						pm.sendNotFoundPropMessage(msg, msgTwin)						
-
-						return nil
-					}else {
-						watchEvent.List = append(watchEvent.List, propName)
-						reportedProps[propName] = value
-					}
-				}		
-			}
+	return pm.handleMessage(msg, func(msg *model.Message, savedTwin, msgTwin *common.DigitalTwin, resp *batchResponse) error{
+		twinID := savedTwin.ID 
+		watchEvent := types.CreateWatchEvent(msg.GetID(), twinID, msg.GetSource(), msg.GetResource())
+		newReported := msgTwin.Properties.Reported
+		results := make([]common.PropertyResult, 0)
 
-			twinProperties:= &types.TwinProperties{
-				Reported: reportedProps,
+		if !pm.context.LockTwin(savedTwin) {
+			return sendTwinNotFound(resp, msgTwin)
+		}
+		respTwin := DumpDigitalTwin(savedTwin)
+		savedReported := savedTwin.Properties.Reported	
+		if len(newReported) < 1 {
+			respTwin.Properties.Reported = copyProperties(savedReported, savedReported)
+		}else {
+			for propName, _ := range newReported {
+				watchEvent.List = append(watchEvent.List, propName)
 			}
-			msgTwin.Properties = twinProperties
-			msgTwin.State = savedTwin.State
+			respTwin.Properties.Reported = copyProperties(savedReported, newReported)
+			// the property may be reported by device later. 
+			results = notFoundResults(twinID, common.TWIN_PROP_KIND_REPORTED, savedReported, newReported)
+		}
+		pm.context.Unlock(twinID)
 
-			pm.context.Unlock(twinID)
-		
-			twins := []*types.DigitalTwin{msgTwin}
-			msgContent, err := types.BuildResponseMessage(types.RequestSuccessCode, "Success", twins)
-			if err != nil {
-				return err
-			}
-			pm.context.SendResponseMessage(msg, msgContent)
+		//Cache the watch event
+		pm.context.UpdateWatchCache(watchEvent)
 
-			//Cache the watch event
-			pm.context.UpdateWatchCache(watchEvent)
-		}*/
+		twins := []common.DigitalTwin{*respTwin}
+		resp.add(twinID, common.RequestSuccessCode, "Watched", twins, results)
 
 		return nil
 	})
@@ -384,6 +559,7 @@ func (pm *PropertyModule) propSyncHandle (msg *model.Message ) error {
 	
 	exist := pm.context.DGTwinIsExist(twinID)
 	if exist{
+		pm.context.MarkAlive(twinID, true)
 		v, _ := pm.context.DGTwinList.Load(twinID)
 		savedTwin, isDgTwinType  :=v.(*common.DigitalTwin)
 		if !isDgTwinType {
@@ -394,10 +570,16 @@ func (pm *PropertyModule) propSyncHandle (msg *model.Message ) error {
 		}	
 		
 		//1. save the data.
-		pm.context.Lock(twinID)
+		if !pm.context.LockTwin(savedTwin) {
+			klog.Warningf("Twin (%s) is deleted, sync ignored", twinID)
+			return nil
+		}
 		savedReported := savedTwin.Properties.Reported	
 		newReported := devTwin.Properties.Reported
 		syncReportedProps := make(map[string]*common.TwinProperty)
+		invalidTwin := &common.DeviceTwin{ID: twinID}
+		devModel := pm.context.GetModel(savedTwin.Model)
+		invalidReason := ""
 			
 		if newReported != nil && len(newReported) > 0 {
 			if savedReported == nil {
@@ -406,16 +588,43 @@ func (pm *PropertyModule) propSyncHandle (msg *model.Message ) error {
 				return nil
 			}
 
-			for _ , prop := range newReported {
+			for key , _ := range newReported {
+				prop := &newReported[key]
 				if _, ok := savedReported[prop.Name]; ok {
-					savedReported[prop.Name] = &prop
-					syncReportedProps[prop.Name] = &prop
+					if err := checkProperty(devModel, common.TWIN_PROP_KIND_REPORTED, savedReported, prop); err != nil {
+						klog.Warningf("Drop reported property (%s/%s): %v", twinID, prop.Name, err)
+						invalidTwin.Properties.Reported = append(invalidTwin.Properties.Reported, *prop)
+						invalidReason = fmt.Sprintf("Invalid property (%s): %v", prop.Name, err)
+						continue
+					}
+					prop.Type = propertyType(devModel, savedReported, prop)
+					prop.Version = nextPropertyVersion(savedReported, prop.Name)
+					pm.context.RecordPropertyAudit(msg, twinID, common.TWIN_PROP_KIND_REPORTED, prop.Name, savedReported[prop.Name], prop)
+					savedReported[prop.Name] = prop
+					syncReportedProps[prop.Name] = prop
+					pm.context.RecordHistory(twinID, prop)
+					refreshDesiredStatus(savedTwin, prop.Name)
+					savedTwin.Version++
+					err := pm.context.SaveProperty(savedTwin, common.TWIN_PROP_KIND_REPORTED, prop.Name, prop)
+					if err != nil {
+						klog.Errorf("Save property (%s/%s) failed (%v)", twinID, prop.Name, err)
+					}
 				}
 			}
 		}
+		reportedTwin := DumpDigitalTwin(savedTwin)
+		reportedTwin.Properties.Reported = syncReportedProps
 		pm.context.Unlock(twinID)
 
-		//2. send response to device .
+		//2. reject the mismatched properties.
+		if len(invalidTwin.Properties.Reported) > 0 {
+			msgContent, err := common.BuildDeviceResponseMessage(strconv.Itoa(common.BadRequestCode), invalidReason, invalidTwin)
+			if err != nil {
+				return err
+			}
+			pm.context.SendResponse2Device(msg, twinID, msgContent)
+		}
+
 		/*msgContent, err := common.BuildDeviceResponseMessage(strconv.Itoa(common.RequestSuccessCode), "SYNC Success", dgTwin)
 		if err != nil {
 			return err
@@ -423,21 +632,81 @@ func (pm *PropertyModule) propSyncHandle (msg *model.Message ) error {
 		pm.context.SendResponseMessage(msg, msgContent)*/
 
 		//3. Report the Sync result.
-		reportedTwin := DumpDigitalTwin(savedTwin)
-		reportedTwin.Properties.Reported = syncReportedProps
+		pm.notifyWatchers(reportedTwin)
+	}
 
-		reportedTwins := []common.DigitalTwin{*reportedTwin}
-		msgContent, err := common.BuildTwinMessage(reportedTwins)
+	return nil
+}
+
+// propHistoryHandle: query the history of reported properties.
+// return the values in the requested time range, the values are downsampled
+// into buckets (min/max/avg) if interval is given.
+func (pm *PropertyModule) propHistoryHandle (msg *model.Message ) error {
+	historyMsg, err := common.UnMarshalTwinHistoryMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	twinID := historyMsg.TwinID
+	if !pm.context.DGTwinIsExist(twinID) {
+		twins := []common.DigitalTwin{common.DigitalTwin{ID: twinID}}
+		msgContent, err := common.BuildResponseMessage(common.NotFoundCode, "Twin Not found", twins)
 		if err != nil {
 			return err
 		}
-		pm.context.SendSyncMessage(common.CloudName, common.DGTWINS_RESOURCE_PROPERTY, msgContent)
-		pm.context.SendSyncMessage(common.EdgeAppName, common.DGTWINS_RESOURCE_PROPERTY, msgContent)
+		pm.context.SendResponseMessage(msg, msgContent)
+		return nil
 	}
 
+	if historyMsg.Interval < 0 || (historyMsg.End > 0 && historyMsg.Start > historyMsg.End) {
+		msgContent, err := common.BuildResponseMessage(common.BadRequestCode, "Invalid time range", nil)
+		if err != nil {
+			return err
+		}
+		pm.context.SendResponseMessage(msg, msgContent)
+		return nil
+	}
+
+	history := pm.context.QueryHistory(twinID, historyMsg.Names, historyMsg.Start,
+							historyMsg.End, historyMsg.Interval)
+	msgContent, err := common.BuildHistoryResponseMessage(common.RequestSuccessCode, "History", history)
+	if err != nil {
+		return err
+	}
+	pm.context.SendResponseMessage(msg, msgContent)
+
 	return nil
 }
 
+// notifyWatchers send the reported properties to each watcher of this twin,
+// the watcher just recieve the properties it watched.
+func (pm *PropertyModule) notifyWatchers(reportedTwin *common.DigitalTwin) {
+	if len(reportedTwin.Properties.Reported) < 1 {
+		return
+	}
+
+	for _, watchEvent := range pm.context.GetWatchEvents(reportedTwin.ID) {
+		watchedTwin := *reportedTwin
+		watchedTwin.Properties.Reported = make(map[string]*common.TwinProperty)
+		for name, prop := range reportedTwin.Properties.Reported {
+			if watchEvent.IsWatched(name) {
+				watchedTwin.Properties.Reported[name] = prop
+			}
+		}
+		if len(watchedTwin.Properties.Reported) < 1 {
+			continue
+		}
+
+		reportedTwins := []common.DigitalTwin{watchedTwin}
+		msgContent, err := common.BuildTwinMessage(reportedTwins)
+		if err != nil {
+			klog.Errorf("Build sync message failed (%v)", err)
+			continue
+		}
+		pm.context.SendSyncMessage(watchEvent.Source, common.DGTWINS_RESOURCE_PROPERTY, msgContent)
+	}
+}
+
 //handleMessage: General message process handle.
 func (pm *PropertyModule) handleMessage (msg *model.Message, fn PropActionHandle) error {
 	var twinMsg	common.TwinMessage
@@ -452,81 +721,74 @@ func (pm *PropertyModule) handleMessage (msg *model.Message, fn PropActionHandle
 		return err
 	}
 
-	//Currently, we just support a twin's property's list since
-	// we are just only foucus on the proprty's update.
-	if len(twinMsg.Twins) < 1 {
-		klog.Warningf("invalid message format")
-		//TODO:
-	}
-
-	for _, dgTwin := range twinMsg.Twins {
+	// every twin in request is processed, and the result of each twin
+	// is replied in a single response.
+	resp := newBatchResponse()
+	for key, _ := range twinMsg.Twins {
+		dgTwin := &twinMsg.Twins[key]
 		twinID := dgTwin.ID
-		exist := pm.context.DGTwinIsExist(twinID)
-		if !exist {
+		v, _ := pm.context.DGTwinList.Load(twinID)
+		savedTwin, _ := v.(*common.DigitalTwin)
+		if savedTwin == nil {
 			// Device has not created yet.
-			twins := []common.DigitalTwin{dgTwin}
-			msgContent, err := common.BuildResponseMessage(common.NotFoundCode, "Twin Not found", twins)
-			if err != nil {
-				return err
-			}
-			pm.context.SendResponseMessage(msg, msgContent)
-		}else{
-			v, _ := pm.context.DGTwinList.Load(twinID)
-			savedTwin, isDgTwinType  :=v.(*common.DigitalTwin)
-			if !isDgTwinType {
-				return errors.New("invalud digital twin type")
-			}
- 			if savedTwin == nil {
-				return errors.New("savedTwin=nil, Unexpected error")
-			}	
-			return fn(msg, savedTwin, &dgTwin)
+			twins := []common.DigitalTwin{*dgTwin}
+			resp.add(twinID, common.NotFoundCode, "Twin Not found", twins, nil)
+			continue
 		}
-	}
 
-	return nil
-}
-
-// propResponseHandle: handle all response.
-func (pm *PropertyModule) propResponseHandle (msg *model.Message ) error {
-	/*var resp types.DGTwinResponse
+		if err := fn(msg, savedTwin, dgTwin, resp); err != nil {
+			klog.Errorf("Handle twin (%s) failed (%v)", twinID, err)
+			twins := []common.DigitalTwin{*dgTwin}
+			resp.add(twinID, common.InternalErrorCode, err.Error(), twins, nil)
+		}
+	}
 
-	content, ok := msg.Content.([]byte)
-	if !ok {
-		klog.Warningf("error message content format, ignore.")
-		return errors.New("invaliad message content")
+	// the request from dgtwin itself need no response.
+	if strings.Compare(msg.GetSource(), types.MODULE_NAME) == 0 {
+		resp.done()
+		return nil
 	}
 
-	err := json.Unmarshal(content, &resp)
+	var models []common.DeviceModel
+	if msg.GetOperation() == common.DGTWINS_OPS_GET {
+		models = pm.context.GetTwinModels(resp.twins)
+	}
+	msgContent, err := resp.build(models)
 	if err != nil {
 		return err
 	}
-
-	//TODO:
-	// use can closed the watch.	
-
-	if resp.Code != types.RequestSuccessCode {
-		//TODO:
-	}*/
-
-	//Success
-	pm.context.SendToModule(types.DGTWINS_MODULE_COMM, msg)
+	pm.context.SendResponseMessage(msg, msgContent)
+	resp.done()
 
 	return nil
 }
 
-func (pm *PropertyModule) sendNotFoundPropMessage(msg *model.Message, msgTwin *common.DigitalTwin) error {
-	twins := []common.DigitalTwin{*msgTwin}
-	msgContent, err := common.BuildResponseMessage(common.NotFoundCode, "twin No property/No this property", twins)
+// propResponseHandle: handle all response.
+// the watcher can close the watch by reply the CloseWatchCode, the twins in 
+// response are the twins to unwatch, if the twin has reported properties, only these
+// properties are unwatched. 
+func (pm *PropertyModule) propResponseHandle (msg *model.Message ) error {
+	resp, err := common.UnMarshalResponseMessage(msg)
 	if err != nil {
-		return err
+		klog.Warningf("error message content format, ignore.")
+	}else if resp.Code == common.CloseWatchCode {
+		source := msg.GetSource()
+		for _, twin := range resp.Twins {
+			list := make([]string, 0)
+			for name, _ := range twin.Properties.Reported {
+				list = append(list, name)
+			}
+			klog.Infof("%s close the watch of twin (%s) %v", source, twin.ID, list)
+			pm.context.DeleteWatchCache(twin.ID, source, list)
+		}
 	}
-			
-	pm.context.SendResponseMessage(msg, msgContent)
+
+	//Success
+	pm.context.SendToModule(types.DGTWINS_MODULE_COMM, msg)
 
 	return nil
 }
 
-
 func DumpDigitalTwin(twin *common.DigitalTwin) *common.DigitalTwin {
 	if twin == nil {
 		return nil
@@ -536,6 +798,8 @@ func DumpDigitalTwin(twin *common.DigitalTwin) *common.DigitalTwin {
 		ID: twin.ID,
 		State: twin.State,
 		LastState: twin.LastState,
+		Model: twin.Model,
+		Version: twin.Version,
 	}
 
 	return dgTwin
@@ -1,14 +1,18 @@
 package dtmodule
 
 import (
+	"os"
 	"sync"
 	"time"
 	"testing"
 	"strings"
+	"io/ioutil"
 	"encoding/json"
+	"github.com/jwzl/edgeOn/common"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/beehive/pkg/core/context"
 	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtstore"
 	"github.com/jwzl/edgeOn/dgtwin/dtcontext"	
 )
 
@@ -40,7 +44,7 @@ func (pt *PropertyTest) Start() {
 	go propModule.Start()
 }
 
-func (pt *PropertyTest) StroeTwin(dgTwin *types.DigitalTwin){
+func (pt *PropertyTest) StroeTwin(dgTwin *common.DigitalTwin){
 	if  dgTwin != nil {
 		twinID := dgTwin.ID
 		pt.context.DGTwinList.Store(twinID, dgTwin)
@@ -49,17 +53,23 @@ func (pt *PropertyTest) StroeTwin(dgTwin *types.DigitalTwin){
 	}
 }
 
-func (pt *PropertyTest) LoadTwin(twinID string)  *types.DigitalTwin {
+// LoadTwin return a copy of the saved twin, it's copied under the twin
+// lock since the module may be changing the twin.
+func (pt *PropertyTest) LoadTwin(twinID string)  *common.DigitalTwin {
 	v, exist := pt.context.DGTwinList.Load(twinID)
 	if !exist {
 		return nil
 	}
-	savedTwin, isDgTwinType  :=v.(*types.DigitalTwin)
+	savedTwin, isDgTwinType  :=v.(*common.DigitalTwin)
 	if !isDgTwinType {
 		return nil
 	}
 
-	return savedTwin
+	pt.context.Lock(twinID)
+	copied := twinCopy(savedTwin)
+	pt.context.Unlock(twinID)
+
+	return &copied
 }
 
 func TestNewPropertyModule(t *testing.T){
@@ -75,7 +85,7 @@ func TestPropUpdateHandle(t *testing.T){
 	pt.Start()	
 	t.Log("Start test PropUpdateHandle ")
 
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
@@ -86,11 +96,25 @@ func TestPropUpdateHandle(t *testing.T){
 	pt.StroeTwin(dgTwin)
 
 	//update.
-	err := pt.propertyDoHandle("dev001", "reboot", types.DGTWINS_OPS_UPDATE, &types.PropertyValue{Value: "1"}, false)
+	err := pt.propertyDoHandle("dev001", "reboot", common.DGTWINS_OPS_UPDATE, []byte("1"), false)
 	if err != nil {
 		t.Fatal("Update error ")
 	}
-	time.Sleep(10 * time.Millisecond)
+
+	// Check the response, the twin is updated before the response.
+	v, ok := <- pt.commChan
+	if !ok {
+		t.Fatal("Channel has closed..")
+	}
+	response := GetDTResponse(v)
+	if response == nil {
+		t.Fatal("Response error format.")
+	}
+
+	if response.Code !=common.RequestSuccessCode {
+		t.Fatal("Response err")
+	}
+	t.Log("Response okay. ")
 
 	//Load the twin.
 	savedTwin :=pt.LoadTwin("dev001")
@@ -98,15 +122,13 @@ func TestPropUpdateHandle(t *testing.T){
 		t.Fatal("error twin by LoadTwin ")
 	}
 
-	if savedTwin.Properties == nil {
-		t.Fatal("update failed, oldTwin.Properties is empty.")
-	}
-
 	savedDesired  := savedTwin.Properties.Desired
+	if savedDesired == nil {
+		t.Fatal("update failed, oldTwin.Properties.Desired is empty.")
+	}
 
 	if val, exist := savedDesired["reboot"]; exist {
-		a := val.Value.(string)
-		if a != "1" {
+		if string(val.Value) != "1" {
 			t.Fatal("update value is error.")
 		}
 	}else {
@@ -114,100 +136,84 @@ func TestPropUpdateHandle(t *testing.T){
 	}	
 	t.Log("property update success. ")
 
-	// Check the response 
-	v, ok := <- pt.commChan
-	if !ok {
-		t.Fatal("Channel has closed..")
-	}
-	response := GetDTResponse(v)
-	if response == nil {
-		t.Fatal("Response error format.")
-	}
-
-	if response.Code !=types.RequestSuccessCode {
-		t.Fatal("Response err")
-	}
-	t.Log("Response okay. ")
-
 	//Check the message to device.
 	v, ok = <- pt.commChan
 	if !ok {
 		t.Fatal("Channel has closed..")
 	}
-	twins := GetTwins(v)
-	if twins == nil {
-		t.Fatal("No twins")
-	}
-
-	dgTwin = twins[0]
-	if dgTwin == nil {
-		t.Fatal("No twins")
+	devTwin := GetDeviceTwin(v)
+	if devTwin == nil {
+		t.Fatal("No device twin")
 	}
 
-	if dgTwin.ID != "dev001" {
+	if devTwin.ID != "dev001" {
 		t.Fatal("error message")
 	}
 
-	if dgTwin.Properties == nil || dgTwin.Properties.Desired == nil ||
-			len(dgTwin.Properties.Desired) < 1 {
-		t.Fatal("no property")
-	}
-
-	desired := dgTwin.Properties.Desired
-	if val, exist :=desired["reboot"]; !exist {
+	prop := common.GetPropertyValue(devTwin.Properties.Desired, "reboot")
+	if prop == nil || string(prop.Value) != "1" {
 		t.Fatal("error update")
-	}else {
-		if val.Value != "1" {
-			t.Fatal("error update")
-		}
 	}
 	t.Log("device message is okay. ")
 
 	pt.context.StopModule("property")
 }
 
-func GetDTResponse(v interface{})*types.DGTwinResponse{
+func GetDTResponse(v interface{})*common.TwinResponse{
 	message, isMsgType := v.(*model.Message )
 	if !isMsgType {
 		return nil
 	}
 
-	content, ok := message.Content.([]byte)
-	if !ok {
-		return nil
-	}
-
-	var resp types.DGTwinResponse
-	err := json.Unmarshal(content, &resp)
+	resp, err := common.UnMarshalResponseMessage(message)
 	if err != nil {
 		return nil
 	}
 
-	return &resp
+	return resp
 }
 
-func GetDTMessage(v interface{})*types.DGTwinMessage{
+func GetDTMessage(v interface{})*common.TwinMessage{
 	message, isMsgType := v.(*model.Message )
 	if !isMsgType {
 		return nil
 	}
 
-	content, ok := message.Content.([]byte)
-	if !ok {
+	dgTwinMsg, err := common.UnMarshalTwinMessage(message)
+	if err != nil {
 		return nil
 	}
 
-	var dgTwinMsg types.DGTwinMessage
-	err := json.Unmarshal(content, &dgTwinMsg)
+	return dgTwinMsg	
+}
+
+// GetModelMessage return the message sent to comm module, the message
+// to device may be sent with its requester.
+func GetModelMessage(v interface{})*model.Message{
+	if cached, isCachedType := v.(*types.CachedMessage); isCachedType {
+		return cached.Msg
+	}
+	message, _ := v.(*model.Message)
+
+	return message
+}
+
+func GetDeviceTwin(v interface{})*common.DeviceTwin{
+	message := GetModelMessage(v)
+	if message == nil {
+		return nil
+	}
+
+	devMsg, err := common.UnMarshalDeviceMessage(message)
 	if err != nil {
 		return nil
 	}
 
-	return &dgTwinMsg	
+	return &devMsg.Twin
 }
 
-func GetTwins(v interface{})[]*types.DigitalTwin{
-	var twins  []*types.DigitalTwin
+func GetTwins(v interface{})[]common.DigitalTwin{
+	var twins  []common.DigitalTwin
 	message, isMsgType := v.(*model.Message )
 	if !isMsgType {
 		return nil
@@ -215,7 +221,7 @@ func GetTwins(v interface{})[]*types.DigitalTwin{
 	
 	operation := message.GetOperation()
 
-	if strings.Compare(types.DGTWINS_OPS_RESPONSE, operation) == 0 {
+	if strings.Compare(common.DGTWINS_OPS_RESPONSE, operation) == 0 {
 		resp := GetDTResponse(v)
 		if resp ==nil {
 			return nil
@@ -232,24 +238,25 @@ func GetTwins(v interface{})[]*types.DigitalTwin{
 	return twins
 }  
 
-func (pt *PropertyTest) propertyDoHandle(twinID, propName, action string, value *types.PropertyValue, report bool) error{
-	props := &types.TwinProperties{}
+func (pt *PropertyTest) propertyDoHandle(twinID, propName, action string, value []byte, report bool) error{
+	props := make(map[string]*common.TwinProperty)
+	props[propName] = &common.TwinProperty{Name: propName, Value: value}
 
+	twin := common.DigitalTwin{
+		ID:	twinID,
+	}
 	if report {
-		props.Reported = make(map[string]*types.PropertyValue)
-		props.Reported[propName] = value	
+		twin.Properties.Reported = props
 	}else {
-		props.Desired = make(map[string]*types.PropertyValue)
-		props.Desired[propName] = value
+		twin.Properties.Desired = props
 	}
 
-	twin := &types.DigitalTwin{
-		ID:	twinID,
-		Properties: props, 
-	}
+	return pt.sendTwinMessage(action, twin)
+}
 
-	twins := []*types.DigitalTwin{twin}
-	bytes, err := types.BuildTwinMessage(action, twins)
+func (pt *PropertyTest) sendTwinMessage(action string, twin common.DigitalTwin) error{
+	twins := []common.DigitalTwin{twin}
+	bytes, err := common.BuildTwinMessage(twins)
 	if err != nil {
 		return err
 	}
@@ -267,49 +274,31 @@ func TestPropDeleteHandle(t *testing.T){
 	pt.Start()	
 	t.Log("Start test PropDeleteHandle ")
 
-	props := &types.TwinProperties{
-		Desired: map[string]*types.PropertyValue{
-			"on/off":	&types.PropertyValue{Value: "0"},
-			"reboot":	&types.PropertyValue{Value: "1"},
-			"holdon":	&types.PropertyValue{Value: "2"},		
-		},
-	}
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
 		State: "offline",
-		Properties: props, 
+	}
+	dgTwin.Properties.Desired = map[string]*common.TwinProperty{
+		"on/off":	&common.TwinProperty{Name: "on/off", Value: []byte("0")},
+		"reboot":	&common.TwinProperty{Name: "reboot", Value: []byte("1")},
+		"holdon":	&common.TwinProperty{Name: "holdon", Value: []byte("2")},		
 	}
 
 	// Store the twin
 	pt.StroeTwin(dgTwin)
 
 	//Delete.
-	err := pt.propertyDoHandle("dev001", "reboot", types.DGTWINS_OPS_DELETE, nil, false)
+	twin := common.DigitalTwin{ID: "dev001"}
+	twin.Properties.Desired = map[string]*common.TwinProperty{
+		"reboot":	&common.TwinProperty{Name: "reboot"},
+		"nothing":	&common.TwinProperty{Name: "nothing"},
+	}
+	err := pt.sendTwinMessage(common.DGTWINS_OPS_DELETE, twin)
 	if err != nil {
 		t.Fatal("Delete error ")
 	}
-	time.Sleep(5 * time.Millisecond)
-	//Load the twin.
-	savedTwin :=pt.LoadTwin("dev001")
-	if savedTwin == nil {
-		t.Fatal("error twin by LoadTwin ")
-	}
-
-	if savedTwin.Properties == nil {
-		t.Fatal("failed, oldTwin.Properties is empty.")
-	}
-
-	savedDesired  := savedTwin.Properties.Desired
-	if savedDesired  == nil {
-		t.Fatal("Desired is nil.")
-	}
-
-	if _, exist := savedDesired["reboot"]; exist {
-		t.Fatal("Delete error.")
-	}
-	t.Log("Delete sucessful. ")
 	
 	//check the reponse.
 	v, ok := <- pt.commChan
@@ -321,37 +310,47 @@ func TestPropDeleteHandle(t *testing.T){
 		t.Fatal("Response error format.")
 	}
 
-	if response.Code !=types.RequestSuccessCode {
+	if response.Code !=common.RequestSuccessCode {
 		t.Fatal("Response err")
 	}
+	if len(response.Results) != 1 || response.Results[0].Name != "nothing" ||
+			response.Results[0].Code != common.NotFoundCode {
+		t.Fatal("error property result.")
+	}
 	t.Log("Response okay. ")
 
+	//Load the twin.
+	savedTwin :=pt.LoadTwin("dev001")
+	if savedTwin == nil {
+		t.Fatal("error twin by LoadTwin ")
+	}
+
+	savedDesired  := savedTwin.Properties.Desired
+	if _, exist := savedDesired["reboot"]; exist {
+		t.Fatal("Delete error.")
+	}
+	if len(savedDesired) != 2 {
+		t.Fatal("Delete too many properties.")
+	}
+	t.Log("Delete sucessful. ")
+
 	//Check the message to device.
 	v, ok = <- pt.commChan
 	if !ok {
 		t.Fatal("Channel has closed..")
 	}
-	twins := GetTwins(v)
-	if twins == nil {
-		t.Fatal("No twins")
-	}
-
-	dgTwin = twins[0]
-	if dgTwin == nil {
-		t.Fatal("No twins")
+	message := GetModelMessage(v)
+	if message == nil || message.GetOperation() != common.DGTWINS_OPS_DELETE ||
+			message.GetTarget() != "device@dev001" {
+		t.Fatal("error device message")
 	}
-
-	if dgTwin.ID != "dev001" {
+	devTwin := GetDeviceTwin(v)
+	if devTwin == nil || devTwin.ID != "dev001" {
 		t.Fatal("error message")
 	}
 
-	if dgTwin.Properties == nil || dgTwin.Properties.Desired == nil ||
-			len(dgTwin.Properties.Desired) < 1 {
-		t.Fatal("no property")
-	}
-
-	desired := dgTwin.Properties.Desired
-	if _, exist :=desired["reboot"]; !exist {
+	if len(devTwin.Properties.Desired) != 1 ||
+			common.GetPropertyValue(devTwin.Properties.Desired, "reboot") == nil {
 		t.Fatal("error delete")
 	}
 	t.Log("delete device message is okay. ")
@@ -359,32 +358,31 @@ func TestPropDeleteHandle(t *testing.T){
 	pt.context.StopModule("property")
 }
 
-
 func TestPropGetHandle(t *testing.T){
 	pt := NewPropertyTest()
 	pt.Start()	
 	t.Log("Start test PropGetHandle ")
 
-	props := &types.TwinProperties{
-		Desired: map[string]*types.PropertyValue{
-			"on/off":	&types.PropertyValue{Value: "0"},
-			"reboot":	&types.PropertyValue{Value: "1"},
-			"holdon":	&types.PropertyValue{Value: "2"},		
-		},
-	}
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
 		State: "offline",
-		Properties: props, 
+	}
+	dgTwin.Properties.Desired = map[string]*common.TwinProperty{
+		"on/off":	&common.TwinProperty{Name: "on/off", Value: []byte("0")},
+		"reboot":	&common.TwinProperty{Name: "reboot", Value: []byte("1")},
+		"holdon":	&common.TwinProperty{Name: "holdon", Value: []byte("2")},		
+	}
+	dgTwin.Properties.Reported = map[string]*common.TwinProperty{
+		"temp":	&common.TwinProperty{Name: "temp", Value: []byte("25")},
 	}
 
 	// Store the twin
 	pt.StroeTwin(dgTwin)
 
 	//Get.
-	err := pt.propertyDoHandle("dev001", "reboot", types.DGTWINS_OPS_GET, nil, false)
+	err := pt.propertyDoHandle("dev001", "reboot", common.DGTWINS_OPS_GET, nil, false)
 	if err != nil {
 		t.Fatal("Get error ")
 	}
@@ -399,40 +397,40 @@ func TestPropGetHandle(t *testing.T){
 		t.Fatal("Response error format.")
 	}
 
-	if response.Code !=types.RequestSuccessCode {
+	if response.Code !=common.RequestSuccessCode {
 		t.Fatal("Response err")
 	}
-	
-	twins := response.Twins
-	if twins == nil {
+	if len(response.Twins) != 1 {
 		t.Fatal("twins is empty.")
 	}
 	
-	twin := twins[0]
-	if twin == nil {
-		t.Fatal("twin is empty.")
-	}
-
-	property := twin.Properties
-	if property == nil || len(property.Desired) != 1 {
-		t.Fatal("property is nil.")
+	property := response.Twins[0].Properties
+	if len(property.Desired) != 1 || len(property.Reported) != 0 {
+		t.Fatal("property number is error.")
 	}
 	if val, exist := property.Desired["reboot"]; !exist {
 		t.Fatal("property is not exist.")
 	}else {
-		if val.Value != "1" {
+		if string(val.Value) != "1" {
 			t.Fatal("Get error.")		
 		}
 	}
+	if len(response.Results) != 0 {
+		t.Fatal("unexpected property result.")
+	}
 	t.Log("Response okay. ")
 
-	//Check  the error response
-	err = pt.propertyDoHandle("dev001", "fuck", types.DGTWINS_OPS_GET, nil, false)
+	//Check the not found property.
+	twin := common.DigitalTwin{ID: "dev001"}
+	twin.Properties.Desired = map[string]*common.TwinProperty{
+		"reboot":	&common.TwinProperty{Name: "reboot"},
+		"nothing":	&common.TwinProperty{Name: "nothing"},
+	}
+	err = pt.sendTwinMessage(common.DGTWINS_OPS_GET, twin)
 	if err != nil {
 		t.Fatal("Get error ")
 	}
 
-	//check the reponse.
 	v, ok = <- pt.commChan
 	if !ok {
 		t.Fatal("Channel has closed..")
@@ -442,10 +440,41 @@ func TestPropGetHandle(t *testing.T){
 		t.Fatal("Response error format.")
 	}
 
-	if response.Code !=types.NotFoundCode {
-		t.Fatal("property founded")
+	if response.Code !=common.RequestSuccessCode || len(response.Twins) != 1 {
+		t.Fatal("Response err")
+	}
+	if _, exist := response.Twins[0].Properties.Desired["reboot"]; !exist {
+		t.Fatal("property reboot is not exist.")
+	}
+	if len(response.Results) != 1 {
+		t.Fatal("no property result.")
+	}
+	result := response.Results[0]
+	if result.Name != "nothing" || result.Code != common.NotFoundCode ||
+			result.Kind != common.TWIN_PROP_KIND_DESIRED {
+		t.Fatalf("error property result (%v)", result)
+	}
+	t.Log("Check not found okay. ")
+
+	//Get all properties.
+	err = pt.sendTwinMessage(common.DGTWINS_OPS_GET, common.DigitalTwin{ID: "dev001"})
+	if err != nil {
+		t.Fatal("Get error ")
+	}
+
+	v, ok = <- pt.commChan
+	if !ok {
+		t.Fatal("Channel has closed..")
+	}
+	response = GetDTResponse(v)
+	if response == nil || len(response.Twins) != 1 {
+		t.Fatal("Response error format.")
 	}
-	t.Log("Check okay. ")
+	property = response.Twins[0].Properties
+	if len(property.Desired) != 3 || len(property.Reported) != 1 {
+		t.Fatal("Get all properties error.")
+	}
+	t.Log("Get all okay. ")
 
 	pt.context.StopModule("property")	
 }
@@ -455,28 +484,25 @@ func TestPropWatchAndSync(t *testing.T){
 	pt.Start()	
 	t.Log("Start test TestPropWatchAndSync ")
 
-	props := &types.TwinProperties{
-		Reported: map[string]*types.PropertyValue{
-			"on/off":	&types.PropertyValue{Value: "0"},
-			"reboot":	&types.PropertyValue{Value: "1"},
-			"holdon":	&types.PropertyValue{Value: "2"},		
-		},
-	}
-	dgTwin := &types.DigitalTwin{
+	dgTwin := &common.DigitalTwin{
 		ID:	"dev001",
 		Name:	"sensor0",
 		Description: "None",
 		State: "offline",
-		Properties: props, 
+	}
+	dgTwin.Properties.Reported = map[string]*common.TwinProperty{
+		"on/off":	&common.TwinProperty{Name: "on/off", Value: []byte("0")},
+		"reboot":	&common.TwinProperty{Name: "reboot", Value: []byte("1")},
+		"holdon":	&common.TwinProperty{Name: "holdon", Value: []byte("2")},		
 	}
 
 	// Store the twin
 	pt.StroeTwin(dgTwin)
 
 	// Watch "reboot" property.
-	err := pt.propertyDoHandle("dev001", "reboot", types.DGTWINS_OPS_WATCH, nil, true)
+	err := pt.propertyDoHandle("dev001", "reboot", common.DGTWINS_OPS_WATCH, nil, true)
 	if err != nil {
-		t.Fatal("Get error ")
+		t.Fatal("Watch error ")
 	}
 	//check the reponse.
 	v, ok := <- pt.commChan
@@ -488,104 +514,472 @@ func TestPropWatchAndSync(t *testing.T){
 		t.Fatal("Response error format.")
 	}
 
-	if response.Code !=types.RequestSuccessCode {
+	if response.Code !=common.RequestSuccessCode || len(response.Twins) != 1 {
 		t.Fatal("Response err")
 	}
 	
-	twins := response.Twins
-	if twins == nil {
-		t.Fatal("twins is empty.")
-	}
-	
-	twin := twins[0]
-	if twin == nil {
-		t.Fatal("twin is empty.")
-	}
-
-	property := twin.Properties
-	if property == nil || len(property.Reported) != 1 {
+	property := response.Twins[0].Properties
+	if len(property.Reported) != 1 {
 		t.Fatal("property is nil.")
 	}
 	if val, exist := property.Reported["reboot"]; !exist {
 		t.Fatal("property is not exist.")
 	}else {
-		if val.Value != "1" {
-			t.Fatal("Get error.")		
+		if string(val.Value) != "1" {
+			t.Fatal("Watch error.")		
 		}
 	}
 	t.Log("Response okay. ")
 
 	// create a SYNC
 	t.Log("Create a sync request.")
-	props = &types.TwinProperties{
-		Reported: map[string]*types.PropertyValue{
-			"on/off":	&types.PropertyValue{Value: "7"},
-			"reboot":	&types.PropertyValue{Value: "sucess"},
-			"holdon":	&types.PropertyValue{Value: "9"},		
-		},
+	pt.sendSyncMessage("dev001", map[string]string{"on/off": "7", "reboot": "sucess"})
+
+	// check  sync
+	v, ok = <- pt.commChan
+	if !ok {
+		t.Fatal("Channel has closed..")
 	}
-	dgTwin = &types.DigitalTwin{
-		ID:	"dev001",
-		Properties: props, 
+	message, _ := v.(*model.Message)
+	if message == nil || message.GetOperation() != common.DGTWINS_OPS_SYNC ||
+			message.GetTarget() != "edge/app" {
+		t.Fatal("error sync message")
 	}
-	twins = []*types.DigitalTwin{dgTwin}
-	bytes, err := types.BuildTwinMessage(types.DGTWINS_OPS_SYNC, twins)
-	if err != nil {
-		t.Fatal("BuildTwinMessage error.")
+	twins := GetTwins(v)
+	if len(twins) != 1 || twins[0].ID != "dev001" {
+		t.Fatal("No twins")
 	}
-	modelMsg := pt.context.BuildModelMessage("device", types.MODULE_NAME, 
-							types.DGTWINS_OPS_SYNC, types.DGTWINS_MODULE_PROPERTY, bytes)
 
-	pt.context.SendToModule(types.DGTWINS_MODULE_PROPERTY, modelMsg) 
+	reported := twins[0].Properties.Reported
+	if len(reported) != 1 {
+		t.Fatal("unwatched property is synced")
+	}
+	if val, exist :=reported["reboot"]; !exist {
+		t.Fatal("error SYNC, no this property")
+	}else {
+		if string(val.Value) != "sucess" {
+			t.Fatal("error SYNC, SYNC failed")
+		}
+	}
+	t.Log("SYNC success. ")
 
-	//check the reponse.
+	// close the watch.
+	resp, _ := common.BuildResponseMessage(common.CloseWatchCode, "Close", []common.DigitalTwin{{ID: "dev001"}})
+	modelMsg := pt.context.BuildModelMessage("edge/app", types.MODULE_NAME, 
+							common.DGTWINS_OPS_RESPONSE, types.DGTWINS_MODULE_PROPERTY, resp)
+	modelMsg.SetTag(message.GetID())
+	pt.context.SendToModule(types.DGTWINS_MODULE_PROPERTY, modelMsg) 
 	v, ok = <- pt.commChan
 	if !ok {
 		t.Fatal("Channel has closed..")
 	}
-	response = GetDTResponse(v)
-	if response == nil {
-		t.Fatal("Response error format.")
+	message, _ = v.(*model.Message)
+	if message == nil || message.GetOperation() != common.DGTWINS_OPS_RESPONSE {
+		t.Fatal("response is not passed to comm")
 	}
-	if response.Code !=types.RequestSuccessCode {
-		t.Fatal("Response err")
+
+	pt.sendSyncMessage("dev001", map[string]string{"reboot": "again"})
+	select {
+	case v = <- pt.commChan:
+		t.Fatalf("sync after watch closed (%v)", v)
+	case <-time.After(10 * time.Millisecond):
 	}
-	t.Log("Response success.")
-	
-	// check  sync
-	v, ok = <- pt.commChan
-	if !ok {
-		t.Fatal("Channel has closed..")
+	t.Log("Close watch success. ")
+
+	pt.context.StopModule("property")	
+}
+
+func (pt *PropertyTest) sendSyncMessage(twinID string, values map[string]string) {
+	devTwin := &common.DeviceTwin{ID: twinID}
+	for name, value := range values {
+		devTwin.Properties.Reported = append(devTwin.Properties.Reported, 
+						common.TwinProperty{Name: name, Value: []byte(value)})
 	}
-	twins = GetTwins(v)
-	if twins == nil {
-		t.Fatal("No twins")
+	bytes, _ := common.BuildDeviceMessage(devTwin)
+	modelMsg := pt.context.BuildModelMessage(common.DeviceName, types.MODULE_NAME, 
+							common.DGTWINS_OPS_SYNC, types.DGTWINS_MODULE_PROPERTY, bytes)
+
+	pt.context.SendToModule(types.DGTWINS_MODULE_PROPERTY, modelMsg) 
+}
+
+// TestPropUpdateConflict test the update with expected version.
+func TestPropUpdateConflict(t *testing.T){
+	pt := NewPropertyTest()
+	pt.Start()	
+	t.Log("Start test PropUpdateConflict ")
+
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State: "offline",
+		Version: 3,
+	}
+	dgTwin.Properties.Desired = map[string]*common.TwinProperty{
+		"reboot":	&common.TwinProperty{Name: "reboot", Value: []byte("1"), Version: 2},
 	}
+	pt.StroeTwin(dgTwin)
 
-	dgTwin = twins[0]
-	if dgTwin == nil {
-		t.Fatal("No twins")
+	update := func(twinVersion, propVersion uint64) *common.TwinResponse {
+		twin := common.DigitalTwin{ID: "dev001", Version: twinVersion}
+		twin.Properties.Desired = map[string]*common.TwinProperty{
+			"reboot":	&common.TwinProperty{Name: "reboot", Value: []byte("0"), Version: propVersion},
+		}
+		pt.sendTwinMessage(common.DGTWINS_OPS_UPDATE, twin)
+
+		v := <- pt.commChan
+		return GetDTResponse(v)
 	}
 
-	if dgTwin.ID != "dev001" {
-		t.Fatal("error message")
+	// stale property version.
+	response := update(0, 1)
+	if response == nil || response.Code != common.ConflictCode || len(response.Twins) != 1 {
+		t.Fatal("stale property version should conflict")
+	}
+	prop := response.Twins[0].Properties.Desired["reboot"]
+	if prop == nil || prop.Version != 2 || response.Twins[0].Version != 3 {
+		t.Fatalf("conflict response should has current version (%v)", response.Twins[0])
 	}
 
-	if dgTwin.Properties == nil || dgTwin.Properties.Reported == nil ||
-			len(dgTwin.Properties.Reported) < 1 {
-		t.Fatal("no property SYNC")
+	// stale twin version.
+	response = update(2, 0)
+	if response == nil || response.Code != common.ConflictCode {
+		t.Fatal("stale twin version should conflict")
 	}
 
-	reported := dgTwin.Properties.Reported
-	if val, exist :=reported["reboot"]; !exist {
-		t.Fatal("error SYNC, no this property")
-	}else {
-		if val.Value != "sucess" {
-			t.Fatal("error SYNC, SYNC failed")
+	// right versions.
+	response = update(3, 2)
+	if response == nil || response.Code != common.RequestSuccessCode || len(response.Twins) != 1 {
+		t.Fatal("update with right version failed")
+	}
+	prop = response.Twins[0].Properties.Desired["reboot"]
+	if prop == nil || prop.Version != 3 || response.Twins[0].Version != 4 {
+		t.Fatalf("versions are not increased (%v)", response.Twins[0])
+	}
+	//device message.
+	<- pt.commChan
+
+	savedTwin := pt.LoadTwin("dev001")
+	if string(savedTwin.Properties.Desired["reboot"].Value) != "0" {
+		t.Fatal("update value is error.")
+	}
+
+	pt.context.StopModule("property")
+}
+
+// TestPropUpdateTypedValue test the desired value is checked against its type.
+func TestPropUpdateTypedValue(t *testing.T){
+	pt := NewPropertyTest()
+	pt.Start()	
+	t.Log("Start test PropUpdateTypedValue ")
+
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State: "offline",
+	}
+	dgTwin.Properties.Desired = map[string]*common.TwinProperty{
+		"temp":	&common.TwinProperty{Name: "temp", Value: []byte("20"), Type: common.TWIN_PROP_VALUE_TYPE_UINT8},
+	}
+	pt.StroeTwin(dgTwin)
+
+	update := func(prop *common.TwinProperty) *common.TwinResponse {
+		twin := common.DigitalTwin{ID: "dev001"}
+		twin.Properties.Desired = map[string]*common.TwinProperty{prop.Name: prop}
+		pt.sendTwinMessage(common.DGTWINS_OPS_UPDATE, twin)
+
+		v := <- pt.commChan
+		return GetDTResponse(v)
+	}
+
+	// out of range of saved type.
+	response := update(&common.TwinProperty{Name: "temp", Value: []byte("300")})
+	if response == nil || response.Code != common.BadRequestCode || len(response.Results) != 1 {
+		t.Fatal("value out of range should be rejected")
+	}
+	if response.Results[0].Name != "temp" || response.Results[0].Reason == "" {
+		t.Fatalf("unexpected result (%v)", response.Results[0])
+	}
+
+	// the request can't change the saved type.
+	response = update(&common.TwinProperty{Name: "temp", Value: []byte(`"abc"`), Type: common.TWIN_PROP_VALUE_TYPE_STRING})
+	if response == nil || response.Code != common.BadRequestCode || len(response.Results) != 1 {
+		t.Fatal("value with other type should be rejected")
+	}
+
+	// mismatch with declared type.
+	response = update(&common.TwinProperty{Name: "mode", Value: []byte("on"), Type: common.TWIN_PROP_VALUE_TYPE_BOOL})
+	if response == nil || response.Code != common.BadRequestCode {
+		t.Fatal("invalid bool should be rejected")
+	}
+
+	prop := &common.TwinProperty{Name: "mode", Type: common.TWIN_PROP_VALUE_TYPE_OBJECT}
+	if err := prop.SetValue(map[string]int{"speed": 2}); err != nil {
+		t.Fatalf("encode object failed (%v)", err)
+	}
+	response = update(prop)
+	if response == nil || response.Code != common.RequestSuccessCode {
+		t.Fatal("valid object should be accepted")
+	}
+	//device message.
+	<- pt.commChan
+
+	savedTwin := pt.LoadTwin("dev001")
+	if string(savedTwin.Properties.Desired["temp"].Value) != "20" ||
+			savedTwin.Properties.Desired["temp"].Type != common.TWIN_PROP_VALUE_TYPE_UINT8 {
+		t.Fatal("rejected value should not be saved.")
+	}
+	v, err := savedTwin.Properties.Desired["mode"].GetValue()
+	object, isObject := v.(map[string]interface{})
+	if err != nil || !isObject || object["speed"] != float64(2) {
+		t.Fatalf("decode object failed (%v, %v)", v, err)
+	}
+
+	pt.context.StopModule("property")
+}
+
+// TestPropUpdateWithModel test the desired value is checked against device model.
+func TestPropUpdateWithModel(t *testing.T){
+	pt := NewPropertyTest()
+	pt.Start()	
+	t.Log("Start test PropUpdateWithModel ")
+
+	min, max := float64(10), float64(40)
+	pt.context.Models.Store("thermostat", &common.DeviceModel{
+		Name:	"thermostat",
+		Properties: []common.PropertySchema{
+			{Name: "target", Type: common.TWIN_PROP_VALUE_TYPE_FLOAT, Unit: "°C", Min: &min, Max: &max},
+			{Name: "mode", Type: common.TWIN_PROP_VALUE_TYPE_STRING, Enum: []string{"heat", "cool"}},
+			{Name: "temp", Type: common.TWIN_PROP_VALUE_TYPE_FLOAT, ReadOnly: true},
+		},
+	})
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State: "offline",
+		Model: "thermostat",
+	}
+	pt.StroeTwin(dgTwin)
+
+	update := func(name, value string) *common.TwinResponse {
+		pt.propertyDoHandle("dev001", name, common.DGTWINS_OPS_UPDATE, []byte(value), false)
+		v := <- pt.commChan
+		return GetDTResponse(v)
+	}
+
+	rejected := map[string]string{
+		"target": "45.5",
+		"mode": "auto",
+		"temp": "20",
+		"speed": "1",
+	}
+	for name, value := range rejected {
+		response := update(name, value)
+		if response == nil || response.Code != common.BadRequestCode || len(response.Results) != 1 {
+			t.Fatalf("property (%s=%s) should be rejected", name, value)
 		}
 	}
-	t.Log("SYNC success. ")
-	
 
-	pt.context.StopModule("property")	
+	response := update("target", "22.5")
+	if response == nil || response.Code != common.RequestSuccessCode {
+		t.Fatal("valid property should be accepted")
+	}
+	//device message.
+	<- pt.commChan
+
+	prop := pt.LoadTwin("dev001").Properties.Desired["target"]
+	if prop == nil || prop.Type != common.TWIN_PROP_VALUE_TYPE_FLOAT {
+		t.Fatalf("property type should be from model (%v)", prop)
+	}
+
+	// Get response carry the model.
+	pt.propertyDoHandle("dev001", "target", common.DGTWINS_OPS_GET, nil, false)
+	response = GetDTResponse(<- pt.commChan)
+	if response == nil || len(response.Models) != 1 || response.Models[0].Name != "thermostat" {
+		t.Fatal("Get response should carry the model")
+	}
+
+	pt.context.StopModule("property")
+}
+
+// TestPropHistory test the reported values are kept in history.
+func TestPropHistory(t *testing.T){
+	pt := NewPropertyTest()
+	pt.context.SetHistoryLimit(3, time.Hour)
+	pt.Start()	
+	t.Log("Start test PropHistory ")
+
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State: "online",
+	}
+	dgTwin.Properties.Reported = map[string]*common.TwinProperty{
+		"temp":	&common.TwinProperty{Name: "temp", Type: common.TWIN_PROP_VALUE_TYPE_UINT64},
+	}
+	pt.StroeTwin(dgTwin)
+
+	for _, value := range []string{"10", "20", "30", "60"} {
+		pt.sendSyncMessage("dev001", map[string]string{"temp": value})
+	}
+
+	query := func(interval int64) *common.TwinResponse {
+		historyMsg := common.TwinHistoryMessage{TwinID: "dev001", Names: []string{"temp"}, Interval: interval}
+		bytes, _ := json.Marshal(historyMsg)
+		modelMsg := pt.context.BuildModelMessage("edge/app", types.MODULE_NAME, 
+							common.DGTWINS_OPS_HISTORY, types.DGTWINS_MODULE_PROPERTY, bytes)
+		pt.context.SendToModule(types.DGTWINS_MODULE_PROPERTY, modelMsg) 
+
+		return GetDTResponse(<- pt.commChan)
+	}
+
+	// the oldest value is dropped.
+	response := query(0)
+	if response == nil || response.Code != common.RequestSuccessCode || len(response.History) != 1 {
+		t.Fatal("query history failed")
+	}
+	points := response.History[0].Points
+	if len(points) != 3 || string(points[0].Value) != "20" || string(points[2].Value) != "60" {
+		t.Fatalf("unexpected history (%v)", points)
+	}
+
+	// all values in one bucket.
+	response = query(int64(time.Hour/time.Millisecond))
+	if response == nil || len(response.History) != 1 || len(response.History[0].Points) > 2 {
+		t.Fatal("query downsampled history failed")
+	}
+	bucket := response.History[0].Points[len(response.History[0].Points)-1]
+	if bucket.Max == nil || *bucket.Max != 60 || bucket.Avg == nil {
+		t.Fatalf("unexpected bucket (%v)", bucket)
+	}
+
+	pt.context.StopModule("property")
+}
+
+// TestPropAudit test the property mutations are audited with the source.
+func TestPropAudit(t *testing.T){
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+	auditLog, err := dtstore.NewAuditLog(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed (%v)", err)
+	}
+	defer auditLog.Close()
+
+	pt := NewPropertyTest()
+	pt.context.SetAuditLog(auditLog)
+	pt.Start()	
+
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State: "online",
+	}
+	dgTwin.Properties.Desired = map[string]*common.TwinProperty{
+		"temp":	&common.TwinProperty{Name: "temp", Value: []byte("10")},
+	}
+	dgTwin.Properties.Reported = map[string]*common.TwinProperty{
+		"temp":	&common.TwinProperty{Name: "temp", Value: []byte("10")},
+	}
+	pt.StroeTwin(dgTwin)
+
+	pt.propertyDoHandle("dev001", "temp", common.DGTWINS_OPS_UPDATE, []byte("20"), false)
+	<-pt.commChan
+	pt.sendSyncMessage("dev001", map[string]string{"temp": "20"})
+	time.Sleep(10 * time.Millisecond)
+
+	records, err := pt.context.QueryAudit("dev001", 0, 0, 0, 0)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("unexpected audit records (%v %v)", err, records)
+	}
+	if records[0].Source != "edge/app" || records[0].Kind != common.TWIN_PROP_KIND_DESIRED ||
+			string(records[0].OldValue) != "10" || string(records[0].NewValue) != "20" {
+		t.Errorf("unexpected desired record (%v)", records[0])
+	}
+	if records[1].Source != common.DeviceName || records[1].Operation != common.DGTWINS_OPS_SYNC ||
+			records[1].Kind != common.TWIN_PROP_KIND_REPORTED || string(records[1].NewValue) != "20" {
+		t.Errorf("unexpected reported record (%v)", records[1])
+	}
+
+	pt.context.StopModule("property")
+}
+
+// TestPropBulkUpdate test every twin in request is updated, and the response
+// has the result of each twin.
+func TestPropBulkUpdate(t *testing.T){
+	pt := NewPropertyTest()
+	pt.context.CommChan["comm"] = pt.commChan
+	pt.module.InitModule(pt.context, make(chan interface{}, 128), make(chan interface{}, 128), nil)
+	pt.StroeTwin(&common.DigitalTwin{ID: "dev001", State: common.DGTWINS_STATE_ONLINE})
+	pt.StroeTwin(&common.DigitalTwin{ID: "dev002", State: common.DGTWINS_STATE_ONLINE, Version: 5})
+
+	desired := func(twinID string, version uint64) common.DigitalTwin {
+		twin := common.DigitalTwin{ID: twinID, Version: version}
+		twin.Properties.Desired = map[string]*common.TwinProperty{
+			"temp": &common.TwinProperty{Name: "temp", Value: []byte("20")},
+		}
+		return twin
+	}
+	twins := []common.DigitalTwin{desired("dev001", 0), desired("dev002", 1), desired("dev003", 0)}
+	content, _ := common.BuildTwinMessage(twins)
+	msg := pt.context.BuildModelMessage("edge/app", types.MODULE_NAME, 
+				common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_PROPERTY, content)
+	if err := pt.module.propUpdateHandle(msg); err != nil {
+		t.Fatalf("bulk update failed (%v)", err)
+	}
+
+	resp := GetDTResponse(<-pt.commChan)
+	if resp == nil || resp.Code != common.MultiStatusCode || len(resp.TwinResults) != 3 {
+		t.Fatalf("response should have result of each twin (%v)", resp)
+	}
+	expected := map[string]int{
+		"dev001": common.RequestSuccessCode,
+		"dev002": common.ConflictCode,
+		"dev003": common.NotFoundCode,
+	}
+	for _, result := range resp.TwinResults {
+		if expected[result.TwinID] != result.Code {
+			t.Errorf("twin (%s) result should be %d, but got %d", result.TwinID, expected[result.TwinID], result.Code)
+		}
+	}
+	if _, exist := pt.LoadTwin("dev001").Properties.Desired["temp"]; !exist {
+		t.Errorf("dev001 should be updated")
+	}
+	if len(pt.LoadTwin("dev002").Properties.Desired) > 0 {
+		t.Errorf("dev002 should not be updated")
+	}
+	// only the updated twin is notified.
+	if message := GetModelMessage(<-pt.commChan); common.GetTwinID(message) != "dev001" {
+		t.Errorf("dev001 should be notified")
+	}
+	if len(pt.commChan) != 0 {
+		t.Errorf("unexpected messages to comm")
+	}
+}
+
+// TestPropUpdateDeletedTwin test the update is not applied to the twin which
+// is deleted while the update waits for the twin lock.
+func TestPropUpdateDeletedTwin(t *testing.T){
+	pt := NewPropertyTest()
+	pt.Start()	
+
+	dgTwin := &common.DigitalTwin{ID: "dev001", State: "online"}
+	pt.StroeTwin(dgTwin)
+
+	// the twin is deleted under its lock, as the twin module does.
+	pt.context.Lock("dev001")
+	pt.propertyDoHandle("dev001", "temp", common.DGTWINS_OPS_UPDATE, []byte("20"), false)
+	time.Sleep(10 * time.Millisecond)
+	pt.context.DGTwinList.Delete("dev001")
+	pt.context.Unlock("dev001")
+	pt.context.DGTwinMutex.Delete("dev001")
+
+	response := GetDTResponse(<-pt.commChan)
+	if response == nil || len(response.TwinResults) != 1 || response.TwinResults[0].Code != common.NotFoundCode {
+		t.Fatalf("update of deleted twin should be not found (%v)", response)
+	}
+	pt.context.Lock("dev001")
+	if len(dgTwin.Properties.Desired) != 0 || dgTwin.Version != 0 {
+		t.Errorf("update is applied to deleted twin (%v)", dgTwin)
+	}
+	pt.context.Unlock("dev001")
+
+	pt.context.StopModule("property")
 }
@@ -0,0 +1,217 @@
+package dtmodule
+
+import (
+	"time"
+	"bytes"
+	"k8s.io/klog"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/config"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+// ReconcileModule compare the desired properties with the reported
+// properties of each twin periodically, and re-push the unsatisfied
+// desired values to the online device. a desired property is marked
+// failed after it has been pushed maxAttempts times.
+// twin module send the twin ID to this module when device is online.
+type ReconcileModule struct {
+	// module name
+	name			string
+	context			*dtcontext.DTContext
+	//for msg communication
+	recieveChan		chan interface{}
+	// for module's health check.
+	heartBeatChan	chan interface{}
+	confirmChan		chan interface{}
+	interval		time.Duration
+	maxAttempts		int
+	// push attempts of desired property, key is twinID/propName.
+	attempts		map[string]*pushAttempt
+}
+
+type pushAttempt struct {
+	// desired property version of these attempts.
+	version		uint64
+	count		int
+}
+
+func NewReconcileModule() *ReconcileModule {
+	return &ReconcileModule{name: types.DGTWINS_MODULE_RECONCILE}
+}
+
+func (rm *ReconcileModule) Name() string {
+	return rm.name
+}
+
+//Init the reconcile module.
+func (rm *ReconcileModule) InitModule(dtc *dtcontext.DTContext, comm, heartBeat, confirm chan interface{}) {
+	conf := config.GetDGTwinConfig()
+
+	rm.context = dtc
+	rm.recieveChan = comm
+	rm.heartBeatChan = heartBeat
+	rm.confirmChan = confirm
+	rm.interval = time.Duration(conf.ReconcileInterval) * time.Second
+	rm.maxAttempts = conf.ReconcileMaxAttempts
+	rm.attempts = make(map[string]*pushAttempt)
+}
+
+//Start reconcile module
+func (rm *ReconcileModule) Start() {
+	reconcileCh := time.After(rm.interval)
+	//Start loop.
+	for {
+		select {
+		case v, ok := <-rm.recieveChan:
+			if !ok {
+				//channel closed.
+				return
+			}
+
+			twinID, isString := v.(string)
+			if isString {
+				// device is online, push all unsatisfied desired properties.
+				klog.Infof("reconcile twin (%s)", twinID)
+				rm.reconcileTwin(twinID, true)
+			}
+		case v, ok := <-rm.heartBeatChan:
+			if !ok {
+				return
+			}
+
+			err := rm.context.HandleHeartBeat(rm.Name(), v.(string))
+			if err != nil {
+				klog.Infof("%s module stopped", rm.Name())
+				return
+			}
+		case <-reconcileCh:
+			rm.reconcileAll()
+			reconcileCh = time.After(rm.interval)
+		}
+	}
+}
+
+// reconcileAll reconcile all twins.
+func (rm *ReconcileModule) reconcileAll() {
+	twinIDs := make(map[string]bool)
+	rm.context.DGTwinList.Range(func(key, value interface{}) bool {
+		twinID := key.(string)
+		twinIDs[twinID] = true
+		rm.reconcileTwin(twinID, false)
+		return true
+	})
+
+	// drop the attempts of deleted twins.
+	for key, _ := range rm.attempts {
+		if !twinIDs[attemptTwinID(key)] {
+			delete(rm.attempts, key)
+		}
+	}
+}
+
+// reconcileTwin update the status of all desired properties of the twin,
+// and push the unsatisfied properties to device if device is online.
+// reset means device is just online, all attempts are restarted.
+func (rm *ReconcileModule) reconcileTwin(twinID string, reset bool) {
+	v, exist := rm.context.DGTwinList.Load(twinID)
+	if !exist {
+		return
+	}
+	savedTwin, isDgTwinType := v.(*common.DigitalTwin)
+	if !isDgTwinType {
+		return
+	}
+
+	pushDesired := make([]common.TwinProperty, 0)
+	changed := false
+
+	rm.context.Lock(twinID)
+	online := savedTwin.State == common.DGTWINS_STATE_ONLINE
+	for name, prop := range savedTwin.Properties.Desired {
+		if prop == nil {
+			continue
+		}
+
+		key := twinID + "/" + name
+		status := common.TWIN_PROP_STATUS_PENDING
+		if isDesiredSatisfied(savedTwin, name) {
+			status = common.TWIN_PROP_STATUS_INSYNC
+			delete(rm.attempts, key)
+		}else {
+			attempt, exist := rm.attempts[key]
+			if !exist || reset || attempt.version != prop.Version {
+				attempt = &pushAttempt{version: prop.Version}
+				rm.attempts[key] = attempt
+			}
+
+			if attempt.count >= rm.maxAttempts {
+				status = common.TWIN_PROP_STATUS_FAILED
+			}else if online {
+				attempt.count++
+				value := *prop
+				value.Status = ""
+				pushDesired = append(pushDesired, value)
+			}
+		}
+
+		if prop.Status != status {
+			prop.Status = status
+			changed = true
+		}
+	}
+	if changed {
+		if err := rm.context.SaveTwin(savedTwin); err != nil {
+			klog.Errorf("Save twin (%s) failed (%v)", twinID, err)
+		}
+	}
+	rm.context.Unlock(twinID)
+
+	if len(pushDesired) > 0 {
+		klog.Infof("re-push %d desired properties to device (%s)", len(pushDesired), twinID)
+		devTwin := &common.DeviceTwin{ID : twinID}
+		devTwin.Properties.Desired = pushDesired
+		rm.context.SendMessage2Device(common.DGTWINS_OPS_UPDATE, devTwin)
+	}
+}
+
+func attemptTwinID(key string) string {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] == '/' {
+			return key[:i]
+		}
+	}
+
+	return key
+}
+
+// isDesiredSatisfied check the reported value is equal to the desired value.
+func isDesiredSatisfied(twin *common.DigitalTwin, name string) bool {
+	desired, exist := twin.Properties.Desired[name]
+	if !exist || desired == nil {
+		return true
+	}
+
+	reported, exist := twin.Properties.Reported[name]
+	if !exist || reported == nil {
+		return false
+	}
+
+	return bytes.Equal(desired.Value, reported.Value)
+}
+
+// refreshDesiredStatus update the status of the desired property after the
+// desired or reported value is changed, the failed status is kept until
+// the reported value reach the desired value.
+func refreshDesiredStatus(twin *common.DigitalTwin, name string) {
+	desired, exist := twin.Properties.Desired[name]
+	if !exist || desired == nil {
+		return
+	}
+
+	if isDesiredSatisfied(twin, name) {
+		desired.Status = common.TWIN_PROP_STATUS_INSYNC
+	}else if desired.Status != common.TWIN_PROP_STATUS_FAILED {
+		desired.Status = common.TWIN_PROP_STATUS_PENDING
+	}
+}
@@ -0,0 +1,106 @@
+package dtmodule
+
+import (
+	"sync"
+	"time"
+	"testing"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/beehive/pkg/core/context"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+func newReconcileTest(maxAttempts int) (*ReconcileModule, chan interface{}) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	dtc := dtcontext.NewDTContext(ctx)
+	comm := make(chan interface{}, 128)
+	dtc.CommChan["comm"] = comm
+
+	rm := NewReconcileModule()
+	rm.context = dtc
+	rm.interval = time.Hour
+	rm.maxAttempts = maxAttempts
+	rm.attempts = make(map[string]*pushAttempt)
+
+	return rm, comm
+}
+
+func storeReconcileTwin(rm *ReconcileModule, state, desired, reported string) *common.DigitalTwin {
+	dgTwin := &common.DigitalTwin{
+		ID:	"dev001",
+		State:	state,
+	}
+	dgTwin.Properties.Desired = map[string]*common.TwinProperty{
+		"temp": &common.TwinProperty{Name: "temp", Value: []byte(desired), Version: 1},
+	}
+	dgTwin.Properties.Reported = map[string]*common.TwinProperty{
+		"temp": &common.TwinProperty{Name: "temp", Value: []byte(reported), Version: 1},
+	}
+
+	rm.context.DGTwinList.Store(dgTwin.ID, dgTwin)
+	var deviceMutex	sync.Mutex
+	rm.context.DGTwinMutex.Store(dgTwin.ID, &deviceMutex)
+
+	return dgTwin
+}
+
+// TestReconcileTwin test the unsatisfied desired property is re-pushed
+// to the online device until it's failed.
+func TestReconcileTwin(t *testing.T) {
+	rm, comm := newReconcileTest(2)
+	dgTwin := storeReconcileTwin(rm, common.DGTWINS_STATE_ONLINE, "30", "20")
+
+	for i := 0; i < 2; i++ {
+		rm.reconcileTwin("dev001", false)
+		if dgTwin.Properties.Desired["temp"].Status != common.TWIN_PROP_STATUS_PENDING {
+			t.Fatalf("expect pending, but got %s", dgTwin.Properties.Desired["temp"].Status)
+		}
+		select {
+		case v := <-comm:
+			devTwin := GetDeviceTwin(v)
+			if devTwin == nil || len(devTwin.Properties.Desired) != 1 ||
+				string(devTwin.Properties.Desired[0].Value) != "30" {
+				t.Fatalf("unexpected device message %v", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("desired property is not pushed")
+		}
+	}
+
+	rm.reconcileTwin("dev001", false)
+	if dgTwin.Properties.Desired["temp"].Status != common.TWIN_PROP_STATUS_FAILED {
+		t.Fatalf("expect failed, but got %s", dgTwin.Properties.Desired["temp"].Status)
+	}
+	if len(comm) != 0 {
+		t.Fatalf("failed desired property should not be pushed")
+	}
+
+	// device is online again, the attempts are restarted.
+	rm.reconcileTwin("dev001", true)
+	if dgTwin.Properties.Desired["temp"].Status != common.TWIN_PROP_STATUS_PENDING || len(comm) != 1 {
+		t.Fatalf("desired property is not re-pushed after device online")
+	}
+	<-comm
+
+	dgTwin.Properties.Reported["temp"].Value = []byte("30")
+	rm.reconcileTwin("dev001", false)
+	if dgTwin.Properties.Desired["temp"].Status != common.TWIN_PROP_STATUS_INSYNC {
+		t.Fatalf("expect in-sync, but got %s", dgTwin.Properties.Desired["temp"].Status)
+	}
+	if len(comm) != 0 {
+		t.Fatalf("in-sync desired property should not be pushed")
+	}
+}
+
+// TestReconcileOfflineTwin test nothing is pushed to the offline device.
+func TestReconcileOfflineTwin(t *testing.T) {
+	rm, comm := newReconcileTest(2)
+	dgTwin := storeReconcileTwin(rm, common.DGTWINS_STATE_OFFLINE, "30", "20")
+
+	rm.reconcileAll()
+	if dgTwin.Properties.Desired["temp"].Status != common.TWIN_PROP_STATUS_PENDING {
+		t.Fatalf("expect pending, but got %s", dgTwin.Properties.Desired["temp"].Status)
+	}
+	if len(comm) != 0 {
+		t.Fatalf("desired property should not be pushed to offline device")
+	}
+}
@@ -0,0 +1,26 @@
+package dtstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+)
+
+// LoadACLPolicy load the access policy from the JSON document.
+func LoadACLPolicy(path string) (*types.ACLPolicy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &types.ACLPolicy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := policy.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,219 @@
+package dtstore
+
+import (
+	"fmt"
+	"sort"
+	"bytes"
+	"strings"
+	"encoding/json"
+	"gopkg.in/yaml.v2"
+	"github.com/jwzl/edgeOn/common"
+)
+
+const (
+	ArchiveFormatJSON	= "json"
+	ArchiveFormatYAML	= "yaml"
+
+	// imported twins replace the saved twins which have same ID,
+	// and other saved twins are kept.
+	ImportModeMerge		= "merge"
+	// saved twins are replaced by the imported twins entirely,
+	// the saved twins not in archive are deleted.
+	ImportModeReplace	= "replace"
+
+	ChangeCreate	= "create"
+	ChangeUpdate	= "update"
+	ChangeDelete	= "delete"
+)
+
+// Archive is the backup of all twins, it is used to move
+// the twins to another gateway.
+type Archive struct {
+	Twins	[]*common.DigitalTwin	`json:"twins"`
+}
+
+// Change is a change of the store which is made by import.
+type Change struct {
+	TwinID		string
+	// one of Change*
+	Action		string
+	// the twin to put, nil for delete.
+	Twin		*common.DigitalTwin
+	// version of saved twin, 0 for create.
+	OldVersion	uint64
+}
+
+func (c *Change) String() string {
+	switch c.Action {
+	case ChangeCreate:
+		return fmt.Sprintf("create %s (version %d)", c.TwinID, c.Twin.Version)
+	case ChangeUpdate:
+		return fmt.Sprintf("update %s (version %d -> %d)", c.TwinID, c.OldVersion, c.Twin.Version)
+	}
+
+	return fmt.Sprintf("delete %s (version %d)", c.TwinID, c.OldVersion)
+}
+
+// ArchiveFormat return the archive format by the file extension,
+// the default format is JSON.
+func ArchiveFormat(path string) string {
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		return ArchiveFormatYAML
+	}
+
+	return ArchiveFormatJSON
+}
+
+// EncodeArchive encode all twins in the format, the twins are sorted by ID.
+func EncodeArchive(twins []*common.DigitalTwin, format string) ([]byte, error) {
+	archive := &Archive{Twins: make([]*common.DigitalTwin, len(twins))}
+	copy(archive.Twins, twins)
+	sort.Slice(archive.Twins, func(i, j int) bool {
+		return archive.Twins[i].ID < archive.Twins[j].ID
+	})
+
+	content, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case ArchiveFormatJSON:
+		return content, nil
+	case ArchiveFormatYAML:
+		// keep the JSON field names and value encoding in YAML.
+		var v interface{}
+		if err := json.Unmarshal(content, &v); err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(v)
+	}
+
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+// DecodeArchive decode the twins from the content in the format.
+func DecodeArchive(content []byte, format string) ([]*common.DigitalTwin, error) {
+	var archive Archive
+
+	switch format {
+	case ArchiveFormatJSON:
+	case ArchiveFormatYAML:
+		var v interface{}
+		if err := yaml.Unmarshal(content, &v); err != nil {
+			return nil, err
+		}
+		jsonContent, err := json.Marshal(yamlToJSON(v))
+		if err != nil {
+			return nil, err
+		}
+		content = jsonContent
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	if err := json.Unmarshal(content, &archive); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for _, twin := range archive.Twins {
+		if twin == nil || twin.ID == "" {
+			return nil, fmt.Errorf("twin without ID in archive")
+		}
+		if ids[twin.ID] {
+			return nil, fmt.Errorf("duplicated twin (%s) in archive", twin.ID)
+		}
+		ids[twin.ID] = true
+	}
+
+	return archive.Twins, nil
+}
+
+// yamlToJSON convert the YAML maps into JSON compatible maps.
+func yamlToJSON(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, item := range value {
+			m[fmt.Sprint(key)] = yamlToJSON(item)
+		}
+		return m
+	case []interface{}:
+		for key, item := range value {
+			value[key] = yamlToJSON(item)
+		}
+		return value
+	}
+
+	return v
+}
+
+// PlanImport compare the imported twins with the saved twins, and return
+// the changes to the store in the import mode, the unchanged twins are
+// skipped.
+func PlanImport(saved, imported []*common.DigitalTwin, mode string) ([]*Change, error) {
+	if mode != ImportModeMerge && mode != ImportModeReplace {
+		return nil, fmt.Errorf("unsupported import mode %q", mode)
+	}
+
+	changes := make([]*Change, 0)
+	savedTwins := make(map[string]*common.DigitalTwin)
+	for _, twin := range saved {
+		savedTwins[twin.ID] = twin
+	}
+
+	importedIDs := make(map[string]bool)
+	for _, twin := range imported {
+		importedIDs[twin.ID] = true
+		savedTwin, exist := savedTwins[twin.ID]
+		if !exist {
+			changes = append(changes, &Change{TwinID: twin.ID, Action: ChangeCreate, Twin: twin})
+			continue
+		}
+		if equalTwin(savedTwin, twin) {
+			continue
+		}
+		changes = append(changes, &Change{TwinID: twin.ID, Action: ChangeUpdate,
+									Twin: twin, OldVersion: savedTwin.Version})
+	}
+
+	if mode == ImportModeReplace {
+		for _, twin := range saved {
+			if !importedIDs[twin.ID] {
+				changes = append(changes, &Change{TwinID: twin.ID, Action: ChangeDelete,
+									OldVersion: twin.Version})
+			}
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].TwinID < changes[j].TwinID
+	})
+
+	return changes, nil
+}
+
+// ApplyImport apply the changes to the store.
+func ApplyImport(store TwinStore, changes []*Change) error {
+	for _, change := range changes {
+		var err error
+		if change.Action == ChangeDelete {
+			err = store.Delete(change.TwinID)
+		}else {
+			err = store.Put(change.Twin)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", change, err)
+		}
+	}
+
+	return nil
+}
+
+func equalTwin(a, b *common.DigitalTwin) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
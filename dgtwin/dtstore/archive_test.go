@@ -0,0 +1,101 @@
+package dtstore
+
+import (
+	"os"
+	"testing"
+	"github.com/jwzl/edgeOn/common"
+)
+
+func newArchiveTwin(twinID string, version uint64) *common.DigitalTwin {
+	twin := &common.DigitalTwin{
+		ID:		twinID,
+		State:	common.DGTWINS_STATE_ONLINE,
+		Version:	version,
+		MetaData:	map[string]*common.MetaType{
+			"vendor": &common.MetaType{Name: "vendor", Value: "acme"},
+		},
+	}
+	twin.Properties.Desired = map[string]*common.TwinProperty{
+		"temp": &common.TwinProperty{Name: "temp", Value: []byte("20"), Type: "int64", Version: 2},
+	}
+	twin.Properties.Reported = map[string]*common.TwinProperty{
+		"temp": &common.TwinProperty{Name: "temp", Value: []byte("19"), Type: "int64"},
+	}
+
+	return twin
+}
+
+func TestArchiveEncodeDecode(t *testing.T) {
+	twins := []*common.DigitalTwin{newArchiveTwin("dev002", 3), newArchiveTwin("dev001", 7)}
+
+	for _, format := range []string{ArchiveFormatJSON, ArchiveFormatYAML} {
+		content, err := EncodeArchive(twins, format)
+		if err != nil {
+			t.Fatalf("encode %s failed (%v)", format, err)
+		}
+		decoded, err := DecodeArchive(content, format)
+		if err != nil {
+			t.Fatalf("decode %s failed (%v)", format, err)
+		}
+		if len(decoded) != 2 || decoded[0].ID != "dev001" || decoded[1].ID != "dev002" {
+			t.Fatalf("%s: twins should be sorted by ID", format)
+		}
+		if !equalTwin(decoded[0], twins[1]) || !equalTwin(decoded[1], twins[0]) {
+			t.Errorf("%s: decoded twins are different from the exported twins", format)
+		}
+	}
+
+	if _, err := DecodeArchive([]byte(`{"twins":[{"id":"dev001"},{"id":"dev001"}]}`), ArchiveFormatJSON); err == nil {
+		t.Errorf("duplicated twins should be rejected")
+	}
+	if ArchiveFormat("twins.yml") != ArchiveFormatYAML || ArchiveFormat("twins.json") != ArchiveFormatJSON {
+		t.Errorf("unexpected archive format")
+	}
+}
+
+func TestPlanAndApplyImport(t *testing.T) {
+	store, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	saved := []*common.DigitalTwin{newArchiveTwin("dev001", 1), newArchiveTwin("dev002", 1), newArchiveTwin("dev003", 1)}
+	for _, twin := range saved {
+		store.Put(twin)
+	}
+	imported := []*common.DigitalTwin{newArchiveTwin("dev001", 1), newArchiveTwin("dev002", 5), newArchiveTwin("dev004", 2)}
+
+	changes, err := PlanImport(saved, imported, ImportModeMerge)
+	if err != nil {
+		t.Fatalf("plan merge failed (%v)", err)
+	}
+	if len(changes) != 2 || changes[0].TwinID != "dev002" || changes[0].Action != ChangeUpdate ||
+			changes[1].TwinID != "dev004" || changes[1].Action != ChangeCreate {
+		t.Fatalf("unexpected merge changes %v", changes)
+	}
+
+	changes, err = PlanImport(saved, imported, ImportModeReplace)
+	if err != nil {
+		t.Fatalf("plan replace failed (%v)", err)
+	}
+	if len(changes) != 3 || changes[1].TwinID != "dev003" || changes[1].Action != ChangeDelete {
+		t.Fatalf("unexpected replace changes %v", changes)
+	}
+
+	if err := ApplyImport(store, changes); err != nil {
+		t.Fatalf("apply failed (%v)", err)
+	}
+	twins, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll failed (%v)", err)
+	}
+	versions := make(map[string]uint64)
+	for _, twin := range twins {
+		versions[twin.ID] = twin.Version
+	}
+	if len(versions) != 3 || versions["dev001"] != 1 || versions["dev002"] != 5 || versions["dev004"] != 2 {
+		t.Errorf("unexpected twins after import %v", versions)
+	}
+
+	if _, err := PlanImport(saved, imported, "unknown"); err == nil {
+		t.Errorf("unknown mode should be rejected")
+	}
+}
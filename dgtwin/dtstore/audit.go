@@ -0,0 +1,267 @@
+package dtstore
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"path/filepath"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/edgeOn/common"
+)
+
+const (
+	auditFileName	= "audit.log"
+	// the last record is read from the tail of current file on open.
+	auditTailSize	= 1024*1024
+)
+
+// AuditLog is an append-only log of twin mutations, each record is a
+// json line in audit.log. when the file exceeds max size, it's rotated
+// to audit.log.1 (the older files are shifted, audit.log.{maxFiles} is
+// the oldest one and is dropped by next rotation).
+// the records are in the order of timestamp, which the query and its
+// continue token rely on, so the timestamp is set under the lock.
+type AuditLog struct {
+	dir			string
+	maxSize		int64
+	maxFiles	int
+	mutex		sync.Mutex
+	file		*os.File
+	size		int64
+	// timestamp of the last record.
+	last		int64
+}
+
+// NewAuditLog open the audit log in directory dir, maxSize (byte) <= 0
+// means the log is never rotated.
+func NewAuditLog(dir string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if dir == "" {
+		return nil, errors.New("audit directory is empty")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if maxFiles < 0 {
+		maxFiles = 0
+	}
+
+	al := &AuditLog{
+		dir:		dir,
+		maxSize:	maxSize,
+		maxFiles:	maxFiles,
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	al.last = al.lastTimestamp()
+
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	file, err := os.OpenFile(al.fileName(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	al.file = file
+	al.size = info.Size()
+
+	return nil
+}
+
+// lastTimestamp return the timestamp of the last record in the tail of
+// current file, 0 if there is no record.
+func (al *AuditLog) lastTimestamp() int64 {
+	file, err := os.Open(al.fileName(0))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	if al.size > auditTailSize {
+		file.Seek(al.size-auditTailSize, io.SeekStart)
+	}
+	last := int64(0)
+	scanner := bufio.NewScanner(io.LimitReader(file, auditTailSize))
+	scanner.Buffer(make([]byte, 64*1024), auditTailSize)
+	for scanner.Scan() {
+		var record common.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil && record.Timestamp > last {
+			last = record.Timestamp
+		}
+	}
+
+	return last
+}
+
+// fileName return the name of the index-th file, 0 is the current file.
+func (al *AuditLog) fileName(index int) string {
+	if index == 0 {
+		return filepath.Join(al.dir, auditFileName)
+	}
+
+	return filepath.Join(al.dir, fmt.Sprintf("%s.%d", auditFileName, index))
+}
+
+// Append append the record, the record is synced to disk before return.
+// the record without timestamp is stamped now, and the timestamp is never
+// earlier than the last record, so the records are in time order even if
+// they are appended concurrently or the clock steps back.
+func (al *AuditLog) Append(record *common.AuditRecord) error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.file == nil {
+		return errors.New("audit log is closed")
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano() / 1e6
+	}
+	if record.Timestamp < al.last {
+		record.Timestamp = al.last
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		return err
+	}
+	al.last = record.Timestamp
+
+	return al.file.Sync()
+}
+
+// rotate shift the files and open a new current file.
+func (al *AuditLog) rotate() error {
+	al.file.Close()
+	al.file = nil
+
+	// the oldest file is dropped, it's the current file if no rotated file is kept.
+	os.Remove(al.fileName(al.maxFiles))
+	for index := al.maxFiles - 1; index >= 0; index-- {
+		err := os.Rename(al.fileName(index), al.fileName(index+1))
+		if err != nil && !os.IsNotExist(err) {
+			klog.Warningf("rotate audit file %s failed (%v)", al.fileName(index), err)
+		}
+	}
+
+	return al.open()
+}
+
+// Query return the records of twin in time range [start, end] (millisecond)
+// from the oldest, empty twinID means all twins, 0 means no limit. the first
+// offset matched records are skipped, and at most limit records are returned,
+// limit <= 0 means all records.
+// the files are opened under the lock and are scanned without it, so the
+// appending is not blocked by the query. the opened rotated file is still
+// readable after it's renamed or removed, and the current file is read up
+// to its size at the query.
+func (al *AuditLog) Query(twinID string, start, end int64, offset, limit int) ([]common.AuditRecord, error) {
+	readers, files, err := al.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	records := make([]common.AuditRecord, 0)
+	for _, reader := range readers {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record common.AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// the last line may be truncated by power loss.
+				continue
+			}
+			if twinID != "" && record.TwinID != twinID {
+				continue
+			}
+			if (start > 0 && record.Timestamp < start) || (end > 0 && record.Timestamp > end) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			records = append(records, record)
+			if limit > 0 && len(records) >= limit {
+				return records, nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+// snapshot open the files from the oldest, the current file is limited
+// to its size now.
+func (al *AuditLog) snapshot() ([]io.Reader, []*os.File, error) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	readers := make([]io.Reader, 0, al.maxFiles+1)
+	files := make([]*os.File, 0, al.maxFiles+1)
+	for index := al.maxFiles; index >= 0; index-- {
+		file, err := os.Open(al.fileName(index))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, nil, err
+		}
+
+		files = append(files, file)
+		if index == 0 {
+			readers = append(readers, io.LimitReader(file, al.size))
+		}else {
+			readers = append(readers, file)
+		}
+	}
+
+	return readers, files, nil
+}
+
+// Close close the audit log.
+func (al *AuditLog) Close() error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+
+	return err
+}
@@ -0,0 +1,90 @@
+package dtstore
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/jwzl/edgeOn/common"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each file holds about 2 records.
+	auditLog, err := NewAuditLog(dir, 300, 1)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed (%v)", err)
+	}
+	for i := int64(1); i <= 5; i++ {
+		twinID := "dev001"
+		if i == 2 {
+			twinID = "dev002"
+		}
+		err := auditLog.Append(&common.AuditRecord{Timestamp: i, Source: "edge/app/console",
+					Operation: common.DGTWINS_OPS_UPDATE, TwinID: twinID, Kind: common.TWIN_PROP_KIND_DESIRED,
+					Property: "temp", OldValue: []byte("10"), NewValue: []byte("20")})
+		if err != nil {
+			t.Fatalf("Append failed (%v)", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.1")); err != nil {
+		t.Errorf("audit log is not rotated (%v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.2")); err == nil {
+		t.Errorf("more rotated files are kept than max files")
+	}
+
+	records, err := auditLog.Query("", 0, 0, 0, 0)
+	if err != nil || len(records) < 2 || records[len(records)-1].Timestamp != 5 {
+		t.Fatalf("query all records failed (%v %v)", err, records)
+	}
+	for key := 1; key < len(records); key++ {
+		if records[key].Timestamp < records[key-1].Timestamp {
+			t.Errorf("records are not in order (%v)", records)
+		}
+	}
+
+	records, _ = auditLog.Query("dev001", 4, 5, 0, 0)
+	if len(records) != 2 || records[0].Timestamp != 4 || string(records[0].NewValue) != "20" {
+		t.Errorf("query by twin and time range failed (%v)", records)
+	}
+
+	records, _ = auditLog.Query("dev001", 4, 0, 0, 1)
+	if len(records) != 1 || records[0].Timestamp != 4 {
+		t.Errorf("query with limit failed (%v)", records)
+	}
+	records, _ = auditLog.Query("dev001", 4, 0, 1, 1)
+	if len(records) != 1 || records[0].Timestamp != 5 {
+		t.Errorf("query with offset and limit failed (%v)", records)
+	}
+
+	// the log is appended after reopen.
+	auditLog.Close()
+	auditLog, _ = NewAuditLog(dir, 300, 1)
+	defer auditLog.Close()
+	auditLog.Append(&common.AuditRecord{Timestamp: 6, TwinID: "dev001"})
+	records, _ = auditLog.Query("dev001", 5, 0, 0, 0)
+	if len(records) != 2 {
+		t.Errorf("records after reopen (%v)", records)
+	}
+
+	// the timestamp is never earlier than the last record, even after reopen.
+	auditLog.Close()
+	auditLog, _ = NewAuditLog(dir, 300, 1)
+	defer auditLog.Close()
+	record := &common.AuditRecord{Timestamp: 3, TwinID: "dev003"}
+	auditLog.Append(record)
+	if record.Timestamp != 6 {
+		t.Errorf("timestamp is %d, want 6", record.Timestamp)
+	}
+	record = &common.AuditRecord{TwinID: "dev003"}
+	auditLog.Append(record)
+	if record.Timestamp < 1000 {
+		t.Errorf("record is not stamped (%d)", record.Timestamp)
+	}
+}
@@ -0,0 +1,206 @@
+package dtstore
+
+import (
+	"os"
+	"sync"
+	"errors"
+	"strings"
+	"net/url"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/edgeOn/common"
+)
+
+const (
+	twinFileSuffix	= ".json"
+	tmpFileSuffix	= ".tmp"
+)
+
+// FileStore is an embedded on-disk TwinStore, each twin is saved as a
+// json file in the store directory. the file is replaced atomically by
+// write/sync/rename, so a twin file is always complete after power loss.
+type FileStore struct {
+	dir		string
+	mutex	sync.Mutex
+}
+
+// NewFileStore create the file store in directory dir.
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("store directory is empty")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+// LoadAll load all twins in store directory.
+func (fs *FileStore) LoadAll() ([]*common.DigitalTwin, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	twins := make([]*common.DigitalTwin, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, tmpFileSuffix) {
+			// unfinished write, drop it.
+			os.Remove(filepath.Join(fs.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, twinFileSuffix) {
+			continue
+		}
+
+		twin, err := fs.readFile(filepath.Join(fs.dir, name))
+		if err != nil {
+			klog.Warningf("load twin file %s failed (%v), ignored", name, err)
+			continue
+		}
+		twins = append(twins, twin)
+	}
+
+	return twins, nil
+}
+
+// Put save the whole twin.
+func (fs *FileStore) Put(twin *common.DigitalTwin) error {
+	if twin == nil || twin.ID == "" {
+		return errors.New("invalid twin")
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.writeFile(twin)
+}
+
+// Delete the twin file.
+func (fs *FileStore) Delete(twinID string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	err := os.Remove(fs.twinFile(twinID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// PatchProperty patch a property of the saved twin.
+func (fs *FileStore) PatchProperty(twinID string, version uint64, kind, name string, prop *common.TwinProperty) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	twin, err := fs.readFile(fs.twinFile(twinID))
+	if err != nil {
+		return err
+	}
+
+	var props map[string]*common.TwinProperty
+	switch kind {
+	case common.TWIN_PROP_KIND_DESIRED:
+		if twin.Properties.Desired == nil {
+			twin.Properties.Desired = make(map[string]*common.TwinProperty)
+		}
+		props = twin.Properties.Desired
+	case common.TWIN_PROP_KIND_REPORTED:
+		if twin.Properties.Reported == nil {
+			twin.Properties.Reported = make(map[string]*common.TwinProperty)
+		}
+		props = twin.Properties.Reported
+	default:
+		return errors.New("invalid property kind")
+	}
+
+	if prop == nil {
+		delete(props, name)
+	} else {
+		props[name] = prop
+	}
+	twin.Version = version
+
+	return fs.writeFile(twin)
+}
+
+// Close the file store.
+func (fs *FileStore) Close() error {
+	return nil
+}
+
+func (fs *FileStore) twinFile(twinID string) string {
+	return filepath.Join(fs.dir, url.PathEscape(twinID)+twinFileSuffix)
+}
+
+func (fs *FileStore) readFile(path string) (*common.DigitalTwin, error) {
+	var twin common.DigitalTwin
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &twin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &twin, nil
+}
+
+// writeFile write the twin into a temporary file, then rename it
+// to the twin file.
+func (fs *FileStore) writeFile(twin *common.DigitalTwin) error {
+	content, err := json.Marshal(twin)
+	if err != nil {
+		return err
+	}
+
+	path := fs.twinFile(twin.ID)
+	tmpPath := path + tmpFileSuffix
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	// sync the directory to make sure the rename is on disk.
+	dir, err := os.Open(fs.dir)
+	if err != nil {
+		return nil
+	}
+	dir.Sync()
+	dir.Close()
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package dtstore
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+	"github.com/jwzl/edgeOn/common"
+)
+
+func newTestStore(t *testing.T) (*FileStore, string) {
+	dir, err := ioutil.TempDir("", "dtstore")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore failed (%v)", err)
+	}
+
+	return store, dir
+}
+
+func TestPutAndLoadAll(t *testing.T) {
+	store, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	twin := &common.DigitalTwin{
+		ID:	"dev/001",
+		Name:	"sensor0",
+		State:	common.DGTWINS_STATE_CREATED,
+	}
+	if err := store.Put(twin); err != nil {
+		t.Fatalf("Put failed (%v)", err)
+	}
+
+	// reopen the store like a restart.
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore failed (%v)", err)
+	}
+	twins, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll failed (%v)", err)
+	}
+	if len(twins) != 1 {
+		t.Fatalf("got %d twins, want 1", len(twins))
+	}
+	if twins[0].ID != twin.ID || twins[0].Name != twin.Name {
+		t.Errorf("got twin %v, want %v", twins[0], twin)
+	}
+}
+
+func TestPatchProperty(t *testing.T) {
+	store, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	if err := store.PatchProperty("dev001", 2, common.TWIN_PROP_KIND_DESIRED, "reboot", nil); err == nil {
+		t.Errorf("patch a not exist twin should fail")
+	}
+
+	store.Put(&common.DigitalTwin{ID: "dev001"})
+	prop := &common.TwinProperty{Name: "reboot", Value: []byte("1")}
+	if err := store.PatchProperty("dev001", 2, common.TWIN_PROP_KIND_DESIRED, "reboot", prop); err != nil {
+		t.Fatalf("PatchProperty failed (%v)", err)
+	}
+	if err := store.PatchProperty("dev001", 2, common.TWIN_PROP_KIND_REPORTED, "temp", prop); err != nil {
+		t.Fatalf("PatchProperty failed (%v)", err)
+	}
+	if err := store.PatchProperty("dev001", 2, common.TWIN_PROP_KIND_REPORTED, "temp", nil); err != nil {
+		t.Fatalf("PatchProperty failed (%v)", err)
+	}
+
+	twins, _ := store.LoadAll()
+	if len(twins) != 1 {
+		t.Fatalf("got %d twins, want 1", len(twins))
+	}
+	desired := twins[0].Properties.Desired
+	if val, exist := desired["reboot"]; !exist || string(val.Value) != "1" {
+		t.Errorf("desired property reboot is not saved")
+	}
+	if twins[0].Version != 2 {
+		t.Errorf("twin version is %d, want 2", twins[0].Version)
+	}
+	if _, exist := twins[0].Properties.Reported["temp"]; exist {
+		t.Errorf("reported property temp is not deleted")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	store, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	store.Put(&common.DigitalTwin{ID: "dev001"})
+	if err := store.Delete("dev001"); err != nil {
+		t.Fatalf("Delete failed (%v)", err)
+	}
+	if err := store.Delete("dev001"); err != nil {
+		t.Errorf("Delete a not exist twin should success (%v)", err)
+	}
+
+	twins, _ := store.LoadAll()
+	if len(twins) != 0 {
+		t.Errorf("got %d twins, want 0", len(twins))
+	}
+}
@@ -0,0 +1,54 @@
+package dtstore
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"github.com/jwzl/edgeOn/common"
+)
+
+// LoadModels load all device models from the directory, one JSON
+// document (*.json) per model. not exist directory means no models.
+func LoadModels(dir string) ([]*common.DeviceModel, error) {
+	models := make([]*common.DeviceModel, 0)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return models, nil
+		}
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		model := &common.DeviceModel{}
+		if err := json.Unmarshal(content, model); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := model.Check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if exist, ok := names[model.Name]; ok {
+			return nil, fmt.Errorf("%s: model (%s) is already declared in %s", path, model.Name, exist)
+		}
+		names[model.Name] = path
+
+		models = append(models, model)
+	}
+
+	return models, nil
+}
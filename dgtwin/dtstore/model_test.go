@@ -0,0 +1,48 @@
+package dtstore
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+)
+
+func TestLoadModels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dtmodel")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	model := `{"name":"thermostat","properties":[{"name":"target","type":"float","min":10,"max":40},{"name":"temp","type":"float","readonly":true}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "thermostat.json"), []byte(model), 0644); err != nil {
+		t.Fatalf("write model failed (%v)", err)
+	}
+	// not a model document.
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("models"), 0644)
+
+	models, err := LoadModels(dir)
+	if err != nil || len(models) != 1 {
+		t.Fatalf("LoadModels failed (%v, %v)", models, err)
+	}
+	schema := models[0].GetProperty("target")
+	if schema == nil || schema.Min == nil || *schema.Min != 10 || schema.Validate([]byte("41")) == nil {
+		t.Fatalf("unexpected property schema (%v)", schema)
+	}
+	if models[0].GetProperty("temp") == nil || !models[0].GetProperty("temp").ReadOnly {
+		t.Fatal("temp should be read-only")
+	}
+
+	// invalid model.
+	bad := `{"name":"bad","properties":[{"name":"x","type":"int128"}]}`
+	ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte(bad), 0644)
+	if _, err := LoadModels(dir); err == nil {
+		t.Fatal("model with unsupported type should fail")
+	}
+
+	// not exist directory.
+	models, err = LoadModels(filepath.Join(dir, "none"))
+	if err != nil || len(models) != 0 {
+		t.Fatalf("not exist directory should has no models (%v)", err)
+	}
+}
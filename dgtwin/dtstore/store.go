@@ -0,0 +1,22 @@
+package dtstore
+
+import (
+	"github.com/jwzl/edgeOn/common"
+)
+
+// TwinStore is the persistent storage of digital twins, all twins
+// in DTContext.DGTwinList are saved here, so they can survive restart
+// or power loss.
+type TwinStore interface {
+	// LoadAll load all saved twins.
+	LoadAll() ([]*common.DigitalTwin, error)
+	// Put create or replace the whole twin.
+	Put(twin *common.DigitalTwin) error
+	// Delete the twin by twin ID.
+	Delete(twinID string) error
+	// PatchProperty create or replace a desired/reported property of the twin,
+	// if prop is nil, the property will be deleted. version is the new twin version.
+	PatchProperty(twinID string, version uint64, kind, name string, prop *common.TwinProperty) error
+	// Close the store.
+	Close() error
+}
@@ -0,0 +1,133 @@
+package types
+
+import (
+	"fmt"
+	"path"
+)
+
+const (
+	ACL_EFFECT_ALLOW	= "allow"
+	ACL_EFFECT_DENY		= "deny"
+)
+
+// ACLPolicy decide which source may do which operation on which twin.
+// the rules are evaluated in order and the first matched rule wins, the
+// Default effect is used if no rule is matched.
+type ACLPolicy struct {
+	// allow or deny, default allow.
+	Default		string		`json:"default,omitempty"`
+	Rules		[]ACLRule	`json:"rules,omitempty"`
+}
+
+// ACLRule match a request by the patterns (path.Match syntax, e.g.
+// "edge/app/*", "sensor-*"), empty field matches anything.
+type ACLRule struct {
+	// allow or deny.
+	Effect		string		`json:"effect"`
+	// source of message, e.g. cloud, device, edge/app/{appID}.
+	Sources		[]string	`json:"sources,omitempty"`
+	Operations	[]string	`json:"operations,omitempty"`
+	Resources	[]string	`json:"resources,omitempty"`
+	// twin ID, device model name and metadata of twin, the rule
+	// with these fields never matches the request without twin, but
+	// it's applied to each twin in the result of the request.
+	Twins		[]string			`json:"twins,omitempty"`
+	Models		[]string			`json:"models,omitempty"`
+	MetaData	map[string]string	`json:"metadata,omitempty"`
+}
+
+// ACLRequest is the request to be authorized, one per twin.
+type ACLRequest struct {
+	Source		string
+	Operation	string
+	Resource	string
+	// twin ID, empty means no twin in request.
+	TwinID		string
+	Model		string
+	MetaData	map[string]string
+}
+
+// Check check the effects and patterns of the policy.
+func (p *ACLPolicy) Check() error {
+	if p.Default != "" && p.Default != ACL_EFFECT_ALLOW && p.Default != ACL_EFFECT_DENY {
+		return fmt.Errorf("invalid default effect %q", p.Default)
+	}
+
+	for key, rule := range p.Rules {
+		if rule.Effect != ACL_EFFECT_ALLOW && rule.Effect != ACL_EFFECT_DENY {
+			return fmt.Errorf("rule %d: invalid effect %q", key, rule.Effect)
+		}
+
+		patterns := make([]string, 0)
+		patterns = append(patterns, rule.Sources...)
+		patterns = append(patterns, rule.Operations...)
+		patterns = append(patterns, rule.Resources...)
+		patterns = append(patterns, rule.Twins...)
+		patterns = append(patterns, rule.Models...)
+		for _, pattern := range rule.MetaData {
+			patterns = append(patterns, pattern)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid pattern %q", key, pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Allowed evaluate the request against the policy.
+func (p *ACLPolicy) Allowed(req *ACLRequest) bool {
+	for _, rule := range p.Rules {
+		if rule.Match(req) {
+			return rule.Effect == ACL_EFFECT_ALLOW
+		}
+	}
+
+	return p.Default != ACL_EFFECT_DENY
+}
+
+// Match check all fields of the rule match the request.
+func (r *ACLRule) Match(req *ACLRequest) bool {
+	if !matchAny(r.Sources, req.Source) || !matchAny(r.Operations, req.Operation) ||
+			!matchAny(r.Resources, req.Resource) {
+		return false
+	}
+
+	if len(r.Twins) < 1 && len(r.Models) < 1 && len(r.MetaData) < 1 {
+		return true
+	}
+	if req.TwinID == "" {
+		return false
+	}
+	if !matchAny(r.Twins, req.TwinID) || !matchAny(r.Models, req.Model) {
+		return false
+	}
+	for name, pattern := range r.MetaData {
+		value, exist := req.MetaData[name]
+		if !exist {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchAny check the value matches any pattern, no pattern matches anything.
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) < 1 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"time"
+	"math/rand"
 	"github.com/jwzl/wssocket/model"
 )
 
@@ -10,8 +12,41 @@ const (
 	DGTWINS_MODULE_TWINS	= "twins"
 	DGTWINS_MODULE_PROPERTY	= "property"
 	DGTWINS_MODULE_COMM	= "comm"
+	DGTWINS_MODULE_RECONCILE	= "reconcile"
+	DGTWINS_MODULE_LIFECYCLE	= "lifecycle"
+	DGTWINS_MODULE_METHOD	= "method"
 
 	DGTWINS_MSG_TIMEOUT = 1*60		//5s 
+
+	// interval to check the messages which wait for response.
+	DGTWINS_RETRY_CHECK_INTERVAL = 500*time.Millisecond
+
+	// default timeout to wait for the result of method.
+	DGTWINS_METHOD_TIMEOUT = 30*time.Second
+	// interval to check the methods which wait for result.
+	DGTWINS_METHOD_CHECK_INTERVAL = 100*time.Millisecond
+
+	// interval to check the liveness of twins.
+	DGTWINS_LIVENESS_CHECK_INTERVAL = 1*time.Second
+	// default liveness policy.
+	DGTWINS_LIVENESS_INTERVAL = 30
+	DGTWINS_LIVENESS_MISS_TOLERANCE = 3
+
+	// retry policy targets.
+	DGTWINS_RETRY_TARGET_DEVICE	= "device"
+	DGTWINS_RETRY_TARGET_CLOUD	= "cloud"
+	DGTWINS_RETRY_TARGET_APP	= "app"
+
+	// default and max page size of twin list.
+	DGTWINS_LIST_PAGE_SIZE		= 100
+	DGTWINS_LIST_MAX_PAGE_SIZE	= 1000
+	// default and max page size of audit query.
+	DGTWINS_AUDIT_PAGE_SIZE		= 100
+	DGTWINS_AUDIT_MAX_PAGE_SIZE	= 1000
+
+	// default max count and max age (second) of each property history.
+	DGTWINS_HISTORY_MAX_COUNT	= 100
+	DGTWINS_HISTORY_MAX_AGE		= 60*60
 )
 
 type DTMessage struct {
@@ -21,6 +56,52 @@ type DTMessage struct {
 	Operation   string
 }
 
+// RetryPolicy is the policy to resend a message which has no response.
+type RetryPolicy struct {
+	// max times to send the message, includes the first sending.
+	MaxAttempts		int
+	// backoff before the first resending, and it's multiplied by
+	// Multiplier for each resending until MaxBackoff.
+	InitialBackoff	time.Duration
+	MaxBackoff		time.Duration
+	Multiplier		float64
+	// random factor of backoff, backoff is in [backoff*(1-Jitter), backoff*(1+Jitter)].
+	Jitter			float64
+}
+
+// Backoff return the backoff after the message has been sent attempts times.
+func (rp *RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := float64(rp.InitialBackoff)
+	for i := 1; i < attempts; i++ {
+		backoff *= rp.Multiplier
+		if backoff >= float64(rp.MaxBackoff) {
+			break
+		}
+	}
+	if backoff > float64(rp.MaxBackoff) {
+		backoff = float64(rp.MaxBackoff)
+	}
+	if rp.Jitter > 0 {
+		backoff += backoff * rp.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(backoff)
+}
+
+// CachedMessage is a message in MessageCache which is waiting for response.
+type CachedMessage struct {
+	Msg				*model.Message
+	// the request which causes this message, it will be notified
+	// when the message can't be delivered. nil means no requester.
+	Requester		*model.Message
+	// times the message has been sent.
+	Attempts		int
+	NextRetry		time.Time
+	Policy			*RetryPolicy
+	// target of retry policy, one of DGTWINS_RETRY_TARGET_*.
+	RetryTarget		string
+}
+
 type WatchEvent	struct {
 	MsgID		string
 	TwinID		string
@@ -52,3 +133,19 @@ func CreateWatchEvent(msgID, twinID, source, resource string) *WatchEvent {
 //1. Retrieve device twin
 //2. Partially update reported properties
 //3. Observe desired properties
+
+// IsWatched check the property is watched by this event,
+// empty list means all properties are watched.
+func (we *WatchEvent) IsWatched(name string) bool {
+	if len(we.List) < 1 {
+		return true
+	}
+
+	for _, val := range we.List {
+		if val == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -21,7 +21,8 @@ type EventBusConfig struct {
 	// MqttSessionQueueSize indicates the size of how many sessions will be handled.
 	// default 100
 	MqttSessionQueueSize int `json:"mqttSessionQueueSize,omitempty"`
-	// MqttServerInternal indicates internal mqtt broker url
+	// MqttServerInternal indicates internal mqtt broker urls separated by comma,
+	// ssl:// and wss:// listeners need MqttCertFile and MqttKeyFile.
 	// default tcp://127.0.0.1:1884
 	MqttServerInternal string `json:"mqttServerInternal,omitempty"`
 	// MqttServerExternal indicates external mqtt broker url
@@ -32,6 +33,21 @@ type EventBusConfig struct {
 	// +Required
 	// default: 0
 	MqttMode int `json:"mqttMode"`
+	// MqttAuthFile indicates the user table (JSON) of internal mqtt broker,
+	// each user can only access the topics of its devices.
+	// default "", any client is accepted.
+	MqttAuthFile string `json:"mqttAuthFile,omitempty"`
+	// MqttCaFile indicates the CA to verify the client certificates of
+	// ssl:// and wss:// listeners, the client certificate is optional
+	// unless MqttRequireClientCert is true.
+	MqttCaFile string `json:"mqttCaFile,omitempty"`
+	// MqttCertFile and MqttKeyFile indicate the server certificate and key.
+	MqttCertFile string `json:"mqttCertFile,omitempty"`
+	MqttKeyFile string `json:"mqttKeyFile,omitempty"`
+	// MqttRequireClientCert indicates the client must have a certificate
+	// signed by MqttCaFile.
+	// default false
+	MqttRequireClientCert bool `json:"mqttRequireClientCert,omitempty"`
 }
 
 func GetEventBusConfig() *EventBusConfig {
@@ -79,5 +95,40 @@ func GetEventBusConfig() *EventBusConfig {
 	}
 	eBConfig.MqttMode = mode
 
+	authFile, err := config.CONFIG.GetValue("eventbus.mqtt.auth-file").ToString()
+	if err != nil {
+		klog.Infof("eventbus.mqtt.auth-file is empty")
+		authFile = ""
+	}
+	eBConfig.MqttAuthFile = authFile
+
+	caFile, err := config.CONFIG.GetValue("eventbus.mqtt.cafile").ToString()
+	if err != nil {
+		klog.Infof("eventbus.mqtt.cafile is empty")
+		caFile = ""
+	}
+	eBConfig.MqttCaFile = caFile
+
+	certFile, err := config.CONFIG.GetValue("eventbus.mqtt.certfile").ToString()
+	if err != nil {
+		klog.Infof("eventbus.mqtt.certfile is empty")
+		certFile = ""
+	}
+	eBConfig.MqttCertFile = certFile
+
+	keyFile, err := config.CONFIG.GetValue("eventbus.mqtt.keyfile").ToString()
+	if err != nil {
+		klog.Infof("eventbus.mqtt.keyfile is empty")
+		keyFile = ""
+	}
+	eBConfig.MqttKeyFile = keyFile
+
+	requireClientCert, err := config.CONFIG.GetValue("eventbus.mqtt.require-client-cert").ToBool()
+	if err != nil {
+		klog.Infof("eventbus.mqtt.require-client-cert is empty")
+		requireClientCert = false
+	}
+	eBConfig.MqttRequireClientCert = requireClientCert
+
 	return eBConfig
 } 
@@ -8,6 +8,8 @@ import (
 
 	"k8s.io/klog"
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/beehive/pkg/core"
 	"github.com/jwzl/beehive/pkg/core/context"
 
@@ -19,6 +21,9 @@ import (
 var (
 	// TokenWaitTime to wait
 	TokenWaitTime = 120 * time.Second
+
+	publishesTotal = metrics.NewCounter("edgeon_eventbus_publishes_total",
+					"Messages published to mqtt broker by mode.", "mode")
 )
 
 const (
@@ -68,6 +73,23 @@ func (eb *EventBus) Start(c *context.Context) {
 											eb.conf.MqttServerInternal, 
 											eb.conf.MqttRetain, eb.conf.MqttQOS, c)
 		eb.MqttServer.InitInternalTopics()
+		if eb.conf.MqttAuthFile != "" {
+			auth, err := mqttBus.LoadMqttAuth(eb.conf.MqttAuthFile)
+			if err != nil {
+				klog.Errorf("Load mqtt users failed, %s", err.Error())
+				os.Exit(1)
+			}
+			eb.MqttServer.SetAuth(auth)
+		}
+		if eb.conf.MqttCertFile != "" && eb.conf.MqttKeyFile != "" {
+			tlsConfig, err := mqttBus.CreateTLSConfig(eb.conf.MqttCaFile, eb.conf.MqttCertFile,
+											eb.conf.MqttKeyFile, eb.conf.MqttRequireClientCert)
+			if err != nil {
+				klog.Errorf("Create tlsconfig of internel mqtt broker failed, %s", err.Error())
+				os.Exit(1)
+			}
+			eb.MqttServer.SetTLSConfig(tlsConfig)
+		}
 		err := eb.MqttServer.Run()
 		if err != nil {
 			klog.Errorf("Launch internel mqtt broker failed, %s", err.Error())
@@ -98,6 +120,7 @@ func (eb *EventBus) pubEdgeToDevice(c *context.Context){
 			//invalid message type or msg == nil, Ignored. 		
 			continue
 		}
+		start := time.Now()
 		
 		s := msg.GetSource()
 		source := strings.Split(s, "/")
@@ -120,7 +143,7 @@ func (eb *EventBus) pubEdgeToDevice(c *context.Context){
 		}
 		/*
 		* device topic format is :
-		* 	$hw/events/device/deviceID/source/target/operation/resource/msgparentid	
+		* 	$hw/events/device/deviceID/source/target/operation/resource/msgparentid/traceid
 		*/
 		topic := fmt.Sprintf("$hw/events/device/%s/%s/%s/%s/%s", splitString[1], source[1],
 										splitString[0], msg.GetOperation(), msg.GetResource())
@@ -130,6 +153,7 @@ func (eb *EventBus) pubEdgeToDevice(c *context.Context){
 		}else {
 			topic = fmt.Sprintf("%s/%s", topic, msg.GetID())
 		}
+		topic = fmt.Sprintf("%s/%s", topic, trace.Start(msg))
 
 		payload, ok :=msg.GetContent().([]byte)
 		if !ok {
@@ -138,7 +162,10 @@ func (eb *EventBus) pubEdgeToDevice(c *context.Context){
 		
 		klog.Infof("topic: %s, payload = %s send to device", topic, payload)
 		//send to device.
+		opLabel, resourceLabel := common.MetricLabels(msg.GetOperation(), msg.GetResource())
+		metrics.MessagesTotal.Inc(common.BusModuleName, opLabel, resourceLabel)
 		eb.publish(topic, payload) 
+		trace.Record(common.BusModuleName, msg, start, trace.SPAN_OUTCOME_OK)
 	}
 }
 
@@ -151,11 +178,13 @@ func (eb *EventBus) publish(topic string, payload []byte) {
 		} else {
 			klog.Infof("Success in pubMQTT with topic: %s", topic)
 		}
+		publishesTotal.Inc("external")
 	}
 
 	if eb.conf.MqttMode <= MqttModeBoth {
 		// pub msg to internal mqtt broker.
 		eb.MqttServer.Publish(topic, payload)
+		publishesTotal.Inc("internal")
 	}
 }
 
@@ -0,0 +1,285 @@
+package mqtt
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"strings"
+	"io/ioutil"
+	"crypto/subtle"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/packet"
+)
+
+const (
+	// device publishes to $hw/events/twin/deviceID/..., and
+	// subscribes $hw/events/device/deviceID/...
+	TopicEventsPrefix	= "$hw/events/"
+	TopicKindTwin		= "twin"
+	TopicKindDevice		= "device"
+)
+
+// deviceOperations are the operations which device can publish.
+var deviceOperations = map[string]bool{
+	common.DGTWINS_OPS_UPDATE:		true,
+	common.DGTWINS_OPS_SYNC:		true,
+	common.DGTWINS_OPS_RESPONSE:	true,
+}
+
+// deviceFields are the fields of device messages (DeviceMessage,
+// DeviceResponse and DeviceMethodResponse).
+var deviceFields = map[string]bool{
+	"twin":		true,
+	"twinid":	true,
+	"code":		true,
+	"reason":	true,
+	"result":	true,
+}
+
+// MqttUser is a client of internal broker, it can only publish and
+// subscribe the topics of the devices it is authorized for.
+type MqttUser struct {
+	Username	string		`json:"username"`
+	Password	string		`json:"password"`
+	// patterns (path.Match syntax) of authorized device IDs.
+	Devices		[]string	`json:"devices"`
+}
+
+// MqttAuth is the user table of internal broker.
+type MqttAuth struct {
+	Users	[]*MqttUser	`json:"users"`
+	users	map[string]*MqttUser
+}
+
+// LoadMqttAuth load the user table from the JSON document.
+func LoadMqttAuth(filePath string) (*MqttAuth, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &MqttAuth{}
+	if err := json.Unmarshal(content, auth); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+
+	auth.users = make(map[string]*MqttUser)
+	for _, user := range auth.Users {
+		if user == nil || user.Username == "" {
+			return nil, fmt.Errorf("%s: user without username", filePath)
+		}
+		if _, exist := auth.users[user.Username]; exist {
+			return nil, fmt.Errorf("%s: duplicated user (%s)", filePath, user.Username)
+		}
+		for _, pattern := range user.Devices {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid device pattern %q", filePath, pattern)
+			}
+		}
+		auth.users[user.Username] = user
+	}
+
+	return auth, nil
+}
+
+// Authenticate return the user if the password is right, or nil.
+func (a *MqttAuth) Authenticate(username, password string) *MqttUser {
+	user, exist := a.users[username]
+	if !exist || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil
+	}
+
+	return user
+}
+
+// User return the user by name, or nil.
+func (a *MqttAuth) User(username string) *MqttUser {
+	return a.users[username]
+}
+
+// AllowDevice check the user is authorized for the device.
+func (u *MqttUser) AllowDevice(deviceID string) bool {
+	if deviceID == "" || strings.ContainsAny(deviceID, "+#") {
+		return false
+	}
+
+	for _, pattern := range u.Devices {
+		if matched, _ := path.Match(pattern, deviceID); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowTopic check the user can access the topic, the topic in
+// $hw/events/ must be the topic of kind for authorized device, the
+// other system topics ($...) are denied. wildcards are just allowed
+// under the topic of authorized device, since they match the topics
+// in $hw/events/ of all devices too.
+func (u *MqttUser) AllowTopic(topic, kind string) bool {
+	if !strings.HasPrefix(topic, TopicEventsPrefix) {
+		return !strings.HasPrefix(topic, "$") && !strings.ContainsAny(topic, "+#")
+	}
+
+	//topic format is :$hw/events/kind/deviceID/...
+	splitString := strings.Split(topic, "/")
+	if len(splitString) < 4 || splitString[2] != kind {
+		return false
+	}
+
+	return u.AllowDevice(splitString[3])
+}
+
+// BindMessage bind the message published in $hw/events/twin/ to the
+// device of topic: the source is always device, the operation must be
+// the one device can do, and each twin in payload is the device of
+// topic (the message without twin is bound to it by twinid). it
+// returns the topic and payload which should be published.
+func (u *MqttUser) BindMessage(topic string, payload []byte) (string, []byte, error) {
+	if !strings.HasPrefix(topic, TopicEventsPrefix) {
+		return topic, payload, nil
+	}
+
+	//topic format is :$hw/events/twin/deviceID/source/target/operation/resource/...
+	splitString := strings.Split(topic, "/")
+	if len(splitString) < 8 {
+		return "", nil, fmt.Errorf("invalid topic %s", topic)
+	}
+	if !deviceOperations[splitString[6]] {
+		return "", nil, fmt.Errorf("device can't %s", splitString[6])
+	}
+	deviceID := splitString[3]
+	splitString[4] = common.DeviceName
+
+	// the fields out of device messages are denied, so the twin can't
+	// be referred by any other field.
+	fields := make(map[string]json.RawMessage)
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return "", nil, fmt.Errorf("invalid payload (%v)", err)
+		}
+	}
+	for key := range fields {
+		if !deviceFields[key] {
+			return "", nil, fmt.Errorf("invalid field %s in payload", key)
+		}
+	}
+
+	if content, exist := fields["twin"]; exist {
+		twin := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(content, &twin); err != nil {
+			return "", nil, fmt.Errorf("invalid twin (%v)", err)
+		}
+		if err := bindTwinID(twin, "id", deviceID); err != nil {
+			return "", nil, err
+		}
+		fields["twin"], _ = json.Marshal(twin)
+	}
+	if err := bindTwinID(fields, "twinid", deviceID); err != nil {
+		return "", nil, err
+	}
+
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return strings.Join(splitString, "/"), content, nil
+}
+
+// bindTwinID set the twin ID in key to deviceID, it fails if the
+// twin ID is another twin.
+func bindTwinID(fields map[string]json.RawMessage, key, deviceID string) error {
+	if content, exist := fields[key]; exist {
+		var twinID string
+		if err := json.Unmarshal(content, &twinID); err != nil {
+			return fmt.Errorf("invalid %s (%v)", key, err)
+		}
+		if twinID != "" && twinID != deviceID {
+			return fmt.Errorf("device %s can't refer twin %s", deviceID, twinID)
+		}
+	}
+	fields[key], _ = json.Marshal(deviceID)
+
+	return nil
+}
+
+// authBackend authenticate the clients by the user table, and check
+// each publish and subscription of the client.
+type authBackend struct {
+	*broker.MemoryBackend
+	auth		*MqttAuth
+	// authenticated clients, key is *broker.Client, value is *MqttUser.
+	clients		sync.Map
+}
+
+func newAuthBackend(backend *broker.MemoryBackend, auth *MqttAuth) *authBackend {
+	return &authBackend{
+		MemoryBackend:	backend,
+		auth:			auth,
+	}
+}
+
+// Authenticate authenticate the client by password, or by the verified client
+// certificate whose common name is the username.
+func (ab *authBackend) Authenticate(client *broker.Client, username, password string) (bool, error) {
+	user := ab.auth.Authenticate(username, password)
+	if user == nil {
+		if name := clientCertName(client); name != "" && (username == "" || username == name) {
+			user = ab.auth.User(name)
+		}
+	}
+	if user == nil {
+		klog.Warningf("mqtt client (%s) authenticate failed", username)
+		return false, nil
+	}
+
+	ab.clients.Store(client, user)
+	return true, nil
+}
+
+func (ab *authBackend) user(client *broker.Client) *MqttUser {
+	v, exist := ab.clients.Load(client)
+	if !exist {
+		return nil
+	}
+
+	return v.(*MqttUser)
+}
+
+func (ab *authBackend) Publish(client *broker.Client, msg *packet.Message, ack broker.Ack) error {
+	user := ab.user(client)
+	if user == nil || !user.AllowTopic(msg.Topic, TopicKindTwin) {
+		return fmt.Errorf("client is not allowed to publish %s", msg.Topic)
+	}
+	topic, payload, err := user.BindMessage(msg.Topic, msg.Payload)
+	if err != nil {
+		return fmt.Errorf("client is not allowed to publish %s (%v)", msg.Topic, err)
+	}
+
+	bound := *msg
+	bound.Topic = topic
+	bound.Payload = payload
+	return ab.MemoryBackend.Publish(client, &bound, ack)
+}
+
+func (ab *authBackend) Subscribe(client *broker.Client, subs []packet.Subscription, ack broker.Ack) error {
+	user := ab.user(client)
+	for _, sub := range subs {
+		if user == nil || !user.AllowTopic(sub.Topic, TopicKindDevice) {
+			return fmt.Errorf("client is not allowed to subscribe %s", sub.Topic)
+		}
+	}
+
+	return ab.MemoryBackend.Subscribe(client, subs, ack)
+}
+
+func (ab *authBackend) Terminate(client *broker.Client) error {
+	ab.clients.Delete(client)
+
+	return ab.MemoryBackend.Terminate(client)
+}
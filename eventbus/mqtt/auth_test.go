@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/packet"
+)
+
+func TestAuthBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttauth")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	authFile := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(authFile, []byte(`{"users":[
+		{"username":"gateway01","password":"secret","devices":["sensor-*"]}
+	]}`), 0600)
+	auth, err := LoadMqttAuth(authFile)
+	if err != nil {
+		t.Fatalf("load users failed (%v)", err)
+	}
+
+	ab := newAuthBackend(broker.NewMemoryBackend(), auth)
+	client := &broker.Client{}
+	if ok, _ := ab.Authenticate(client, "gateway01", "wrong"); ok {
+		t.Errorf("client with wrong password is authenticated")
+	}
+	if err := ab.Publish(client, &packet.Message{Topic: "$hw/events/twin/sensor-01/device/dgtwin/Update/twins"}, nil); err == nil {
+		t.Errorf("unauthenticated client can publish")
+	}
+	if ok, _ := ab.Authenticate(client, "gateway01", "secret"); !ok {
+		t.Fatalf("client with right password is not authenticated")
+	}
+
+	tests := []struct {
+		name	string
+		topic	string
+		payload	string
+		allowed	bool
+	}{
+		{"own device", "$hw/events/twin/sensor-01/device/dgtwin/Update/twins", `{"twin":{"id":"sensor-01"}}`, true},
+		{"other device", "$hw/events/twin/switch-01/device/dgtwin/Update/twins", `{"twin":{"id":"switch-01"}}`, false},
+		{"other twin in payload", "$hw/events/twin/sensor-01/device/dgtwin/Update/twins", `{"twin":{"id":"switch-01"}}`, false},
+		{"other twinid in payload", "$hw/events/twin/sensor-01/cloud/dgtwin/Invoke/method", `{"twinid":"switch-01","method":"reboot"}`, false},
+		{"other twinid in response", "$hw/events/twin/sensor-01/device/dgtwin/Response/method", `{"twinid":"switch-01","code":"200"}`, false},
+		{"unknown field in payload", "$hw/events/twin/sensor-01/device/dgtwin/Response/twins", `{"code":"200","twins":[{"id":"switch-01"}]}`, false},
+		{"operation of cloud", "$hw/events/twin/sensor-01/cloud/dgtwin/List/twins", "", false},
+		{"short topic", "$hw/events/twin/sensor-01/device", "", false},
+		{"wildcard device", "$hw/events/twin/+/device/dgtwin/Update/twins", "", false},
+		{"message to device", "$hw/events/device/sensor-01/dgtwin/device/Update/twins", "", false},
+		{"application topic", "factory/line1/status", "running", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ab.Publish(client, &packet.Message{Topic: test.topic, Payload: []byte(test.payload)}, nil)
+			if (err == nil) != test.allowed {
+				t.Errorf("publish %s: allowed = %v, want %v", test.topic, err == nil, test.allowed)
+			}
+		})
+	}
+
+	user := auth.Authenticate("gateway01", "secret")
+	if !user.AllowTopic("$hw/events/device/sensor-01/#", TopicKindDevice) ||
+			user.AllowTopic("$hw/events/device/#", TopicKindDevice) {
+		t.Errorf("unexpected subscription authorization")
+	}
+	for _, topic := range []string{"#", "+/events/device/#", "factory/+/status"} {
+		err := ab.Subscribe(client, []packet.Subscription{{Topic: topic}}, nil)
+		if err == nil {
+			t.Errorf("client can subscribe %s", topic)
+		}
+	}
+
+	// the source and twins of message are bound to the device of topic.
+	topic, payload, err := user.BindMessage("$hw/events/twin/sensor-01/cloud/dgtwin/Response/method/1001",
+								[]byte(`{"code":"200","result":{"done":true}}`))
+	if err != nil || topic != "$hw/events/twin/sensor-01/device/dgtwin/Response/method/1001" ||
+			string(payload) != `{"code":"200","result":{"done":true},"twinid":"sensor-01"}` {
+		t.Errorf("unexpected bound message %s %s (%v)", topic, payload, err)
+	}
+	_, payload, err = user.BindMessage("$hw/events/twin/sensor-01/device/dgtwin/Update/twins",
+								[]byte(`{"twin":{"state":"online"}}`))
+	if err != nil || string(payload) != `{"twin":{"id":"sensor-01","state":"online"},"twinid":"sensor-01"}` {
+		t.Errorf("unexpected bound payload %s (%v)", payload, err)
+	}
+}
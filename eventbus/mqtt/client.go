@@ -16,6 +16,8 @@ import (
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/beehive/pkg/core/context"	
 )
@@ -91,14 +93,19 @@ func (mq *Client) OnSubMessageReceived(client MQTT.Client, message MQTT.Message)
 	// for "$hw/events/twin/#", send to twin
 	
 	if strings.HasPrefix(message.Topic(), "$hw/events/twin") {
-		now := time.Now().UnixNano() / 1e6
+		start := time.Now()
+		now := start.UnixNano() / 1e6
 	 
 		//Header
 		msg := model.NewMessage("")
 		msg.BuildHeader("", now)
 
 		splitString := strings.Split(message.Topic(), "/")
-		//topic format is :$hw/events/twin/deviceID/source/target/operation/resource/msgparentid
+		//topic format is :$hw/events/twin/deviceID/source/target/operation/resource/msgparentid/traceid
+		if len(splitString) < 8 {
+			klog.Warningf("Invalid topic %s, ignored", message.Topic())
+			return
+		}
 		source := splitString[4]
 		target := splitString[5]
 		operation := splitString[6] 
@@ -106,15 +113,21 @@ func (mq *Client) OnSubMessageReceived(client MQTT.Client, message MQTT.Message)
 		//Router
 		msg.BuildRouter(source, "", "edge/"+target, resource, operation)	
 
-		if len(splitString) == 9 {
+		if len(splitString) >= 9 {
 			msg.SetTag(splitString[8])	
 		}
+		if len(splitString) >= 10 {
+			trace.Join(msg, splitString[9])
+		}
 
 		//content
 		msg.Content = message.Payload
 
 		klog.Info(fmt.Sprintf("Received msg from mqttserver, deliver to %s with resource %s", common.TwinModuleName, resource))
+		opLabel, resourceLabel := common.MetricLabels(operation, resource)
+		metrics.MessagesTotal.Inc(common.BusModuleName, opLabel, resourceLabel)
 		mq.Context.Send(common.TwinModuleName, msg)
+		trace.Record(common.BusModuleName, msg, start, trace.SPAN_OUTCOME_OK)
 	}  
 }
 
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"time"
 	"strings"
+	"crypto/tls"
 	"k8s.io/klog"
 	
 	"github.com/jwzl/wssocket/model"
@@ -18,6 +19,8 @@ import (
 	"github.com/256dpi/gomqtt/transport"
 
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/beehive/pkg/core/context"
 )
 
@@ -30,14 +33,18 @@ var (
 )
 //Server serve as an internal mqtt broker.
 type Server struct {
-	// Internal mqtt url
+	// Internal mqtt urls, separated by comma, e.g.
+	// tcp://127.0.0.1:1884,ssl://0.0.0.0:8883
 	url string
 
+	// TLS config of ssl:// and wss:// listeners.
+	tlsConfig *tls.Config
+
 	// Used to save and match topic, it is thread-safe tree.
 	tree *topic.Tree
 
-	// A server accepts incoming connections.
-	server transport.Server
+	// Servers accept incoming connections, one per url.
+	servers []transport.Server
 
 	// A MemoryBackend stores all in memory.
 	backend *broker.MemoryBackend
@@ -55,6 +62,9 @@ type Server struct {
 	// A sessionQueueSize will default to 100
 	sessionQueueSize int
 
+	// user table of clients, nil means any client is accepted.
+	auth	*MqttAuth
+
 	// beehive context.
 	Context			*context.Context
 }
@@ -72,14 +82,41 @@ func NewMqttServer(sqz int, url string, retain bool, qos int, c *context.Context
 	}
 }
 
-// Run launch a server and accept connections.
+// SetAuth set the user table, the clients must be authenticated and
+// can only access the topics of their devices.
+func (m *Server) SetAuth(auth *MqttAuth) {
+	m.auth = auth
+}
+
+// SetTLSConfig set the TLS config of ssl:// and wss:// listeners.
+func (m *Server) SetTLSConfig(tlsConfig *tls.Config) {
+	m.tlsConfig = tlsConfig
+}
+
+// Run launch a server for each url and accept connections.
 func (m *Server) Run() error {
-	var err error
+	launcher := transport.NewLauncher(transport.LaunchConfig{TLSConfig: m.tlsConfig})
+	for _, url := range strings.Split(m.url, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if m.tlsConfig == nil && (strings.HasPrefix(url, "ssl://") || strings.HasPrefix(url, "wss://") ||
+				strings.HasPrefix(url, "tls://") || strings.HasPrefix(url, "mqtts://")) {
+			m.closeServers()
+			return fmt.Errorf("no certificate for secure listener %s", url)
+		}
 
-	m.server, err = transport.Launch(m.url)
-	if err != nil {
-		klog.Errorf("Launch transport failed %v", err)
-		return err
+		server, err := launcher.Launch(url)
+		if err != nil {
+			klog.Errorf("Launch transport %s failed %v", url, err)
+			m.closeServers()
+			return err
+		}
+		m.servers = append(m.servers, server)
+	}
+	if len(m.servers) < 1 {
+		return fmt.Errorf("no internal mqtt url")
 	}
 
 	m.backend = broker.NewMemoryBackend()
@@ -93,25 +130,43 @@ func (m *Server) Run() error {
 		}
 	}
 
-	engine := broker.NewEngine(m.backend)
-	engine.Accept(m.server)
+	var backend broker.Backend = m.backend
+	if m.auth != nil {
+		backend = newAuthBackend(m.backend, m.auth)
+	}
+	engine := broker.NewEngine(backend)
+	for _, server := range m.servers {
+		engine.Accept(server)
+	}
 
 	return nil
 }
 
+func (m *Server) closeServers() {
+	for _, server := range m.servers {
+		server.Close()
+	}
+	m.servers = nil
+}
+
 // onSubscribe will be called if the topic is matched in topic tree.
 func (m *Server) onSubscribe(message *packet.Message) {
 	// for "$hw/events/twin/#", send to twin
 	
 	if strings.HasPrefix(message.Topic, "$hw/events/twin") {
-		now := time.Now().UnixNano() / 1e6
+		start := time.Now()
+		now := start.UnixNano() / 1e6
 	 
 		//Header
 		msg := model.NewMessage("")
 		msg.BuildHeader("", now)
 
 		splitString := strings.Split(message.Topic, "/")
-		//topic format is :$hw/events/twin/deviceID/source/target/operation/resource/msgparentid
+		//topic format is :$hw/events/twin/deviceID/source/target/operation/resource/msgparentid/traceid
+		if len(splitString) < 8 {
+			klog.Warningf("Invalid topic %s, ignored", message.Topic)
+			return
+		}
 		source := splitString[4]
 		target := splitString[5]
 		operation := splitString[6] 
@@ -119,15 +174,21 @@ func (m *Server) onSubscribe(message *packet.Message) {
 		//Router
 		msg.BuildRouter(source, "", "edge/"+target, resource, operation)	
 
-		if len(splitString) == 9 {
+		if len(splitString) >= 9 {
 			msg.SetTag(splitString[8])	
 		}
+		if len(splitString) >= 10 {
+			trace.Join(msg, splitString[9])
+		}
 
 		//content
 		msg.Content = message.Payload
 
 		klog.Info(fmt.Sprintf("Received msg from mqttserver, deliver to %s with resource %s", common.TwinModuleName, resource))
+		opLabel, resourceLabel := common.MetricLabels(operation, resource)
+		metrics.MessagesTotal.Inc(common.BusModuleName, opLabel, resourceLabel)
 		m.Context.Send(common.TwinModuleName, msg)
+		trace.Record(common.BusModuleName, msg, start, trace.SPAN_OUTCOME_OK)
 	}  
 }
 
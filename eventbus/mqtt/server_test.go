@@ -0,0 +1,33 @@
+package mqtt
+
+import (
+	"testing"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/beehive/pkg/core/context"
+)
+
+func TestOnSubscribeMetricLabels(t *testing.T) {
+	ctx := context.GetContext(context.MsgCtxTypeChannel)
+	ctx.AddModule(common.TwinModuleName)
+	server := NewMqttServer(100, "tcp://127.0.0.1:1884", false, 0, ctx)
+
+	others := metrics.MessagesTotal.Value(common.BusModuleName, common.METRIC_LABEL_OTHER, common.METRIC_LABEL_OTHER)
+	updates := metrics.MessagesTotal.Value(common.BusModuleName, common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_TWINS)
+	server.onSubscribe(&packet.Message{Topic: "$hw/events/twin/sensor-01/device/dgtwin/Update/twins"})
+	// the operation and resource of device topic are not label values.
+	server.onSubscribe(&packet.Message{Topic: "$hw/events/twin/sensor-01/device/dgtwin/op-12345/res-12345"})
+	ctx.Receive(common.TwinModuleName)
+	ctx.Receive(common.TwinModuleName)
+
+	if v := metrics.MessagesTotal.Value(common.BusModuleName, common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_TWINS); v != updates+1 {
+		t.Errorf("Update/twins count is %v, want %v", v, updates+1)
+	}
+	if v := metrics.MessagesTotal.Value(common.BusModuleName, common.METRIC_LABEL_OTHER, common.METRIC_LABEL_OTHER); v != others+1 {
+		t.Errorf("other count is %v, want %v", v, others+1)
+	}
+	if v := metrics.MessagesTotal.Value(common.BusModuleName, "op-12345", "res-12345"); v != 0 {
+		t.Errorf("device operation is a label value")
+	}
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/transport"
+)
+
+// CreateTLSConfig create the TLS config of ssl:// and wss:// listeners. the
+// client certificate is verified by the CA if it is given, and it's
+// required if requireClientCert is true.
+func CreateTLSConfig(caFile, certFile, keyFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:	[]tls.Certificate{cert},
+		ClientAuth:		tls.NoClientCert,
+		MinVersion:		tls.VersionTLS12,
+	}
+
+	if caFile == "" {
+		if requireClientCert {
+			return nil, fmt.Errorf("client certificate is required but no CA is given")
+		}
+		return tlsConfig, nil
+	}
+
+	rootCA, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootCA) {
+		return nil, fmt.Errorf("fail to load ca content")
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// clientCertName return the common name of the verified client
+// certificate, or empty if the client has no certificate.
+func clientCertName(client *broker.Client) string {
+	var conn net.Conn
+
+	switch c := client.Conn().(type) {
+	case *transport.NetConn:
+		conn = c.UnderlyingConn()
+	case *transport.WebSocketConn:
+		conn = c.UnderlyingConn().UnderlyingConn()
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) < 1 || len(state.PeerCertificates) < 1 {
+		return ""
+	}
+
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"testing"
+	"math/big"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"path/filepath"
+	"crypto/x509/pkix"
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport"
+)
+
+// createCert create a certificate signed by parent, or self-signed if parent is nil.
+func createCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed (%v)", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:	big.NewInt(time.Now().UnixNano()),
+		Subject:		pkix.Name{CommonName: name},
+		NotBefore:		time.Now().Add(-time.Hour),
+		NotAfter:		time.Now().Add(time.Hour),
+		KeyUsage:		x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:	[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:	[]net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate failed (%v)", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtttls")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caPEM, _ := createCert(t, "ca", nil, nil)
+	_, _, serverPEM, serverKeyPEM := createCert(t, "edge", ca, caKey)
+	_, _, clientPEM, clientKeyPEM := createCert(t, "gateway01", ca, caKey)
+	files := map[string][]byte{"ca.crt": caPEM, "server.crt": serverPEM, "server.key": serverKeyPEM,
+						"users.json": []byte(`{"users":[{"username":"gateway01","devices":["sensor-*"]}]}`)}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), content, 0600)
+	}
+
+	m := NewMqttServer(100, "ssl://127.0.0.1:0", false, 0, nil)
+	if err := m.Run(); err == nil {
+		m.closeServers()
+		t.Fatalf("secure listener is launched without certificate")
+	}
+
+	tlsConfig, err := CreateTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "server.crt"),
+								filepath.Join(dir, "server.key"), true)
+	if err != nil {
+		t.Fatalf("create tls config failed (%v)", err)
+	}
+	auth, err := LoadMqttAuth(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatalf("load users failed (%v)", err)
+	}
+	m.SetTLSConfig(tlsConfig)
+	m.SetAuth(auth)
+	if err := m.Run(); err != nil {
+		t.Fatalf("launch secure listener failed (%v)", err)
+	}
+	defer m.closeServers()
+	url := "ssl://" + m.servers[0].Addr().String()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	connect := func(certPEM, keyPEM []byte) (*client.Client, error) {
+		clientTLS := &tls.Config{RootCAs: pool}
+		if certPEM != nil {
+			cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+			clientTLS.Certificates = []tls.Certificate{cert}
+		}
+		config := client.NewConfig(url)
+		config.Dialer = transport.NewDialer(transport.DialConfig{TLSConfig: clientTLS})
+
+		c := client.New()
+		future, err := c.Connect(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := future.Wait(time.Second); err != nil {
+			return nil, err
+		}
+		if future.ReturnCode() != packet.ConnectionAccepted {
+			return nil, fmt.Errorf("connection refused (%v)", future.ReturnCode())
+		}
+		return c, nil
+	}
+
+	if c, err := connect(nil, nil); err == nil {
+		c.Close()
+		t.Errorf("client without certificate is connected")
+	}
+
+	// the user is authenticated by the common name of certificate.
+	c, err := connect(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatalf("client with certificate is not connected (%v)", err)
+	}
+	defer c.Close()
+
+	future, err := c.Publish("$hw/events/twin/sensor-01/device/dgtwin/Update/twins", []byte(`{"twin":{"id":"sensor-01"}}`),
+						packet.QOSAtLeastOnce, false)
+	if err != nil || future.Wait(time.Second) != nil {
+		t.Errorf("publish to own device failed (%v)", err)
+	}
+	future, err = c.Publish("$hw/events/twin/switch-01/device/dgtwin/Update/twins", nil, packet.QOSAtLeastOnce, false)
+	if err == nil && future.Wait(time.Second) == nil {
+		t.Errorf("publish to other device is allowed")
+	}
+}
@@ -2,23 +2,30 @@ package mqtt
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 	"strings"
+	"encoding/json"
 	"k8s.io/klog"
 	"github.com/jwzl/mqtt/client"
 	"github.com/jwzl/wssocket/fifo"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/trace"
+	"github.com/jwzl/edgeOn/msghub/queue"
 	"github.com/jwzl/edgeOn/msghub/config"
 )
 
 const (
 	//mqtt topic should has the format:
-	// mqtt/dgtwin/cloud[edge]/{edgeID}/comm for communication.
+	// mqtt/dgtwin/cloud[edge]/{edgeID}/comm[/{traceID}] for communication.
 	// mqtt/dgtwin/cloud[edge]/{edgeID}/control  for some control message.
 	MQTT_SUBTOPIC_PREFIX	= "mqtt/dgtwin/cloud"
 	MQTT_PUBTOPIC_PREFIX	= "mqtt/dgtwin/edge"
+
+	// interval to retry the queued messages.
+	MQTT_QUEUE_RETRY_INTERVAL	= 3*time.Second
 )
 
 type MqttClient	struct {
@@ -29,6 +36,15 @@ type MqttClient	struct {
 	client		*client.Client
 	// message fifo.
 	messageFifo *fifo.MessageFifo
+	// outbound queue for the messages which can't be published,
+	// nil means the messages are dropped.
+	queue		*queue.DiskQueue
+	// broker is reachable.
+	online		bool
+	drainChan	chan struct{}
+	// closed when the client is closed, it stops the drain loop.
+	stopChan	chan struct{}
+	closeOnce	sync.Once
 }	
 
 func NewMqttClient(conf *config.MqttConfig) *MqttClient {
@@ -61,11 +77,25 @@ func NewMqttClient(conf *config.MqttConfig) *MqttClient {
 	}
 	c.SetTlsConfig(tlsConfig)
 
+	q, err := queue.NewDiskQueue(queue.QueueConfig{
+		Path:		conf.QueuePath,
+		MaxSize:	conf.QueueMaxSize,
+		MaxAge:		time.Duration(conf.QueueMaxAge) * time.Second,
+		DropPolicy:	conf.QueueDropPolicy,
+	})
+	if err != nil {
+		klog.Errorf("Open outbound queue %s failed (%v), messages will be dropped while broker is unreachable", conf.QueuePath, err)
+		q = nil
+	}
+
 	return &MqttClient{
 		isBind: false,
 		conf: conf,
 		client: c,
 		messageFifo: fifo.NewMessageFifo(0),
+		queue: q,
+		drainChan: make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
 	}
 }
 
@@ -90,10 +120,21 @@ restart_mqtt:
 		return err
 	}
 
+	//send all queued messages.
+	c.mutex.Lock()
+	c.online = true
+	c.mutex.Unlock()
+	if c.queue != nil {
+		go c.drainQueue()
+	}
+
 	return nil
 }
 
 func (c *MqttClient) Close(){
+	c.closeOnce.Do(func() {
+		close(c.stopChan)
+	})
 	c.client.Close()
 }
 
@@ -103,11 +144,15 @@ func (c *MqttClient) messageArrived(topic string, msg *model.Message){
 	}
 
 	splitString := strings.Split(topic, "/")
-	if len(splitString) != 5 {
+	if len(splitString) != 5 && len(splitString) != 6 {
 		klog.Infof("topic =(%v),  msg ignored", splitString)
 		return
 	} 
 	if strings.Contains(splitString[4], "comm") {
+		if len(splitString) == 6 {
+			// join the trace of cloud if it's known.
+			trace.Join(msg, splitString[5])
+		}
 		// put the model message into fifo.
 		c.messageFifo.Write(msg)
 	}else if strings.Contains(splitString[4], "bind") {
@@ -120,7 +165,9 @@ func (c *MqttClient) messageArrived(topic string, msg *model.Message){
 		modelMsg := common.BuildModelMessage(common.HubModuleName, common.CloudName, 
 				common.DGTWINS_OPS_RESPONSE, common.DGTWINS_RESOURCE_EDGE, info)
 		modelMsg.SetTag(msg.GetID())	 		
-		c.WriteMessage("", modelMsg)
+		if _, err := c.WriteMessage("", modelMsg); err != nil {
+			klog.Warningf("Report edge information failed (%v)", err)
+		}
 		// start go rountine to send heartbeat.
 		if true != c.isBind {
 			go c.SendHeartBeat(*modelMsg)
@@ -131,21 +178,126 @@ func (c *MqttClient) messageArrived(topic string, msg *model.Message){
 	}
 }
 
+//IsOnline return true if the broker is reachable.
+func (c *MqttClient) IsOnline() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.online
+}
+
 //ReadMessage read the message from fifo. 
 func (c *MqttClient) ReadMessage() (*model.Message, error){
 	return c.messageFifo.Read()
 }
 
 //WriteMessage publish the message to cloud.
-func (c *MqttClient) WriteMessage(clientID string, msg *model.Message) error {
+// the message is queued if broker is unreachable or there are queued
+// messages, and it will be sent in order after the broker is reachable.
+// it returns true if the message is queued.
+func (c *MqttClient) WriteMessage(clientID string, msg *model.Message) (bool, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	if clientID == "" {
 		clientID = c.conf.ClientID
 	}
-	pubTopic := fmt.Sprintf("%s/%s/comm", MQTT_PUBTOPIC_PREFIX, clientID)
-	return c.client.Publish(pubTopic, msg)
+	pubTopic := fmt.Sprintf("%s/%s/comm/%s", MQTT_PUBTOPIC_PREFIX, clientID, trace.Start(msg))
+	if c.queue == nil {
+		return false, c.client.Publish(pubTopic, msg)
+	}
+
+	if c.online && c.queue.Len() < 1 {
+		err := c.client.Publish(pubTopic, msg)
+		if err == nil {
+			return false, nil
+		}
+		klog.Warningf("Publish message failed (%v), queue it", err)
+		c.online = false
+	}
+
+	err := c.queue.Push(pubTopic, coalesceKey(msg), msg)
+	if err != nil {
+		return false, err
+	}
+	c.notifyDrain()
+
+	return true, nil
+}
+
+func (c *MqttClient) notifyDrain() {
+	select {
+	case c.drainChan <- struct{}{}:
+	default:
+	}
+}
+
+// drainQueue send the queued messages in order, it stops at the first
+// failed message and retry it later. the messages are published without
+// the lock, the new messages are queued until the queue is empty.
+func (c *MqttClient) drainQueue() {
+	for {
+		select {
+		case <-c.drainChan:
+		case <-time.After(MQTT_QUEUE_RETRY_INTERVAL):
+		case <-c.stopChan:
+			return
+		}
+
+		for {
+			select {
+			case <-c.stopChan:
+				return
+			default:
+			}
+
+			topic, msg, err := c.queue.Peek()
+			if err != nil {
+				break
+			}
+			err = c.client.Publish(topic, msg)
+			c.setOnline(err == nil)
+			if err != nil {
+				klog.Warningf("Broker is unreachable (%v), %d messages queued", err, c.queue.Len())
+				break
+			}
+			c.queue.Remove(msg.GetID())
+		}
+	}
+}
+
+func (c *MqttClient) setOnline(online bool) {
+	c.mutex.Lock()
+	c.online = online
+	c.mutex.Unlock()
+}
+
+// coalesceKey return the key of the twin properties in Sync message, the
+// queued message with the same key is replaced by the later one.
+func coalesceKey(msg *model.Message) string {
+	if msg.GetOperation() != common.DGTWINS_OPS_SYNC {
+		return ""
+	}
+	content, ok := msg.GetContent().([]byte)
+	if !ok {
+		return ""
+	}
+
+	var twinMsg common.TwinMessage
+	if err := json.Unmarshal(content, &twinMsg); err != nil || len(twinMsg.Twins) != 1 {
+		return ""
+	}
+	twin := twinMsg.Twins[0]
+	names := make([]string, 0)
+	for name, _ := range twin.Properties.Desired {
+		names = append(names, common.TWIN_PROP_KIND_DESIRED+"."+name)
+	}
+	for name, _ := range twin.Properties.Reported {
+		names = append(names, common.TWIN_PROP_KIND_REPORTED+"."+name)
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("%s/%s/%s/%s", msg.GetTarget(), msg.GetResource(), twin.ID, strings.Join(names, ","))
 }
 
 func (c *MqttClient) SendHeartBeat(msg model.Message){
@@ -0,0 +1,374 @@
+package rest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"strconv"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/msghub/types"
+	"github.com/jwzl/edgeOn/msghub/config"
+)
+
+/*
+* REST API of twins, each request is translated into a twin message to
+* edge/dgtwin, and is replied by the correlated response.
+*	GET		/twins/{id}							Get twin
+*	PUT		/twins/{id}							Create twin
+*	PATCH	/twins/{id}							Update desired properties
+*	DELETE	/twins/{id}							Delete twin
+*	GET		/twins/{id}/properties/{name}		Get property
+*	PUT		/twins/{id}/properties/{name}		Update desired property
+*	PATCH	/twins/{id}/properties/{name}		Update desired property
+*	DELETE	/twins/{id}/properties/{name}		Delete property
+* the kind (desired or reported) of property can be given by query ?kind=.
+*	GET		/events								Stream the twin events
+*	GET		/traces/{id}						Get the spans of message trace
+* the REST callers are not authenticated, all requests are sent as the
+* same principal edge/app/{app-id}, so the server should just listen on
+* localhost (or be protected by the access rules of this principal).
+*/
+const (
+	REST_PATH_TWINS			= "twins"
+	REST_PATH_PROPERTIES	= "properties"
+)
+
+type RESTServer struct {
+	conf			*config.RestServerConfig
+	server			*http.Server
+	//message from REST requests.
+	messageInChan	chan *model.Message
+	// closed when the server is closed, it stops the senders of
+	// messageInChan and the router.
+	done			chan struct{}
+	closeOnce		sync.Once
+	// requests which wait for response, key is the request
+	// message ID, value is chan *model.Message.
+	pending			*sync.Map
+	// clients of events, and the count of clients which watch each twin.
+	clientsMutex	sync.Mutex
+	clients			map[*sseClient]bool
+	watchCount		map[string]int
+}
+
+// NewRESTServer Create REST server.
+func NewRESTServer(conf *config.RestServerConfig) *RESTServer {
+	if conf == nil {
+		return nil
+	}
+
+	var pending sync.Map
+	rs := &RESTServer{
+		conf:			conf,
+		messageInChan:	make(chan *model.Message, 128),
+		done:			make(chan struct{}),
+		pending:		&pending,
+		clients:		make(map[*sseClient]bool),
+		watchCount:		make(map[string]int),
+	}
+	rs.server = &http.Server{
+		Addr:		conf.URL,
+		Handler:	rs,
+	}
+
+	return rs
+}
+
+func (rs *RESTServer) Start() {
+	klog.Infof("Start the REST server, listen: %s.....", rs.conf.URL)
+	go rs.rewatchLoop()
+
+	var err error
+	if rs.conf.CertFilePath != "" && rs.conf.KeyFilePath != "" {
+		err = rs.server.ListenAndServeTLS(rs.conf.CertFilePath, rs.conf.KeyFilePath)
+	}else {
+		err = rs.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		klog.Errorf("REST server stopped (%v)", err)
+	}
+}
+
+// Close close the server, the message channel is kept open since the
+// requests being closed may still send messages, they're stopped by Done.
+func (rs *RESTServer) Close() {
+	rs.closeOnce.Do(func() {
+		close(rs.done)
+	})
+	rs.server.Close()
+}
+
+// GetMessageChan return the channel of request messages.
+func (rs *RESTServer) GetMessageChan() chan *model.Message {
+	return rs.messageInChan
+}
+
+// Done return the channel which is closed when the server is closed.
+func (rs *RESTServer) Done() <-chan struct{} {
+	return rs.done
+}
+
+// Source return the source of all request messages.
+func (rs *RESTServer) Source() string {
+	return types.EdgeAppName + "/" + rs.conf.AppID
+}
+
+// IsTarget check the message is to this server.
+func (rs *RESTServer) IsTarget(target string) bool {
+	return target == rs.Source()
+}
+
+// DeliverMessage pass the response to the waiting request, the
+// message which has no waiting request is dropped. the Sync message
+// is relayed to the clients of events.
+func (rs *RESTServer) DeliverMessage(msg *model.Message) {
+	if msg.GetOperation() == common.DGTWINS_OPS_SYNC {
+		rs.PublishSync(msg)
+		rs.ackSync(msg)
+		return
+	}
+
+	v, exist := rs.pending.Load(msg.GetTag())
+	if !exist {
+		klog.Infof("No request waits for message (%s), Ignored", msg.GetID())
+		return
+	}
+
+	select {
+	case v.(chan *model.Message) <- msg:
+	default:
+	}
+}
+
+func (rs *RESTServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for key, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid path")
+			return
+		}
+		segments[key] = unescaped
+	}
+
+	if len(segments) == 1 && segments[0] == REST_PATH_EVENTS {
+		rs.serveEvents(w, r)
+		return
+	}
+	if len(segments) == 2 && segments[0] == REST_PATH_TRACES {
+		rs.serveTrace(w, r, segments[1])
+		return
+	}
+
+	var msg *model.Message
+	var status int
+	var err error
+	switch {
+	case len(segments) == 2 && segments[0] == REST_PATH_TWINS:
+		msg, status, err = rs.twinRequest(r, segments[1])
+	case len(segments) == 4 && segments[0] == REST_PATH_TWINS && segments[2] == REST_PATH_PROPERTIES:
+		msg, status, err = rs.propertyRequest(r, segments[1], segments[3])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	w.Header().Set(REST_HEADER_MESSAGE_ID, msg.GetID())
+
+	resp, err := rs.request(r, msg)
+	if err != nil {
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	writeResponse(w, resp)
+}
+
+// twinRequest translate the request of twin into twin message.
+func (rs *RESTServer) twinRequest(r *http.Request, twinID string) (*model.Message, int, error) {
+	twin := common.DigitalTwin{}
+	var operation, resource string
+
+	switch r.Method {
+	case http.MethodGet:
+		operation, resource = common.DGTWINS_OPS_GET, common.DGTWINS_RESOURCE_TWINS
+	case http.MethodPut:
+		operation, resource = common.DGTWINS_OPS_CREATE, common.DGTWINS_RESOURCE_TWINS
+		if err := readBody(r, &twin); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	case http.MethodPatch:
+		operation, resource = common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_PROPERTY
+		if err := readBody(r, &twin); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	case http.MethodDelete:
+		operation, resource = common.DGTWINS_OPS_DELETE, common.DGTWINS_RESOURCE_TWINS
+		version, err := queryVersion(r)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		twin.Version = version
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method)
+	}
+	twin.ID = twinID
+
+	return rs.buildMessage(operation, resource, &twin)
+}
+
+// propertyRequest translate the request of property into twin message.
+func (rs *RESTServer) propertyRequest(r *http.Request, twinID, name string) (*model.Message, int, error) {
+	twin := common.DigitalTwin{ID: twinID}
+	prop := &common.TwinProperty{}
+	var operation string
+
+	switch r.Method {
+	case http.MethodGet:
+		operation = common.DGTWINS_OPS_GET
+	case http.MethodPut, http.MethodPatch:
+		operation = common.DGTWINS_OPS_UPDATE
+		if err := readBody(r, prop); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	case http.MethodDelete:
+		operation = common.DGTWINS_OPS_DELETE
+		version, err := queryVersion(r)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		prop.Version = version
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method)
+	}
+	prop.Name = name
+
+	props := map[string]*common.TwinProperty{name: prop}
+	kind := r.URL.Query().Get("kind")
+	switch kind {
+	case common.TWIN_PROP_KIND_DESIRED:
+		twin.Properties.Desired = props
+	case common.TWIN_PROP_KIND_REPORTED:
+		if operation == common.DGTWINS_OPS_UPDATE {
+			return nil, http.StatusBadRequest, fmt.Errorf("reported property can't be updated")
+		}
+		twin.Properties.Reported = props
+	case "":
+		twin.Properties.Desired = props
+		// get both desired and reported property by default.
+		if operation == common.DGTWINS_OPS_GET {
+			twin.Properties.Reported = props
+		}
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid property kind %q", kind)
+	}
+
+	return rs.buildMessage(operation, common.DGTWINS_RESOURCE_PROPERTY, &twin)
+}
+
+func (rs *RESTServer) buildMessage(operation, resource string, twin *common.DigitalTwin) (*model.Message, int, error) {
+	content, err := common.BuildTwinMessage([]common.DigitalTwin{*twin})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	msg := common.BuildModelMessage(rs.Source(), types.TwinModuleName, operation, resource, content)
+
+	return msg, http.StatusOK, nil
+}
+
+// request send the request message, and wait for the response
+// which is tagged with the request message ID.
+func (rs *RESTServer) request(r *http.Request, msg *model.Message) (*model.Message, error) {
+	respChan := make(chan *model.Message, 1)
+	rs.pending.Store(msg.GetID(), respChan)
+	defer rs.pending.Delete(msg.GetID())
+
+	timer := time.NewTimer(time.Duration(rs.conf.Timeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case rs.messageInChan <- msg:
+	case <-timer.C:
+		return nil, fmt.Errorf("Timeout to send request")
+	case <-rs.done:
+		return nil, fmt.Errorf("REST server is closed")
+	}
+
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("Timeout to wait for response")
+	case <-rs.done:
+		return nil, fmt.Errorf("REST server is closed")
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+func readBody(r *http.Request, v interface{}) error {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(content) < 1 {
+		return nil
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("Invalid body (%v)", err)
+	}
+
+	return nil
+}
+
+func queryVersion(r *http.Request) (uint64, error) {
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid version %q", version)
+	}
+
+	return v, nil
+}
+
+// writeResponse write the twin response, the response code is used as HTTP
+// status if it is a valid HTTP status.
+func writeResponse(w http.ResponseWriter, msg *model.Message) {
+	content, ok := msg.Content.([]byte)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "invaliad message content")
+		return
+	}
+
+	status := http.StatusOK
+	resp, err := common.UnMarshalResponseMessage(msg)
+	if err == nil && resp.Code >= 100 && resp.Code < 600 {
+		status = resp.Code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	content, _ := common.BuildResponseMessage(status, reason, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
@@ -0,0 +1,114 @@
+package rest
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"net/http/httptest"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/msghub/types"
+	"github.com/jwzl/edgeOn/msghub/config"
+)
+
+// responder reply each request message by the reply func.
+func responder(rs *RESTServer, reply func(msg *model.Message) (int, []common.DigitalTwin)) {
+	for msg := range rs.GetMessageChan() {
+		code, twins := reply(msg)
+		content, _ := common.BuildResponseMessage(code, "", twins)
+		resp := common.BuildModelMessage(types.TwinModuleName, msg.GetSource(), 
+					common.DGTWINS_OPS_RESPONSE, msg.GetResource(), content)
+		resp.SetTag(msg.GetID())
+		rs.DeliverMessage(resp)
+	}
+}
+
+func doRequest(t *testing.T, method, url, body string) (int, *common.TwinResponse) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed (%v)", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	content, _ := ioutil.ReadAll(resp.Body)
+	twinResp := &common.TwinResponse{}
+	if err := json.Unmarshal(content, twinResp); err != nil {
+		t.Fatalf("invalid response body %s", content)
+	}
+
+	return resp.StatusCode, twinResp
+}
+
+func TestRESTRequests(t *testing.T) {
+	rs := NewRESTServer(&config.RestServerConfig{AppID: "rest", Timeout: 1})
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	requests := make(chan *model.Message, 16)
+	go responder(rs, func(msg *model.Message) (int, []common.DigitalTwin) {
+		requests <- msg
+		twinMsg := &common.TwinMessage{}
+		json.Unmarshal(msg.Content.([]byte), twinMsg)
+		if twinMsg.Twins[0].ID == "missing" {
+			return common.NotFoundCode, nil
+		}
+		return common.RequestSuccessCode, twinMsg.Twins
+	})
+
+	status, resp := doRequest(t, http.MethodGet, server.URL+"/twins/dev001", "")
+	if status != http.StatusOK || len(resp.Twins) != 1 || resp.Twins[0].ID != "dev001" {
+		t.Errorf("GET twin failed (%d %v)", status, resp)
+	}
+	msg := <-requests
+	if msg.GetSource() != "edge/app/rest" || msg.GetTarget() != types.TwinModuleName ||
+			msg.GetOperation() != common.DGTWINS_OPS_GET || msg.GetResource() != common.DGTWINS_RESOURCE_TWINS {
+		t.Errorf("unexpected request message %v", msg.Router)
+	}
+
+	status, resp = doRequest(t, http.MethodPut, server.URL+"/twins/dev001/properties/temp?kind=desired", `{"value":"MjA="}`)
+	if status != http.StatusOK {
+		t.Errorf("PUT property failed (%d %v)", status, resp)
+	}
+	msg = <-requests
+	twinMsg := &common.TwinMessage{}
+	json.Unmarshal(msg.Content.([]byte), twinMsg)
+	prop := twinMsg.Twins[0].Properties.Desired["temp"]
+	if msg.GetOperation() != common.DGTWINS_OPS_UPDATE || msg.GetResource() != common.DGTWINS_RESOURCE_PROPERTY ||
+			prop == nil || string(prop.Value) != "20" {
+		t.Errorf("unexpected property update message %v", msg.Router)
+	}
+
+	status, _ = doRequest(t, http.MethodDelete, server.URL+"/twins/missing", "")
+	if status != http.StatusNotFound {
+		t.Errorf("DELETE missing twin should be 404, but got %d", status)
+	}
+	<-requests
+
+	status, _ = doRequest(t, http.MethodPost, server.URL+"/twins/dev001", "")
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("POST should not be allowed, but got %d", status)
+	}
+	status, _ = doRequest(t, http.MethodGet, server.URL+"/devices/dev001", "")
+	if status != http.StatusNotFound {
+		t.Errorf("unknown path should be 404, but got %d", status)
+	}
+	status, _ = doRequest(t, http.MethodPatch, server.URL+"/twins/dev001", "{")
+	if status != http.StatusBadRequest {
+		t.Errorf("invalid body should be 400, but got %d", status)
+	}
+}
+
+func TestRESTTimeout(t *testing.T) {
+	rs := NewRESTServer(&config.RestServerConfig{AppID: "rest", Timeout: 1})
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	// no response for the request.
+	status, _ := doRequest(t, http.MethodGet, server.URL+"/twins/dev001", "")
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("request should be timeout, but got %d", status)
+	}
+}
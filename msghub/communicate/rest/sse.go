@@ -0,0 +1,273 @@
+package rest
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"net/http"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/msghub/types"
+)
+
+/*
+* Server-sent events of twins.
+*	GET		/events?twin={id}&property={name}
+* the Sync messages of twins and property are relayed to the client as
+* events, the event type is the resource and the data is the twin message.
+* twin and property can be repeated or comma-separated, twin is required
+* and no property means all properties. the properties of twins are watched
+* on behalf of the client, so the property events are just relayed for the
+* twins in filter. the watches are kept in memory of dgtwin, so they are
+* sent again periodically in case dgtwin is restarted.
+*/
+const (
+	REST_PATH_EVENTS		= "events"
+
+	// interval to send keepalive comment to client.
+	SSE_KEEPALIVE_INTERVAL	= 15*time.Second
+	SSE_EVENT_BUFFER		= 64
+	// interval to send the watches of clients again.
+	SSE_REWATCH_INTERVAL	= 60*time.Second
+)
+
+type sseClient struct {
+	// filter of twin IDs and property names, empty names means all.
+	twins		map[string]bool
+	names		map[string]bool
+	events		chan []byte
+}
+
+// filter return the twins which match the filter of client, the properties
+// are filtered by names. the property message without any matched property
+// is dropped.
+func (c *sseClient) filter(resource string, twins []common.DigitalTwin) []common.DigitalTwin {
+	matched := make([]common.DigitalTwin, 0)
+
+	for _, twin := range twins {
+		if len(c.twins) > 0 && !c.twins[twin.ID] {
+			continue
+		}
+		twin.Properties.Desired = c.filterProperties(twin.Properties.Desired)
+		twin.Properties.Reported = c.filterProperties(twin.Properties.Reported)
+		if resource == common.DGTWINS_RESOURCE_PROPERTY &&
+				len(twin.Properties.Desired) < 1 && len(twin.Properties.Reported) < 1 {
+			continue
+		}
+		matched = append(matched, twin)
+	}
+
+	return matched
+}
+
+func (c *sseClient) filterProperties(props map[string]*common.TwinProperty) map[string]*common.TwinProperty {
+	if len(c.names) < 1 || len(props) < 1 {
+		return props
+	}
+
+	filtered := make(map[string]*common.TwinProperty)
+	for name, prop := range props {
+		if c.names[name] {
+			filtered[name] = prop
+		}
+	}
+	if len(filtered) < 1 {
+		return nil
+	}
+
+	return filtered
+}
+
+// queryList return all values of the query key, the value can be comma-separated.
+func queryList(r *http.Request, key string) map[string]bool {
+	list := make(map[string]bool)
+
+	for _, value := range r.URL.Query()[key] {
+		for _, item := range strings.Split(value, ",") {
+			if item != "" {
+				list[item] = true
+			}
+		}
+	}
+
+	return list
+}
+
+// serveEvents stream the events to client until it is disconnected.
+func (rs *RESTServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	client := &sseClient{
+		twins:	queryList(r, "twin"),
+		names:	queryList(r, "property"),
+		events:	make(chan []byte, SSE_EVENT_BUFFER),
+	}
+	if len(client.twins) < 1 {
+		writeError(w, http.StatusBadRequest, "twin is required")
+		return
+	}
+	rs.addClient(client)
+	defer rs.removeClient(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-client.events:
+			w.Write(event)
+		case <-keepalive.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case <-r.Context().Done():
+			return
+		case <-rs.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (rs *RESTServer) addClient(client *sseClient) {
+	watchTwins := make([]common.DigitalTwin, 0)
+
+	rs.clientsMutex.Lock()
+	rs.clients[client] = true
+	for twinID, _ := range client.twins {
+		rs.watchCount[twinID]++
+		if rs.watchCount[twinID] == 1 {
+			watchTwins = append(watchTwins, common.DigitalTwin{ID: twinID})
+		}
+	}
+	rs.clientsMutex.Unlock()
+
+	// watch the properties of twins which are not watched yet.
+	rs.watch(watchTwins)
+}
+
+func (rs *RESTServer) watch(twins []common.DigitalTwin) {
+	if len(twins) > 0 {
+		content, _ := common.BuildTwinMessage(twins)
+		rs.sendMessage(common.BuildModelMessage(rs.Source(), types.TwinModuleName,
+					common.DGTWINS_OPS_WATCH, common.DGTWINS_RESOURCE_PROPERTY, content))
+	}
+}
+
+// rewatchLoop send the watches of all watched twins periodically, the
+// watch is idempotent in dgtwin.
+func (rs *RESTServer) rewatchLoop() {
+	ticker := time.NewTicker(SSE_REWATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rs.rewatch()
+		case <-rs.done:
+			return
+		}
+	}
+}
+
+func (rs *RESTServer) rewatch() {
+	watchTwins := make([]common.DigitalTwin, 0)
+
+	rs.clientsMutex.Lock()
+	for twinID, _ := range rs.watchCount {
+		watchTwins = append(watchTwins, common.DigitalTwin{ID: twinID})
+	}
+	rs.clientsMutex.Unlock()
+
+	rs.watch(watchTwins)
+}
+
+func (rs *RESTServer) removeClient(client *sseClient) {
+	closeTwins := make([]common.DigitalTwin, 0)
+
+	rs.clientsMutex.Lock()
+	delete(rs.clients, client)
+	for twinID, _ := range client.twins {
+		rs.watchCount[twinID]--
+		if rs.watchCount[twinID] <= 0 {
+			delete(rs.watchCount, twinID)
+			closeTwins = append(closeTwins, common.DigitalTwin{ID: twinID})
+		}
+	}
+	rs.clientsMutex.Unlock()
+
+	// close the watch of twins which no client is interested in.
+	if len(closeTwins) > 0 {
+		content, _ := common.BuildResponseMessage(common.CloseWatchCode, "Close watch", closeTwins)
+		rs.sendMessage(common.BuildModelMessage(rs.Source(), types.TwinModuleName,
+					common.DGTWINS_OPS_RESPONSE, common.DGTWINS_RESOURCE_PROPERTY, content))
+	}
+}
+
+// PublishSync relay the Sync message of twins and property to
+// the clients of events.
+func (rs *RESTServer) PublishSync(msg *model.Message) {
+	resource := msg.GetResource()
+	if resource != common.DGTWINS_RESOURCE_TWINS && resource != common.DGTWINS_RESOURCE_PROPERTY {
+		return
+	}
+	twinMsg, err := common.UnMarshalTwinMessage(msg)
+	if err != nil {
+		klog.Warningf("Invalid sync message (%s), Ignored", msg.GetID())
+		return
+	}
+
+	rs.clientsMutex.Lock()
+	defer rs.clientsMutex.Unlock()
+
+	for client, _ := range rs.clients {
+		twins := client.filter(resource, twinMsg.Twins)
+		if len(twins) < 1 {
+			continue
+		}
+
+		data, err := json.Marshal(&common.TwinMessage{Twins: twins})
+		if err != nil {
+			continue
+		}
+		event := fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", msg.GetID(), resource, data)
+		select {
+		case client.events <- []byte(event):
+		default:
+			klog.Warningf("Events client is too slow, drop the event (%s)", msg.GetID())
+		}
+	}
+}
+
+// ackSync reply the Sync message, so it will not be resent.
+func (rs *RESTServer) ackSync(msg *model.Message) {
+	content, _ := common.BuildResponseMessage(common.RequestSuccessCode, "Synced", nil)
+	resp := common.BuildModelMessage(rs.Source(), types.TwinModuleName,
+				common.DGTWINS_OPS_RESPONSE, msg.GetResource(), content)
+	resp.SetTag(msg.GetID())
+
+	rs.sendMessage(resp)
+}
+
+func (rs *RESTServer) sendMessage(msg *model.Message) {
+	select {
+	case rs.messageInChan <- msg:
+	case <-time.After(time.Duration(rs.conf.Timeout) * time.Second):
+		klog.Warningf("Timeout to send message (%s), Ignored", msg.GetID())
+	case <-rs.done:
+		klog.Warningf("REST server is closed, message (%s) is ignored", msg.GetID())
+	}
+}
@@ -0,0 +1,164 @@
+package rest
+
+import (
+	"time"
+	"bufio"
+	"strings"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/msghub/types"
+	"github.com/jwzl/edgeOn/msghub/config"
+)
+
+func buildSyncMessage(target, resource string, twins []common.DigitalTwin) *model.Message {
+	content, _ := common.BuildTwinMessage(twins)
+	return common.BuildModelMessage(types.TwinModuleName, target, common.DGTWINS_OPS_SYNC, resource, content)
+}
+
+func receiveMessage(t *testing.T, rs *RESTServer) *model.Message {
+	select {
+	case msg := <-rs.GetMessageChan():
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("no message from REST server")
+	}
+
+	return nil
+}
+
+// readEvent read the next event, the keepalive comments are skipped.
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string, *common.TwinMessage) {
+	var id, event string
+	twinMsg := &common.TwinMessage{}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event failed (%v)", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, twinMsg
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), twinMsg)
+		}
+	}
+}
+
+func TestRESTEvents(t *testing.T) {
+	rs := NewRESTServer(&config.RestServerConfig{AppID: "rest", Timeout: 1})
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?twin=dev001&property=temp")
+	if err != nil {
+		t.Fatalf("GET events failed (%v)", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected events response (%d %s)", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	// the properties of twin in filter are watched.
+	msg := receiveMessage(t, rs)
+	twinMsg, _ := common.UnMarshalTwinMessage(msg)
+	if msg.GetOperation() != common.DGTWINS_OPS_WATCH || msg.GetResource() != common.DGTWINS_RESOURCE_PROPERTY ||
+			msg.GetSource() != rs.Source() || len(twinMsg.Twins) != 1 || twinMsg.Twins[0].ID != "dev001" {
+		t.Fatalf("unexpected watch message %v", msg.Router)
+	}
+
+	props := map[string]*common.TwinProperty{
+		"temp":		&common.TwinProperty{Name: "temp", Value: []byte("20")},
+		"humidity":	&common.TwinProperty{Name: "humidity", Value: []byte("50")},
+	}
+	twin := common.DigitalTwin{ID: "dev002"}
+	twin.Properties.Reported = props
+	rs.DeliverMessage(buildSyncMessage(rs.Source(), common.DGTWINS_RESOURCE_PROPERTY, []common.DigitalTwin{twin}))
+	twin.ID = "dev001"
+	sync := buildSyncMessage(rs.Source(), common.DGTWINS_RESOURCE_PROPERTY, []common.DigitalTwin{twin})
+	rs.DeliverMessage(sync)
+
+	// each Sync message is replied.
+	for i := 0; i < 2; i++ {
+		ack := receiveMessage(t, rs)
+		if ack.GetOperation() != common.DGTWINS_OPS_RESPONSE || ack.GetTarget() != types.TwinModuleName {
+			t.Errorf("unexpected ack message %v", ack.Router)
+		}
+	}
+
+	id, event, twinMsg := readEvent(t, reader)
+	if id != sync.GetID() || event != common.DGTWINS_RESOURCE_PROPERTY || len(twinMsg.Twins) != 1 ||
+			twinMsg.Twins[0].ID != "dev001" || len(twinMsg.Twins[0].Properties.Reported) != 1 ||
+			twinMsg.Twins[0].Properties.Reported["temp"] == nil {
+		t.Errorf("unexpected property event %s %s %v", id, event, twinMsg)
+	}
+
+	// the twin state to cloud is relayed too.
+	state := buildSyncMessage(common.CloudName, common.DGTWINS_RESOURCE_TWINS,
+				[]common.DigitalTwin{common.DigitalTwin{ID: "dev001", State: common.DGTWINS_STATE_ONLINE}})
+	rs.PublishSync(state)
+	id, event, twinMsg = readEvent(t, reader)
+	if id != state.GetID() || event != common.DGTWINS_RESOURCE_TWINS || len(twinMsg.Twins) != 1 ||
+			twinMsg.Twins[0].State != common.DGTWINS_STATE_ONLINE {
+		t.Errorf("unexpected twins event %s %s %v", id, event, twinMsg)
+	}
+
+	// the watches are sent again, e.g. after dgtwin is restarted.
+	rs.rewatch()
+	msg = receiveMessage(t, rs)
+	twinMsg, _ = common.UnMarshalTwinMessage(msg)
+	if msg.GetOperation() != common.DGTWINS_OPS_WATCH || len(twinMsg.Twins) != 1 || twinMsg.Twins[0].ID != "dev001" {
+		t.Fatalf("unexpected rewatch message %v", msg.Router)
+	}
+
+	// the client without twin is rejected, since dgtwin can't watch all twins.
+	noTwin, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET events failed (%v)", err)
+	}
+	noTwin.Body.Close()
+	if noTwin.StatusCode != http.StatusBadRequest {
+		t.Errorf("events without twin should be rejected, status %d", noTwin.StatusCode)
+	}
+
+	// the watch is closed after the client is disconnected.
+	resp.Body.Close()
+	msg = receiveMessage(t, rs)
+	closeResp, _ := common.UnMarshalResponseMessage(msg)
+	if msg.GetOperation() != common.DGTWINS_OPS_RESPONSE || closeResp == nil ||
+			closeResp.Code != common.CloseWatchCode || len(closeResp.Twins) != 1 {
+		t.Errorf("unexpected close watch message %v", msg.Router)
+	}
+}
+
+// TestRESTClose test the server is closed with the client of events.
+func TestRESTClose(t *testing.T) {
+	rs := NewRESTServer(&config.RestServerConfig{AppID: "rest", Timeout: 1})
+	server := httptest.NewServer(rs)
+
+	resp, err := http.Get(server.URL + "/events?twin=dev001")
+	if err != nil {
+		t.Fatalf("GET events failed (%v)", err)
+	}
+	defer resp.Body.Close()
+	receiveMessage(t, rs)
+
+	// the stream is ended, and its watch is closed without panic.
+	rs.Close()
+	server.Close()
+	select {
+	case <-rs.Done():
+	default:
+		t.Errorf("server should be done after close")
+	}
+	rs.Close()
+}
@@ -0,0 +1,46 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"encoding/json"
+	"github.com/jwzl/edgeOn/common/trace"
+)
+
+/*
+* Spans of message trace.
+*	GET		/traces/{id}
+* id is the message ID or trace ID, the spans of whole trace which the
+* message belongs to are returned. the message ID of each REST request is
+* given by X-Message-Id header of its response.
+*/
+const (
+	REST_PATH_TRACES		= "traces"
+	REST_HEADER_MESSAGE_ID	= "X-Message-Id"
+)
+
+type traceResponse struct {
+	ID		string			`json:"id"`
+	Spans	[]trace.Span	`json:"spans"`
+}
+
+func (rs *RESTServer) serveTrace(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method))
+		return
+	}
+
+	spans := trace.Spans(id)
+	if spans == nil {
+		writeError(w, http.StatusNotFound, "Trace not found")
+		return
+	}
+
+	content, err := json.Marshal(&traceResponse{ID: id, Spans: spans})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
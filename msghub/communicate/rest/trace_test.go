@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"time"
+	"testing"
+	"net/http"
+	"encoding/json"
+	"net/http/httptest"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/trace"
+	"github.com/jwzl/edgeOn/msghub/config"
+)
+
+func TestRESTTrace(t *testing.T) {
+	rs := NewRESTServer(&config.RestServerConfig{AppID: "rest", Timeout: 1})
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	go responder(rs, func(msg *model.Message) (int, []common.DigitalTwin) {
+		trace.Record("edge/dgtwin", msg, time.Now(), trace.SPAN_OUTCOME_OK)
+		return common.RequestSuccessCode, nil
+	})
+
+	resp, err := http.Get(server.URL + "/twins/dev001")
+	if err != nil {
+		t.Fatalf("GET twin failed (%v)", err)
+	}
+	resp.Body.Close()
+	msgID := resp.Header.Get(REST_HEADER_MESSAGE_ID)
+	if msgID == "" {
+		t.Fatalf("response without message ID")
+	}
+
+	resp, err = http.Get(server.URL + "/traces/" + msgID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET trace failed (%v %v)", err, resp)
+	}
+	traceResp := &traceResponse{}
+	json.NewDecoder(resp.Body).Decode(traceResp)
+	resp.Body.Close()
+	if len(traceResp.Spans) != 1 || traceResp.Spans[0].MessageID != msgID || traceResp.Spans[0].TraceID != msgID {
+		t.Errorf("unexpected spans %v", traceResp.Spans)
+	}
+
+	resp, _ = http.Get(server.URL + "/traces/unknown")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET unknown trace return %d", resp.StatusCode)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/jwzl/wssocket/server"
 	"github.com/jwzl/wssocket/model"
 	"github.com/jwzl/wssocket/conn"
+	"github.com/jwzl/edgeOn/msghub/types"
 	"github.com/jwzl/edgeOn/msghub/config"	
 )
 
@@ -86,14 +87,13 @@ func (wss *WSServer) MessageProcess(headers http.Header, msg *model.Message, c *
 		return
 	}
 
-	//update the source.
-	source := msg.GetSource()
-	if source == "" {
-		klog.Infof("msg.source is empty, Ignore...")
+	//the source is always the app of connection, the source in message
+	// is ignored, so the app can't send as other principal (e.g. cloud).
+	if appID == "" {
+		klog.Infof("app_id is empty, Ignore...")
 		return
-    }
-	source = fmt.Sprintf("%s/%s",source, appID)
-	msg.Router.Source = source
+	}
+	msg.Router.Source = fmt.Sprintf("%s/%s", types.EdgeAppName, appID)
 
 	select {
 	case wss.messageInChan <- msg:
@@ -177,6 +177,17 @@ func (wss *WSServer) keepaliveCheckLoop(appID string, stop chan int){
 		}
 	}
 } 
+//ConnectionCount return the count of connected apps.
+func (wss *WSServer) ConnectionCount() int {
+	count := 0
+	wss.conns.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+
+	return count
+}
+
 //HubIOWrite: write message to connection.
 func (wss *WSServer) HubIOWrite(appID string, msg *model.Message) error {
 	v, exist := wss.conns.Load(appID)
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"testing"
+	"net/http"
+	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/beehive/pkg/core/context"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/dgtwin/types"
+	"github.com/jwzl/edgeOn/dgtwin/dtcontext"
+)
+
+// TestMessageSource test the app can't spoof the source to escape
+// the access rules of the app.
+func TestMessageSource(t *testing.T) {
+	wss := &WSServer{messageInChan: make(chan *model.Message, 128)}
+	headers := http.Header{}
+	headers.Set("app_id", "thirdparty")
+
+	content, _ := common.BuildTwinMessage([]common.DigitalTwin{common.DigitalTwin{ID: "switch01"}})
+	msg := common.BuildModelMessage(common.CloudName, types.MODULE_NAME,
+				common.DGTWINS_OPS_UPDATE, common.DGTWINS_RESOURCE_PROPERTY, content)
+	wss.MessageProcess(headers, msg, nil)
+	msg = <-wss.messageInChan
+	if msg.GetSource() != "edge/app/thirdparty" {
+		t.Fatalf("unexpected source %s", msg.GetSource())
+	}
+
+	dtc := dtcontext.NewDTContext(context.GetContext(context.MsgCtxTypeChannel))
+	dtc.ACLPolicy = &types.ACLPolicy{
+		Default: types.ACL_EFFECT_ALLOW,
+		Rules: []types.ACLRule{
+			{Effect: types.ACL_EFFECT_DENY, Sources: []string{"edge/app/thirdparty"}},
+		},
+	}
+	if denied := dtc.Authorize(msg); len(denied) != 1 || denied[0].TwinID != "switch01" {
+		t.Errorf("spoofed source should be denied (%v)", denied)
+	}
+
+	// the message without app is dropped.
+	wss.MessageProcess(http.Header{}, msg, nil)
+	if len(wss.messageInChan) != 0 {
+		t.Errorf("message without app_id should be dropped")
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"k8s.io/klog"
 	"github.com/jwzl/beehive/pkg/common/config"
 )
@@ -17,6 +18,14 @@ type MqttConfig struct {
 	QOS				 	int
 	Retain			   	bool	
 	MessageCacheDepth  	uint
+	// outbound queue for cloud messages while the broker is unreachable.
+	QueuePath			string
+	// max total size (byte) of queued messages.
+	QueueMaxSize		int64
+	// max age (second) of queued messages.
+	QueueMaxAge			int
+	// oldest or coalesce.
+	QueueDropPolicy		string
 }
 
 func GetMqttConfig() (*MqttConfig, error) {
@@ -99,6 +108,34 @@ func GetMqttConfig() (*MqttConfig, error) {
 	}
 	conf.MessageCacheDepth = uint(sessionQueueSize)
 
+	queuePath, err := config.CONFIG.GetValue("msghub.mqtt.queue.path").ToString()
+	if err != nil || queuePath == "" {
+		klog.Infof("msghub.mqtt.queue.path is empty")
+		queuePath = "/var/lib/edgeOn/msghub/queue"
+	}
+	conf.QueuePath = queuePath
+
+	queueMaxSize, err := config.CONFIG.GetValue("msghub.mqtt.queue.max-size").ToInt64()
+	if err != nil || queueMaxSize < 0 {
+		klog.Infof("msghub.mqtt.queue.max-size is empty")
+		queueMaxSize = 64*1024*1024
+	}
+	conf.QueueMaxSize = queueMaxSize
+
+	queueMaxAge, err := config.CONFIG.GetValue("msghub.mqtt.queue.max-age").ToInt()
+	if err != nil || queueMaxAge < 0 {
+		klog.Infof("msghub.mqtt.queue.max-age is empty")
+		queueMaxAge = 24*60*60
+	}
+	conf.QueueMaxAge = queueMaxAge
+
+	dropPolicy, err := config.CONFIG.GetValue("msghub.mqtt.queue.drop-policy").ToString()
+	if err != nil || dropPolicy == "" {
+		klog.Infof("msghub.mqtt.queue.drop-policy is empty")
+		dropPolicy = "oldest"
+	}
+	conf.QueueDropPolicy = dropPolicy
+
 	return conf, nil
 }
 
@@ -175,3 +212,56 @@ func GetWSServerConfig() (*WebsocketServerConfig, error) {
 
 	return conf, nil
 }
+
+type RestServerConfig struct{
+	// listen address, e.g. 127.0.0.1:10001
+	URL				string
+	// requests are sent as edge/app/{AppID}.
+	AppID			string
+	// HTTPS is enabled if both cert and key are set.
+	CertFilePath    string
+	KeyFilePath     string
+	// timeout (second) to wait for the response.
+	Timeout			int
+}
+
+func GetRestServerConfig() (*RestServerConfig, error) {
+	conf := &RestServerConfig{}
+
+	url, err := config.CONFIG.GetValue("msghub.rest.url").ToString()
+	if err != nil || url == "" {
+		klog.Infof("msghub.rest.url is empty, REST server is disabled")
+		return nil, errors.New("msghub.rest.url is empty")
+	}
+	conf.URL = url
+
+	appID, err := config.CONFIG.GetValue("msghub.rest.app-id").ToString()
+	if err != nil || appID == "" {
+		klog.Infof("msghub.rest.app-id is empty")
+		appID = "rest"
+	}
+	conf.AppID = appID
+
+	certfile, err := config.CONFIG.GetValue("msghub.rest.certfile").ToString()
+	if err != nil {
+		klog.Infof("msghub.rest.certfile is empty")
+		certfile = ""
+	}
+	conf.CertFilePath = certfile
+
+	keyfile, err := config.CONFIG.GetValue("msghub.rest.keyfile").ToString()
+	if err != nil {
+		klog.Infof("msghub.rest.keyfile is empty")
+		keyfile = ""
+	}
+	conf.KeyFilePath = keyfile
+
+	timeout, err := config.CONFIG.GetValue("msghub.rest.timeout").ToInt()
+	if err != nil || timeout <= 0 {
+		klog.Infof("msghub.rest.timeout is empty")
+		timeout = 30
+	}
+	conf.Timeout = timeout
+
+	return conf, nil
+}
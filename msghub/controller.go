@@ -1,13 +1,18 @@
 package msghub
 
 import (
+	"time"
 	"strings"
 	"k8s.io/klog"
 	"github.com/jwzl/wssocket/model"
+	"github.com/jwzl/edgeOn/common"
+	"github.com/jwzl/edgeOn/common/metrics"
+	"github.com/jwzl/edgeOn/common/trace"
 	"github.com/jwzl/beehive/pkg/core/context"
 	"github.com/jwzl/edgeOn/msghub/types"
 	"github.com/jwzl/edgeOn/msghub/config"
 	"github.com/jwzl/edgeOn/msghub/communicate/mqtt"
+	"github.com/jwzl/edgeOn/msghub/communicate/rest"
 	"github.com/jwzl/edgeOn/msghub/communicate/websocket"
 )
 
@@ -19,6 +24,8 @@ type Controller struct {
 	mqtt	   *mqtt.MqttClient
 	//websocket server.
 	wsServer   *websocket.WSServer	
+	//REST server, nil means disabled.
+	restServer	*rest.RESTServer
 }
 
 func NewController(ctx *context.Context) *Controller {
@@ -64,20 +71,50 @@ func (hc * Controller)Start(){
 	
 	//Start the websocket server.
 	go hc.wsServer.Start()
+
+	// Start REST server.
+	restConf, err := config.GetRestServerConfig()
+	if err == nil {
+		hc.restServer = rest.NewRESTServer(restConf)
+		go hc.restServer.Start()
+	}
 		
-	stop := make(chan struct{}, 3)
+	hc.initMetrics()
+	stop := make(chan struct{}, 4)
 
 	go 	hc.routeToUpstream(stop)
 	go 	hc.routeFromWebsocket(stop)
 	go  hc.routeFromMqtt(stop)
+	if hc.restServer != nil {
+		go hc.routeFromRest(stop)
+	}
 
 	<-stop
 	if hc.mqtt != nil {
 		hc.mqtt.Close()
 	}
 	hc.wsServer.Close()
+	if hc.restServer != nil {
+		hc.restServer.Close()
+	}
 } 
 
+// initMetrics register the gauges of mqtt and websocket connections.
+func (hc * Controller) initMetrics() {
+	metrics.NewGaugeFunc("edgeon_msghub_mqtt_connected", "1 if the cloud mqtt broker is reachable.", nil,
+		func(observe func(value float64, labelValues ...string)) {
+			if hc.mqtt != nil && hc.mqtt.IsOnline() {
+				observe(1)
+			}else {
+				observe(0)
+			}
+		})
+	metrics.NewGaugeFunc("edgeon_msghub_websocket_connections", "Connected websocket apps.", nil,
+		func(observe func(value float64, labelValues ...string)) {
+			observe(float64(hc.wsServer.ConnectionCount()))
+		})
+}
+
 func (hc * Controller) routeToUpstream(stop chan struct{}){
 	for {
 		v, err := hc.context.Receive(types.HubModuleName)
@@ -92,22 +129,52 @@ func (hc * Controller) routeToUpstream(stop chan struct{}){
 			//invalid message type or msg == nil, Ignored. 		
 			continue
 		}
+		start := time.Now()
+		opLabel, resourceLabel := common.MetricLabels(msg.GetOperation(), msg.GetResource())
+		metrics.MessagesTotal.Inc(types.HubModuleName, opLabel, resourceLabel)
 
 		target := msg.GetTarget()
 		if strings.Contains(target, types.CloudName) {
 			// Send message over mqtt.
 			klog.Infof("Send message to cloud over mqtt..")
-			hc.mqtt.WriteMessage("", msg) 
+			queued, err := hc.mqtt.WriteMessage("", msg)
+			if err != nil {
+				klog.Warningf("Send message (%s) to cloud failed (%v)", msg.GetID(), err)
+			}else if queued && msg.GetSource() == types.TwinModuleName &&
+					msg.GetOperation() != common.DGTWINS_OPS_RESPONSE {
+				hc.sendQueued(msg)
+			}
 		}
 
-		if strings.Contains(target, types.EdgeAppName) {
+		if hc.restServer != nil && msg.GetOperation() == common.DGTWINS_OPS_SYNC &&
+				msg.GetResource() == common.DGTWINS_RESOURCE_TWINS && !hc.restServer.IsTarget(target) {
+			// the twin state is relayed to the clients of events too.
+			hc.restServer.PublishSync(msg)
+		}
+
+		if hc.restServer != nil && hc.restServer.IsTarget(target) {
+			klog.Infof("Send message to edge/app over REST..")
+			hc.restServer.DeliverMessage(msg)
+		}else if strings.Contains(target, types.EdgeAppName) {
 			klog.Infof("Send message to edge/app over websocket..")
 			msgChan := hc.wsServer.GetMessageChan(false)
 			msgChan <- msg
 		}
+		trace.Record(types.HubModuleName, msg, start, trace.SPAN_OUTCOME_OK)
 	}
 }
 
+// sendQueued tell dgtwin the message is queued, the queued message will
+// be delivered by hub, so dgtwin should not resend it or fail it.
+func (hc * Controller) sendQueued(msg *model.Message) {
+	queued := common.BuildModelMessage(types.HubModuleName, types.TwinModuleName,
+					common.DGTWINS_OPS_QUEUED, msg.GetResource(), nil)
+	queued.SetTag(msg.GetID())
+	trace.Propagate(msg, queued)
+
+	hc.context.Send(types.TwinModuleName, queued)
+}
+
 func (hc * Controller) routeFromWebsocket(stop chan struct{}){
 	for {
 		msg, ok := <-hc.wsServer.GetMessageChan(true)
@@ -121,6 +188,9 @@ func (hc * Controller) routeFromWebsocket(stop chan struct{}){
 			//msg == nil, Ignored. 		
 			continue
 		}
+		start := time.Now()
+		opLabel, resourceLabel := common.MetricLabels(msg.GetOperation(), msg.GetResource())
+		metrics.MessagesTotal.Inc(types.HubModuleName, opLabel, resourceLabel)
 
 		target := msg.GetTarget()
 		if strings.Contains(target, types.TwinModuleName) {
@@ -129,13 +199,14 @@ func (hc * Controller) routeFromWebsocket(stop chan struct{}){
 
 		if strings.Contains(target, types.CloudName) {
 			// Send message over mqtt.
-			hc.mqtt.WriteMessage("", msg) 
+			hc.mqtt.WriteMessage("", msg)
 		}
 
 		if strings.Contains(target, types.EdgeAppName) {
 			msgChan := hc.wsServer.GetMessageChan(false)
 			msgChan <- msg
 		}
+		trace.Record(types.HubModuleName, msg, start, trace.SPAN_OUTCOME_OK)
 	}
 }
 
@@ -152,6 +223,9 @@ func (hc * Controller) routeFromMqtt(stop chan struct{}){
 			//msg == nil, Ignored. 		
 			continue
 		}
+		start := time.Now()
+		opLabel, resourceLabel := common.MetricLabels(msg.GetOperation(), msg.GetResource())
+		metrics.MessagesTotal.Inc(types.HubModuleName, opLabel, resourceLabel)
 
 		target := msg.GetTarget()
 		if strings.Contains(target, types.TwinModuleName) {
@@ -160,12 +234,36 @@ func (hc * Controller) routeFromMqtt(stop chan struct{}){
 
 		if strings.Contains(target, types.CloudName) {
 			// Send message over mqtt.
-			hc.mqtt.WriteMessage("", msg) 
+			hc.mqtt.WriteMessage("", msg)
 		}
 
 		if strings.Contains(target, types.EdgeAppName) {
 			msgChan := hc.wsServer.GetMessageChan(false)
 			msgChan <- msg
 		}
+		trace.Record(types.HubModuleName, msg, start, trace.SPAN_OUTCOME_OK)
+	}
+}
+
+func (hc * Controller) routeFromRest(stop chan struct{}){
+	for {
+		var msg *model.Message
+		select {
+		case msg = <-hc.restServer.GetMessageChan():
+		case <-hc.restServer.Done():
+			klog.Infof("REST server is closed, stop routing")
+			return
+		}
+
+		if msg == nil {
+			//msg == nil, Ignored. 		
+			continue
+		}
+		start := time.Now()
+		opLabel, resourceLabel := common.MetricLabels(msg.GetOperation(), msg.GetResource())
+		metrics.MessagesTotal.Inc(types.HubModuleName, opLabel, resourceLabel)
+
+		hc.context.Send(types.TwinModuleName, msg)
+		trace.Record(types.HubModuleName, msg, start, trace.SPAN_OUTCOME_OK)
 	}
 }
@@ -0,0 +1,307 @@
+package queue
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"k8s.io/klog"
+	"github.com/jwzl/wssocket/model"
+)
+
+const (
+	// drop the oldest messages when the queue is full.
+	DropPolicyOldest	= "oldest"
+	// keep only the latest message of each twin property, and then
+	// drop the oldest messages when the queue is still full.
+	DropPolicyCoalesce	= "coalesce"
+
+	queueFileSuffix		= ".msg"
+)
+
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// QueueConfig is the config of disk queue.
+type QueueConfig struct {
+	// directory which the queued messages are saved in.
+	Path		string
+	// max total size (byte) of queued messages, 0 means no limit.
+	MaxSize		int64
+	// max age of queued message, 0 means no limit.
+	MaxAge		time.Duration
+	DropPolicy	string
+}
+
+// entry is a queued message saved in a file.
+type entry struct {
+	Timestamp	int64			`json:"timestamp"`
+	Topic		string			`json:"topic"`
+	// coalesce key, empty means never coalesced.
+	Key			string			`json:"key,omitempty"`
+	Msg			model.Message	`json:"msg"`
+	// the content of message, []byte content is kept as is
+	// and other content is kept as JSON.
+	Content		[]byte			`json:"content,omitempty"`
+	RawContent	bool			`json:"raw,omitempty"`
+
+	seq			uint64
+	size		int64
+}
+
+// DiskQueue is a FIFO queue of messages, each message is saved in a
+// file named by its sequence, so the queue is kept after restart.
+type DiskQueue struct {
+	mutex		sync.Mutex
+	conf		QueueConfig
+	entries		[]*entry
+	size		int64
+	nextSeq		uint64
+}
+
+// NewDiskQueue open the queue in conf.Path and load all queued messages.
+func NewDiskQueue(conf QueueConfig) (*DiskQueue, error) {
+	if conf.DropPolicy == "" {
+		conf.DropPolicy = DropPolicyOldest
+	}
+	if conf.DropPolicy != DropPolicyOldest && conf.DropPolicy != DropPolicyCoalesce {
+		return nil, fmt.Errorf("unsupported drop policy %q", conf.DropPolicy)
+	}
+	if err := os.MkdirAll(conf.Path, 0700); err != nil {
+		return nil, err
+	}
+
+	dq := &DiskQueue{conf: conf, entries: make([]*entry, 0), nextSeq: 1}
+	if err := dq.load(); err != nil {
+		return nil, err
+	}
+
+	return dq, nil
+}
+
+func (dq *DiskQueue) load() error {
+	files, err := ioutil.ReadDir(dq.conf.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, queueFileSuffix) {
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(dq.conf.Path, name))
+			}
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dq.conf.Path, name))
+		if err != nil {
+			return err
+		}
+		e := &entry{}
+		if err := json.Unmarshal(content, e); err != nil {
+			klog.Warningf("Drop broken queued message %s (%v)", name, err)
+			os.Remove(filepath.Join(dq.conf.Path, name))
+			continue
+		}
+		e.seq = seq
+		e.size = int64(len(content))
+
+		dq.entries = append(dq.entries, e)
+		dq.size += e.size
+	}
+
+	sort.Slice(dq.entries, func(i, j int) bool {
+		return dq.entries[i].seq < dq.entries[j].seq
+	})
+	if len(dq.entries) > 0 {
+		dq.nextSeq = dq.entries[len(dq.entries)-1].seq + 1
+	}
+	klog.Infof("%d messages loaded from queue %s", len(dq.entries), dq.conf.Path)
+
+	return nil
+}
+
+func (dq *DiskQueue) fileName(seq uint64) string {
+	return filepath.Join(dq.conf.Path, fmt.Sprintf("%020d%s", seq, queueFileSuffix))
+}
+
+// Push append the message to the tail of queue, the key is used
+// to coalesce the messages of the same twin property. the message
+// which is already queued (e.g. resent by dgtwin) is not queued again.
+func (dq *DiskQueue) Push(topic, key string, msg *model.Message) error {
+	e := &entry{
+		Timestamp:	time.Now().UnixNano() / 1e6,
+		Topic:		topic,
+		Key:		key,
+		Msg:		*msg,
+	}
+	e.Msg.Content = nil
+	if raw, ok := msg.Content.([]byte); ok {
+		e.Content = raw
+		e.RawContent = true
+	}else if msg.Content != nil {
+		content, err := json.Marshal(msg.Content)
+		if err != nil {
+			return err
+		}
+		e.Content = content
+	}
+
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	if dq.find(msg.GetID()) >= 0 {
+		klog.Infof("Message (%s) is already queued", msg.GetID())
+		return nil
+	}
+	e.seq = dq.nextSeq
+	e.size = int64(len(content))
+	if err := writeFile(dq.fileName(e.seq), content); err != nil {
+		return err
+	}
+	dq.nextSeq++
+
+	if dq.conf.DropPolicy == DropPolicyCoalesce && key != "" {
+		for i := len(dq.entries) - 1; i >= 0; i-- {
+			if dq.entries[i].Key == key {
+				klog.Infof("Coalesce queued message (%s)", key)
+				dq.remove(i)
+			}
+		}
+	}
+	dq.entries = append(dq.entries, e)
+	dq.size += e.size
+
+	// drop the oldest messages when the queue is full.
+	dq.expire()
+	for dq.conf.MaxSize > 0 && dq.size > dq.conf.MaxSize && len(dq.entries) > 1 {
+		klog.Warningf("Queue is full, drop the oldest message (%s)", dq.entries[0].Msg.GetID())
+		dq.remove(0)
+	}
+
+	return nil
+}
+
+// Peek return the topic and message at the head of queue.
+func (dq *DiskQueue) Peek() (string, *model.Message, error) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	dq.expire()
+	if len(dq.entries) < 1 {
+		return "", nil, ErrQueueEmpty
+	}
+
+	e := dq.entries[0]
+	msg := e.Msg
+	if e.RawContent {
+		msg.Content = e.Content
+	}else if len(e.Content) > 0 {
+		msg.Content = json.RawMessage(e.Content)
+	}
+
+	return e.Topic, &msg, nil
+}
+
+// Pop remove the message at the head of queue.
+func (dq *DiskQueue) Pop() {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	if len(dq.entries) > 0 {
+		dq.remove(0)
+	}
+}
+
+// Remove remove the message by its ID, the message may be not at
+// the head since it can be coalesced or dropped while it's sent.
+func (dq *DiskQueue) Remove(msgID string) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	if index := dq.find(msgID); index >= 0 {
+		dq.remove(index)
+	}
+}
+
+func (dq *DiskQueue) find(msgID string) int {
+	for index, e := range dq.entries {
+		if e.Msg.GetID() == msgID {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// Len return the count of queued messages.
+func (dq *DiskQueue) Len() int {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	return len(dq.entries)
+}
+
+// expire drop the messages which are older than MaxAge.
+func (dq *DiskQueue) expire() {
+	if dq.conf.MaxAge <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-dq.conf.MaxAge).UnixNano() / 1e6
+	for len(dq.entries) > 0 && dq.entries[0].Timestamp < deadline {
+		klog.Warningf("Drop the expired message (%s)", dq.entries[0].Msg.GetID())
+		dq.remove(0)
+	}
+}
+
+func (dq *DiskQueue) remove(index int) {
+	e := dq.entries[index]
+	if err := os.Remove(dq.fileName(e.seq)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Remove queued message failed (%v)", err)
+	}
+
+	dq.size -= e.size
+	dq.entries = append(dq.entries[:index], dq.entries[index+1:]...)
+}
+
+// writeFile write the file atomically.
+func writeFile(name string, content []byte) error {
+	tmp := name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
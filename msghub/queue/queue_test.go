@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"os"
+	"time"
+	"testing"
+	"io/ioutil"
+	"github.com/jwzl/wssocket/model"
+)
+
+func newTestQueue(t *testing.T, conf QueueConfig) (*DiskQueue, string) {
+	dir, err := ioutil.TempDir("", "msgqueue")
+	if err != nil {
+		t.Fatalf("create temp dir failed (%v)", err)
+	}
+	conf.Path = dir
+
+	dq, err := NewDiskQueue(conf)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed (%v)", err)
+	}
+
+	return dq, dir
+}
+
+func newTestMessage(content string) *model.Message {
+	msg := model.NewMessage("")
+	msg.BuildRouter("edge/dgtwin", "", "cloud", "property", "Sync")
+	msg.FillBody([]byte(content))
+
+	return msg
+}
+
+func TestPushAndReload(t *testing.T) {
+	dq, dir := newTestQueue(t, QueueConfig{})
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{"1", "2", "3"} {
+		if err := dq.Push("topic", "", newTestMessage(content)); err != nil {
+			t.Fatalf("Push failed (%v)", err)
+		}
+	}
+	dq.Pop()
+
+	// reopen the queue like a restart.
+	dq, err := NewDiskQueue(QueueConfig{Path: dir})
+	if err != nil || dq.Len() != 2 {
+		t.Fatalf("reload queue failed (%v)", err)
+	}
+	topic, msg, err := dq.Peek()
+	if err != nil || topic != "topic" || string(msg.GetContent().([]byte)) != "2" {
+		t.Fatalf("unexpected head message (%v, %v)", msg, err)
+	}
+
+	dq.Push("topic", "", newTestMessage("4"))
+	dq.Pop()
+	dq.Pop()
+	_, msg, _ = dq.Peek()
+	if string(msg.GetContent().([]byte)) != "4" {
+		t.Fatalf("messages are not in order (%v)", msg)
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	dq, dir := newTestQueue(t, QueueConfig{DropPolicy: DropPolicyCoalesce})
+	defer os.RemoveAll(dir)
+
+	dq.Push("topic", "dev001/temp", newTestMessage("1"))
+	dq.Push("topic", "dev001/humi", newTestMessage("2"))
+	dq.Push("topic", "dev001/temp", newTestMessage("3"))
+	if dq.Len() != 2 {
+		t.Fatalf("messages of same property should be coalesced, len = %d", dq.Len())
+	}
+	_, msg, _ := dq.Peek()
+	if string(msg.GetContent().([]byte)) != "2" {
+		t.Fatalf("coalesced message should be at tail (%v)", msg)
+	}
+
+	// size limit.
+	size := dq.size
+	dq.conf.MaxSize = size
+	dq.Push("topic", "", newTestMessage("4"))
+	if dq.Len() != 2 {
+		t.Fatalf("oldest message should be dropped, len = %d", dq.Len())
+	}
+	_, msg, _ = dq.Peek()
+	if string(msg.GetContent().([]byte)) != "3" {
+		t.Fatalf("unexpected head message (%v)", msg)
+	}
+
+	// age limit.
+	dq.conf.MaxAge = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if _, _, err := dq.Peek(); err != ErrQueueEmpty {
+		t.Fatalf("expired messages should be dropped")
+	}
+}
+
+func TestPushDuplicated(t *testing.T) {
+	dq, dir := newTestQueue(t, QueueConfig{})
+	defer os.RemoveAll(dir)
+
+	msg := newTestMessage("1")
+	dq.Push("topic", "", msg)
+	dq.Push("topic", "", newTestMessage("2"))
+	// the resent message is not queued again.
+	dq.Push("topic", "", msg)
+	if dq.Len() != 2 {
+		t.Fatalf("resent message should not be queued, len = %d", dq.Len())
+	}
+
+	// the sent message is removed by ID even if it's not at the head.
+	dq.Remove(msg.GetID())
+	_, head, _ := dq.Peek()
+	if dq.Len() != 1 || string(head.GetContent().([]byte)) != "2" {
+		t.Fatalf("unexpected queue after remove (%v)", head)
+	}
+}
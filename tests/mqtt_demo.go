@@ -141,7 +141,7 @@ func (hc * Controller) messageArrived(topic string, msg *model.Message){
 	}
 	klog.Infof("message Arrived. topic =(%v),  msg %v", topic, msg)
 	splitString := strings.Split(topic, "/")
-	if len(splitString) != 5 {
+	if len(splitString) < 5 {
 		klog.Infof("topic =(%v),  msg ignored", splitString)
 		return
 	} 